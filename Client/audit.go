@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	auditLogPath = flag.String("audit-log", "", `Local audit log of everything the server runs here (default <user config dir>/gofrpclient/audit.log, "off" disables)`)
+	auditMaxSize = flag.Int("audit-max-size", 10, "Size in megabytes at which the audit log is rotated")
+	auditKeep    = flag.Int("audit-keep", 5, "Rotated audit logs to keep")
+)
+
+// auditEntry is one line of the local audit log. It is written by the
+// client for the owner of the machine; the server has no say in it.
+type auditEntry struct {
+	Time      time.Time   `json:"time"`
+	Server    string      `json:"server,omitempty"`
+	Command   string      `json:"command"`
+	Operation string      `json:"operation"`
+	Decision  string      `json:"decision"` // allowed or denied
+	Reason    string      `json:"reason,omitempty"`
+	ExitCode  *int        `json:"exit_code,omitempty"`
+	Files     []auditFile `json:"files,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// auditFile is a file the operation read, wrote or captured
+type auditFile struct {
+	Path   string `json:"path"`
+	Access string `json:"access"` // read, written or screenshot
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// newAuditEntry starts the entry for a command received from the server
+func newAuditEntry(command string) *auditEntry {
+	e := &auditEntry{Time: time.Now(), Command: command, Operation: operation(command), Decision: "allowed"}
+	if server, ok := activeServer.Load().(string); ok {
+		e.Server = server
+	}
+	return e
+}
+
+func (e *auditEntry) deny(reason string) {
+	e.Decision, e.Reason = "denied", reason
+}
+
+// finish records how the command ended
+func (e *auditEntry) finish(err error) {
+	code := exitCode(err)
+	e.ExitCode = &code
+	if err != nil {
+		e.Error = err.Error()
+	}
+}
+
+// auditLog appends entries to the audit file, rotating it at maxSize
+type auditLog struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+	keep    int
+}
+
+var localAudit = &auditLog{}
+
+// auditPath is where the audit log is kept, or "" if it is disabled
+func auditPath() string {
+	switch *auditLogPath {
+	case "off":
+		return ""
+	case "":
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			dir = "."
+		}
+		return filepath.Join(dir, "gofrpclient", "audit.log")
+	}
+	return *auditLogPath
+}
+
+// openAuditLog opens the audit log configured with the flags
+func openAuditLog() error {
+	a := localAudit
+	a.path = auditPath()
+	a.maxSize = int64(*auditMaxSize) << 20
+	a.keep = *auditKeep
+	if a.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.size = f, stat.Size()
+	return nil
+}
+
+func (a *auditLog) record(e *auditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+
+	if a.maxSize > 0 && a.size >= a.maxSize {
+		a.file.Close()
+		a.file = nil
+		if err := os.Rename(a.path, a.path+"."+time.Now().Format("20060102-150405.000")); err != nil {
+			log.Printf("Failed to rotate audit log: %v", err)
+		}
+		if err := a.open(); err != nil {
+			log.Printf("Failed to open audit log: %v", err)
+			return
+		}
+		rotated := rotatedAuditFiles(a.path)
+		for a.keep > 0 && len(rotated) > a.keep {
+			os.Remove(rotated[0])
+			rotated = rotated[1:]
+		}
+	}
+
+	line, _ := json.Marshal(e)
+	n, err := a.file.Write(append(line, '\n'))
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+// close flushes and closes the log; later entries are dropped
+func (a *auditLog) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Sync()
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+// protects reports whether path is the audit log or one of its rotated
+// files, which the server may not overwrite
+func (a *auditLog) protects(path string) bool {
+	if a.path == "" {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	logPath, _ := filepath.Abs(a.path)
+	return abs == logPath || strings.HasPrefix(abs, logPath+".")
+}
+
+// rotatedAuditFiles lists the rotated files of path, oldest first
+func rotatedAuditFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	sort.Strings(matches)
+	return matches
+}
+
+// digest is the size and SHA-256 of what is written to it
+type digest struct {
+	h hash.Hash
+	n int64
+}
+
+func newDigest() *digest {
+	return &digest{h: sha256.New()}
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	d.n += int64(len(p))
+	return d.h.Write(p)
+}
+
+func (d *digest) file(path, access string) auditFile {
+	return auditFile{Path: path, Access: access, Size: d.n, SHA256: hex.EncodeToString(d.h.Sum(nil))}
+}
+
+// runAudit implements "gofrpclient audit": print the local audit log
+func runAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	config := fs.String("config", "", "Client configuration file, for its audit_log setting")
+	file := fs.String("audit-log", "", "Audit log to read (default: the configured one)")
+	last := fs.Int("n", 50, "Show the last N entries (0 shows all)")
+	raw := fs.Bool("json", false, "Print the entries as JSON lines")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s audit [-config FILE] [-audit-log FILE] [-n N] [-json]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	*configPath = *config
+	if err := loadConfig(); err != nil {
+		fmt.Printf("Error: failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+	if *file != "" {
+		*auditLogPath = *file
+	}
+	path := auditPath()
+	if path == "" {
+		fmt.Println("The audit log is disabled")
+		os.Exit(1)
+	}
+
+	var lines []string
+	for _, name := range append(rotatedAuditFiles(path), path) {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		f.Close()
+	}
+	if len(lines) == 0 {
+		fmt.Printf("No entries in %s\n", path)
+		return
+	}
+	if *last > 0 && len(lines) > *last {
+		lines = lines[len(lines)-*last:]
+	}
+
+	for _, line := range lines {
+		if *raw {
+			fmt.Println(line)
+			continue
+		}
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			fmt.Printf("(unreadable entry: %v)\n", err)
+			continue
+		}
+		result := e.Decision
+		if e.Reason != "" {
+			result += ": " + e.Reason
+		}
+		if e.ExitCode != nil {
+			result += fmt.Sprintf(", exit %d", *e.ExitCode)
+		}
+		fmt.Printf("%s  %-22s  %-10s  %s  [%s]\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Server, e.Operation, e.Command, result)
+		for _, f := range e.Files {
+			fmt.Printf("%21s%s %s (%d bytes, sha256 %s)\n", "", f.Access, f.Path, f.Size, f.SHA256)
+		}
+		if e.Error != "" {
+			fmt.Printf("%21serror: %s\n", "", e.Error)
+		}
+	}
+}
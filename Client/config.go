@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"gofrpprotocol"
+)
+
+var (
+	configPath = flag.String("config", "", "YAML configuration file; its settings override the command line flags")
+	clientName = flag.String("name", "", "Display name shown on the server (defaults to the host name)")
+	idFile     = flag.String("id-file", "", "File holding the persistent client ID (created on first run)")
+)
+
+// Config is everything the client can be configured with. Command line
+// flags provide the defaults, the file given with -config overrides them.
+type Config struct {
+	Servers   []string        `yaml:"servers"` // host[:port], tried as with -server
+	Port      string          `yaml:"port"`
+	Key       string          `yaml:"key"`
+	Name      string          `yaml:"name"`
+	Tags      []string        `yaml:"tags"`
+	IDFile    string          `yaml:"id_file"`
+	Transport string          `yaml:"transport"`
+	WSPath    string          `yaml:"ws_path"`
+	Insecure  bool            `yaml:"insecure"`
+	QUICPin   string          `yaml:"quic_fingerprint"`
+	Proxy     string          `yaml:"proxy"`
+	Reconnect ReconnectConfig `yaml:"reconnect"`
+	Heartbeat HeartbeatConfig `yaml:"heartbeat"`
+	Metrics   time.Duration   `yaml:"metrics_interval"`
+	Audit     AuditConfig     `yaml:"audit"`
+	Shutdown  time.Duration   `yaml:"shutdown_timeout"`
+	LogFile   string          `yaml:"log_file"`
+	UpdateKey string          `yaml:"update_key"`
+
+	// Limit and ForwardLimit are rates such as 500KB/s, see -limit and
+	// -forward-limit
+	Limit        string `yaml:"limit"`
+	ForwardLimit string `yaml:"forward_limit"`
+
+	// Allow lists the operations the server may run here (cmd, ps, proc,
+	// send, screenshot, forward, ls, upload, update, client-quit). Empty
+	// allows all.
+	Allow []string `yaml:"allow"`
+	// ForwardTargets are host:port globs forwards may connect to. Empty
+	// allows any target.
+	ForwardTargets []string `yaml:"forward_targets"`
+}
+
+type ReconnectConfig struct {
+	Failover string        `yaml:"failover"` // order or round-robin
+	Base     time.Duration `yaml:"base"`
+	Max      time.Duration `yaml:"max"`
+}
+
+type HeartbeatConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Misses   int           `yaml:"misses"`
+}
+
+// AuditConfig is the local audit log, see -audit-log
+type AuditConfig struct {
+	File    string `yaml:"file"`
+	MaxSize int    `yaml:"max_size"` // megabytes
+	Keep    int    `yaml:"keep"`
+}
+
+// clientConfig holds the settings that have no flag of their own
+var clientConfig = &Config{}
+
+// loadConfig reads the -config file and applies it over the flags
+func loadConfig() error {
+	if *configPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(*configPath)
+	if err != nil {
+		return err
+	}
+	c := &Config{}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parse %s: %v", *configPath, err)
+	}
+
+	settings := map[string]string{
+		"server":             strings.Join(c.Servers, ","),
+		"port":               c.Port,
+		"key":                c.Key,
+		"name":               c.Name,
+		"id-file":            c.IDFile,
+		"transport":          c.Transport,
+		"ws-path":            c.WSPath,
+		"quic-fingerprint":   c.QUICPin,
+		"proxy":              c.Proxy,
+		"failover":           c.Reconnect.Failover,
+		"retry-base":         durationSetting(c.Reconnect.Base),
+		"retry-max":          durationSetting(c.Reconnect.Max),
+		"heartbeat-interval": durationSetting(c.Heartbeat.Interval),
+		"metrics-interval":   durationSetting(c.Metrics),
+		"audit-log":          c.Audit.File,
+		"shutdown-timeout":   durationSetting(c.Shutdown),
+		"log-file":           c.LogFile,
+		"update-key":         c.UpdateKey,
+		"limit":              c.Limit,
+		"forward-limit":      c.ForwardLimit,
+	}
+	if c.Heartbeat.Misses > 0 {
+		settings["heartbeat-misses"] = strconv.Itoa(c.Heartbeat.Misses)
+	}
+	if c.Audit.MaxSize > 0 {
+		settings["audit-max-size"] = strconv.Itoa(c.Audit.MaxSize)
+	}
+	if c.Audit.Keep > 0 {
+		settings["audit-keep"] = strconv.Itoa(c.Audit.Keep)
+	}
+	if c.Insecure {
+		settings["insecure"] = "true"
+	}
+	for name, value := range settings {
+		if value == "" {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	clientConfig = c
+	return nil
+}
+
+func durationSetting(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// loadClientID returns the persistent ID of this client, creating it on
+// first run. It survives reconnects and address changes, so the server can
+// tell the same machine apart from a new one.
+func loadClientID() (string, error) {
+	name := *idFile
+	if name == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			dir = "."
+		}
+		name = filepath.Join(dir, "gofrpclient", "client_id")
+	}
+
+	if data, err := os.ReadFile(name); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(name, []byte(id+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// clientIdentity is sent to the server after AUTH; it is our hello
+var clientIdentity protocol.ClientInfo
+
+func newIdentity(id string) protocol.ClientInfo {
+	hostname, _ := os.Hostname()
+	name := *clientName
+	if name == "" {
+		name = hostname
+	}
+	return protocol.ClientInfo{
+		ID:       id,
+		Name:     name,
+		Tags:     clientConfig.Tags,
+		Hostname: hostname,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Version:  version,
+
+		Protocol:     protocol.Version,
+		MinProtocol:  minServerProtocol,
+		Capabilities: capabilities,
+		Compression:  protocol.Encodings,
+	}
+}
+
+// operationAllowed checks a server command against the allow list
+func operationAllowed(message string) bool {
+	if len(clientConfig.Allow) == 0 {
+		return true
+	}
+	op := operation(message)
+	if op == "help" {
+		return true
+	}
+	for _, a := range clientConfig.Allow {
+		if a == op {
+			return true
+		}
+	}
+	return false
+}
+
+// operation is the name the allow list uses for a command
+func operation(message string) string {
+	if message == "cmd capture screen" {
+		return "screenshot"
+	}
+	switch msg, _ := protocol.Parse(message); msg.(type) {
+	case protocol.NewConnection:
+		return "forward"
+	case protocol.UploadStart:
+		return "upload"
+	case protocol.UpdateStart:
+		return "update"
+	}
+	op, _, _ := strings.Cut(message, " ")
+	return op
+}
+
+// forwardTargetAllowed checks a forward target against forward_targets
+func forwardTargetAllowed(target string) bool {
+	if len(clientConfig.ForwardTargets) == 0 {
+		return true
+	}
+	for _, pattern := range clientConfig.ForwardTargets {
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gofrpprotocol"
+)
+
+// handleListCommand implements "ls [path]". The first line is "# <absolute
+// path>", then one "<d|f>\t<size>\t<modified>\t<name>" line per entry,
+// directories first.
+func handleListCommand(conn net.Conn, message string) {
+	dir := strings.TrimSpace(strings.TrimPrefix(message, "ls"))
+	if dir == "" {
+		dir = "."
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		sendResponse(conn, nil, err)
+		return
+	}
+
+	entries, err := os.ReadDir(abs)
+	if err != nil {
+		sendResponse(conn, nil, err)
+		return
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].IsDir() && !entries[j].IsDir()
+	})
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "# %s\n", abs)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		kind, size := "f", info.Size()
+		if e.IsDir() {
+			kind, size = "d", 0
+		}
+		fmt.Fprintf(&out, "%s\t%d\t%s\t%s\n", kind, size, info.ModTime().Format("2006-01-02 15:04"), e.Name())
+	}
+	sendResponse(conn, []byte(out.String()), nil)
+}
+
+// receiveUpload reads a file the server pushes as start, Chunk lines and
+// UploadEnd from reader and writes it to its path. Every frame goes to
+// frame first, which keeps a long upload from looking like a dead
+// connection and handles the frames the server sends in between.
+func receiveUpload(conn net.Conn, reader *protocol.Reader, start protocol.UploadStart, frame func(protocol.Message) bool) {
+	header := start.String()
+	dest, size := start.Path, start.Size
+	conn = framed(conn)
+
+	// Counted until the partial file is gone, see shutdown
+	activeUploads.Add(1)
+	defer activeUploads.Add(-1)
+
+	entry := newAuditEntry(header)
+	entry.Command = fmt.Sprintf("upload %s (%d bytes)", dest, size)
+	defer localAudit.record(entry)
+
+	// Chunks are consumed even when the upload is refused, so they are not
+	// taken for commands
+	var file *os.File
+	var refused, err error
+	if !operationAllowed(header) {
+		refused = fmt.Errorf("operation %q is not allowed on this client", "upload")
+		entry.deny("not allowed by the client configuration")
+	} else if localAudit.protects(dest) {
+		refused = fmt.Errorf("%s is the client's audit log", dest)
+		entry.deny("the audit log cannot be overwritten")
+	} else if file, err = os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".part*"); err != nil {
+		refused = err
+	}
+	sum := newDigest()
+	if file != nil {
+		defer os.Remove(file.Name())
+		defer file.Close()
+	}
+
+	log.Printf("Receiving upload: %s (%d bytes)", dest, size)
+	started := time.Now()
+	var written int64
+	for {
+		msg, err := reader.Read()
+		if err != nil && !errors.Is(err, protocol.ErrMalformed) {
+			log.Printf("Upload of %s interrupted: %v", dest, err)
+			entry.finish(fmt.Errorf("interrupted: %v", err))
+			return
+		}
+		if frame(msg) {
+			continue
+		}
+		if _, ok := msg.(protocol.UploadEnd); ok {
+			break
+		}
+		if refused != nil {
+			continue
+		}
+
+		chunk, ok := msg.(protocol.Chunk)
+		if !ok {
+			refused = fmt.Errorf("malformed chunk")
+			continue
+		}
+		_, err = file.Write(chunk.Data)
+		sum.Write(chunk.Data)
+		if err != nil {
+			refused = err
+			continue
+		}
+		written += int64(len(chunk.Data))
+	}
+
+	if refused == nil && written != size {
+		refused = fmt.Errorf("received %d of %d bytes", written, size)
+	}
+	if refused == nil {
+		refused = file.Close()
+	}
+	if refused == nil {
+		refused = os.Rename(file.Name(), dest)
+	}
+	entry.finish(refused)
+	if refused != nil {
+		log.Printf("Upload of %s failed: %v", dest, refused)
+		sendResponse(conn, nil, fmt.Errorf("upload of %s failed: %v", dest, refused))
+		return
+	}
+
+	entry.Files = append(entry.Files, sum.file(dest, "written"))
+	log.Printf("Upload saved as %s (%d bytes in %v)", dest, written, time.Since(started).Round(time.Millisecond))
+	sendResponse(conn, []byte(fmt.Sprintf("File saved as %s (%d bytes)\n", dest, written)), nil)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"gofrpprotocol"
+)
+
+// activeServer is the address of the server we are connected to, used to
+// open data connections for forwards on non-multiplexing transports
+var activeServer atomic.Value
+
+// streamOpener is implemented by connections of multiplexing transports
+type streamOpener interface {
+	OpenStream() (net.Conn, error)
+}
+
+// handleForward serves a forward request: dial its target, then open a
+// data connection to the server and copy between the two.
+func handleForward(conn net.Conn, req protocol.NewConnection) {
+	id, target := req.ID, req.Target
+	if target == "" {
+		log.Printf("Malformed forward request: %s", req)
+		return
+	}
+
+	entry := newAuditEntry(req.String())
+	entry.Command = "forward to " + target
+
+	if !operationAllowed(req.String()) || !forwardTargetAllowed(target) {
+		log.Printf("Forward %d: target %s is not allowed by the client configuration", id, target)
+		entry.deny("target not allowed by the client configuration")
+		localAudit.record(entry)
+		protocol.Write(conn, protocol.NewConnFailed{ID: id, Reason: "target not allowed"})
+		return
+	}
+
+	local, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		entry.Error = err.Error()
+		localAudit.record(entry)
+		log.Printf("Forward %d: failed to connect to %s: %v", id, target, err)
+		protocol.Write(conn, protocol.NewConnFailed{ID: id, Reason: err.Error()})
+		return
+	}
+	localAudit.record(entry)
+
+	data, err := openDataChannel(conn)
+	if err != nil {
+		log.Printf("Forward %d: failed to open data connection: %v", id, err)
+		local.Close()
+		protocol.Write(conn, protocol.NewConnFailed{ID: id, Reason: err.Error()})
+		return
+	}
+	// The server checks the key on data connections if it can
+	msgs := []protocol.Message{protocol.NewConnection{ID: id}}
+	if hello := connectedServer.Load(); hello != nil && slices.Contains(hello.Capabilities, "forward-auth") {
+		msgs = append([]protocol.Message{protocol.Auth{Key: *authKey}}, msgs...)
+	}
+	if err := protocol.Write(data, msgs...); err != nil {
+		log.Printf("Forward %d: failed to open data connection: %v", id, err)
+		local.Close()
+		data.Close()
+		return
+	}
+
+	log.Printf("Forward %d: connected to %s", id, target)
+	go joinConn(local, data)
+	joinConn(forwardLimit.Conn(data), local)
+}
+
+// openDataChannel opens a new stream on multiplexing transports, or a new
+// connection to the server otherwise
+func openDataChannel(conn net.Conn) (net.Conn, error) {
+	if opener, ok := conn.(streamOpener); ok {
+		return opener.OpenStream()
+	}
+	addr, _ := activeServer.Load().(string)
+	if addr == "" {
+		return nil, fmt.Errorf("not connected")
+	}
+	// QUIC already fell back to TCP for this session, don't retry it
+	if _, ok := transport.(quicTransport); ok {
+		return dialServer(addr)
+	}
+	return transport.Dial(addr)
+}
+
+func joinConn(dst net.Conn, src net.Conn) {
+	defer dst.Close()
+	defer src.Close()
+	io.Copy(dst, src)
+}
@@ -2,12 +2,35 @@ module gofrmclient
 
 go 1.24.7
 
-require github.com/kbinani/screenshot v0.0.0-20250624051815-089614a94018
+require (
+	github.com/coder/websocket v1.8.13
+	github.com/kbinani/screenshot v0.0.0-20250624051815-089614a94018
+	github.com/quic-go/quic-go v0.54.1
+	github.com/shirou/gopsutil/v4 v4.25.8
+	gofrpprotocol v0.0.0
+	golang.org/x/net v0.43.0
+	golang.org/x/sys v0.35.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
+	github.com/ebitengine/purego v0.8.4 // indirect
 	github.com/gen2brain/shm v0.1.0 // indirect
+	github.com/go-ole/go-ole v1.2.6 // indirect
 	github.com/godbus/dbus/v5 v5.1.0 // indirect
 	github.com/jezek/xgb v1.1.1 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/lufia/plan9stats v0.0.0-20211012122336-39d0f177ccd0 // indirect
 	github.com/lxn/win v0.0.0-20210218163916-a377121e959e // indirect
-	golang.org/x/sys v0.35.0 // indirect
+	github.com/power-devops/perfstat v0.0.0-20240221224432-82ca36839d55 // indirect
+	github.com/tklauser/go-sysconf v0.3.15 // indirect
+	github.com/tklauser/numcpus v0.10.0 // indirect
+	github.com/yusufpapurcu/wmi v1.2.4 // indirect
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
 )
+
+replace gofrpprotocol => ../protocol
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"gofrpprotocol"
+)
+
+// errAuthFailed means the server rejected our -key
+var errAuthFailed = errors.New("server rejected the authentication key")
+
+// errHeartbeatTimeout means the server stopped answering and the client
+// should reconnect immediately instead of backing off.
+var errHeartbeatTimeout = errors.New("server missed heartbeats")
+
+// heartbeat tracks when the server was last heard from
+type heartbeat struct {
+	conn     net.Conn
+	interval time.Duration
+	misses   int
+	lastSeen atomic.Int64
+	expired  atomic.Bool
+	pinging  atomic.Bool
+}
+
+func newHeartbeat(conn net.Conn, interval time.Duration, misses int) *heartbeat {
+	hb := &heartbeat{conn: conn, interval: interval, misses: misses}
+	hb.touch()
+	return hb
+}
+
+func (hb *heartbeat) touch() {
+	hb.lastSeen.Store(time.Now().UnixNano())
+}
+
+// handle answers heartbeat frames from the server. It reports whether
+// msg was one and must not be treated as a command.
+func (hb *heartbeat) handle(msg protocol.Message) bool {
+	switch msg.(type) {
+	case protocol.KeepAlive:
+		if err := protocol.Write(hb.conn, protocol.KeepAliveAck{}); err != nil {
+			log.Printf("Failed to answer keep-alive: %v", err)
+		}
+		return true
+	case protocol.KeepAliveAck:
+		return true
+	}
+	return false
+}
+
+// run pings the server every interval and closes the connection once the
+// server has been silent for more than misses intervals.
+func (hb *heartbeat) run(done <-chan struct{}) {
+	if hb.interval <= 0 {
+		return
+	}
+	deadline := hb.interval * time.Duration(hb.misses)
+
+	ticker := time.NewTicker(hb.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			silent := time.Since(time.Unix(0, hb.lastSeen.Load()))
+			if silent > deadline {
+				log.Printf("Server silent for %v, dropping connection", silent.Round(time.Second))
+				hb.expired.Store(true)
+				hb.conn.Close()
+				return
+			}
+
+			// Don't let a write blocked on a half-open connection stall the check
+			if hb.pinging.CompareAndSwap(false, true) {
+				go func() {
+					defer hb.pinging.Store(false)
+					if err := protocol.Write(hb.conn, protocol.KeepAlive{}); err != nil {
+						log.Printf("Failed to send keep-alive: %v", err)
+					}
+				}()
+			}
+		}
+	}
+}
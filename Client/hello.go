@@ -0,0 +1,77 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"gofrpprotocol"
+)
+
+// minServerProtocol is the oldest protocol servers may speak. Servers
+// before the hello send none and speak protocol 1.
+const minServerProtocol = 1
+
+// capabilities are the commands this client handles, named like the
+// operations of the allow list, "limit" for the server's limits,
+// "transfers" for files sent and controlled as transfers of its queue,
+// "forward-auth" for forward data connections that send the auth key and
+// "update-version" for updates signed with their version
+var capabilities = []string{"cmd", "ps", "proc", "ls", "send", "screenshot", "forward", "upload", "update", "client-quit", "limit", "transfers", "forward-auth", "update-version"}
+
+// errIncompatible means the server and this client cannot work together
+var errIncompatible = errors.New("incompatible server")
+
+// connectedServer is the hello of the server we are connected to, nil
+// for servers before the hello
+var connectedServer atomic.Pointer[protocol.Hello]
+
+// handleHello checks the server's answer to our hello. The server sends
+// the reason in it when it refuses this client.
+func handleHello(hello protocol.Hello) error {
+	if hello.Error != "" {
+		return fmt.Errorf("%w: %s", errIncompatible, hello.Error)
+	}
+	if hello.Protocol < minServerProtocol {
+		return fmt.Errorf("%w: server version %s speaks protocol %d, this client (version %s) needs %d or later: update the server",
+			errIncompatible, hello.Version, hello.Protocol, version, minServerProtocol)
+	}
+	if hello.MinProtocol > protocol.Version {
+		return fmt.Errorf("%w: server version %s needs protocol %d or later, this client (version %s) speaks %d: update the client",
+			errIncompatible, hello.Version, hello.MinProtocol, version, protocol.Version)
+	}
+	connectedServer.Store(&hello)
+	if hello.Protocol >= protocol.FramingVersion {
+		log.Printf("Compression: %s", describeCompression(hello.Compression))
+	}
+	log.Printf("Server version %s (%s/%s, protocol %d)", hello.Version, hello.OS, hello.Arch, hello.Protocol)
+	return nil
+}
+
+// framed sends the messages written on conn, the connection or one of its
+// streams, in the framing agreed with the server. Each command gets its
+// own, as a Conn keeps track of the transfer it sends.
+func framed(conn net.Conn) net.Conn {
+	hello := connectedServer.Load()
+	if hello == nil || hello.Protocol < protocol.FramingVersion {
+		return conn
+	}
+	return protocol.NewConn(conn, hello.Compression)
+}
+
+// newReader reads what the server sends on conn, one of the streams of the
+// connection, in the framing agreed with it
+func newReader(conn net.Conn) *protocol.Reader {
+	r := protocol.NewReader(conn)
+	hello := connectedServer.Load()
+	r.SetFramed(hello != nil && hello.Protocol >= protocol.FramingVersion)
+	return r
+}
+
+func describeCompression(c protocol.Compression) string {
+	output, data := c[protocol.OutputFrames], c[protocol.DataFrames]
+	return fmt.Sprintf("output %s, data %s", cmp.Or(output, protocol.None), cmp.Or(data, protocol.None))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"gofrpprotocol"
+)
+
+var (
+	transferLimit = limitFlag("limit", "Rate limit for command output, files and screenshots sent to the server, e.g. 500KB/s (empty for none)")
+	forwardLimit  = limitFlag("forward-limit", "Rate limit for forward traffic sent to the server, e.g. 1MB/s (empty for none)")
+)
+
+// limitFlag defines a flag for a Limiter, which the server can change at
+// runtime with its limit command
+func limitFlag(name, usage string) *protocol.Limiter {
+	l := protocol.NewLimiter(0)
+	flag.Var(l, name, usage)
+	return l
+}
+
+// handleLimit applies a limit the server sets
+func handleLimit(m protocol.Limit) {
+	var l *protocol.Limiter
+	switch m.Kind {
+	case protocol.TransferLimit:
+		l = transferLimit
+	case protocol.ForwardLimit:
+		l = forwardLimit
+	default:
+		log.Printf("Ignoring limit of unknown kind %q from the server", m.Kind)
+		return
+	}
+	l.SetRate(m.Rate)
+	log.Printf("Server set the %s limit to %s", m.Kind, protocol.FormatRate(m.Rate))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/shirou/gopsutil/v4/cpu"
+	"github.com/shirou/gopsutil/v4/disk"
+	"github.com/shirou/gopsutil/v4/load"
+	"github.com/shirou/gopsutil/v4/mem"
+	gnet "github.com/shirou/gopsutil/v4/net"
+
+	"gofrpprotocol"
+)
+
+// pushMetrics sends a metrics frame every interval until done is closed
+func pushMetrics(conn net.Conn, interval time.Duration, done <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+
+	// Prime the CPU and network counters so the first frame has real rates
+	cpu.Percent(0, false)
+	lastRx, lastTx := netCounters()
+	lastTime := time.Now()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			m := collectMetrics()
+
+			rx, tx := netCounters()
+			if elapsed := now.Sub(lastTime).Seconds(); elapsed > 0 && rx >= lastRx && tx >= lastTx {
+				m.NetRx = float64(rx-lastRx) / elapsed
+				m.NetTx = float64(tx-lastTx) / elapsed
+			}
+			lastRx, lastTx, lastTime = rx, tx, now
+
+			if err := protocol.Write(conn, m); err != nil {
+				log.Printf("Failed to send metrics: %v", err)
+				return
+			}
+		}
+	}
+}
+
+func collectMetrics() protocol.Metrics {
+	m := protocol.Metrics{Time: time.Now().Unix()}
+
+	if pct, err := cpu.Percent(0, false); err == nil && len(pct) > 0 {
+		m.CPU = pct[0]
+	}
+
+	if vm, err := mem.VirtualMemory(); err == nil {
+		m.Mem = vm.UsedPercent
+		m.MemUsed = vm.Used
+		m.MemTotal = vm.Total
+	}
+
+	// Report the fullest local partition, that is the one worth alerting on
+	if parts, err := disk.Partitions(false); err == nil {
+		for _, p := range parts {
+			usage, err := disk.Usage(p.Mountpoint)
+			if err != nil || usage.Total == 0 {
+				continue
+			}
+			if usage.UsedPercent > m.Disk {
+				m.Disk = usage.UsedPercent
+				m.DiskPath = p.Mountpoint
+			}
+		}
+	}
+
+	// Windows has no load average
+	if runtime.GOOS != "windows" {
+		if avg, err := load.Avg(); err == nil {
+			m.Load1, m.Load5, m.Load15 = avg.Load1, avg.Load5, avg.Load15
+		}
+	}
+
+	return m
+}
+
+func netCounters() (rx, tx uint64) {
+	counters, err := gnet.IOCounters(false)
+	if err != nil || len(counters) == 0 {
+		return 0, 0
+	}
+	return counters[0].BytesRecv, counters[0].BytesSent
+}
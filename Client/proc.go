@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+// procRow is one row of "proc list" / "proc info" output
+type procRow struct {
+	PID     int32
+	PPID    int32
+	User    string
+	CPU     float64
+	RSS     uint64
+	Started time.Time
+	Cmdline string
+	Name    string
+}
+
+const procUsage = `Usage:
+  proc list [--filter name] [--sort cpu|mem]
+  proc kill <pid>... [--tree]
+  proc info <pid>`
+
+// cpuSample is how long the CPU usage shown is measured over: a
+// process's own counters only give its average since it started
+const cpuSample = 500 * time.Millisecond
+
+// handleProcCommand implements the native process management verbs so the
+// output does not depend on tasklist / ps being available on the client.
+func handleProcCommand(conn net.Conn, message string) {
+	args := strings.Fields(strings.TrimPrefix(message, "proc"))
+	if len(args) == 0 {
+		sendErrorResponse(conn, procUsage+"\n")
+		return
+	}
+
+	var text string
+	var err error
+	switch args[0] {
+	case "list", "ls":
+		text, err = procList(args[1:])
+	case "kill":
+		text, err = procKill(args[1:])
+	case "info":
+		text, err = procInfo(args[1:])
+	default:
+		err = fmt.Errorf("unknown proc verb %q\n%s", args[0], procUsage)
+	}
+
+	if err != nil {
+		log.Printf("proc %s failed: %v", args[0], err)
+		sendErrorResponse(conn, fmt.Sprintf("Error: %v\n", err))
+		return
+	}
+	sendTextResponse(conn, text)
+}
+
+func procList(args []string) (string, error) {
+	var filter, sortBy string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--filter", "-f":
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("--filter requires a value")
+			}
+			i++
+			filter = strings.ToLower(args[i])
+		case "--sort", "-s":
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("--sort requires cpu or mem")
+			}
+			i++
+			sortBy = args[i]
+			if sortBy != "cpu" && sortBy != "mem" {
+				return "", fmt.Errorf("invalid sort key %q, use cpu or mem", sortBy)
+			}
+		default:
+			return "", fmt.Errorf("unknown option %q\n%s", args[i], procUsage)
+		}
+	}
+
+	procs, err := process.Processes()
+	if err != nil {
+		return "", fmt.Errorf("failed to list processes: %v", err)
+	}
+
+	sampleCPU(procs...)
+	rows := make([]procRow, 0, len(procs))
+	for _, p := range procs {
+		row := readProcRow(p)
+		if filter != "" &&
+			!strings.Contains(strings.ToLower(row.Name), filter) &&
+			!strings.Contains(strings.ToLower(row.Cmdline), filter) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	switch sortBy {
+	case "cpu":
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].CPU > rows[j].CPU })
+	case "mem":
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].RSS > rows[j].RSS })
+	default:
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].PID < rows[j].PID })
+	}
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tPPID\tUSER\tCPU%\tRSS\tSTART\tCMDLINE")
+	for _, r := range rows {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%.1f\t%s\t%s\t%s\n",
+			r.PID, r.PPID, r.User, r.CPU, formatBytes(r.RSS), formatStart(r.Started), r.Cmdline)
+	}
+	w.Flush()
+	fmt.Fprintf(&buf, "%d processes\n", len(rows))
+	return buf.String(), nil
+}
+
+func procKill(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("missing pid\n%s", procUsage)
+	}
+
+	var tree bool
+	var pids []int32
+	for _, a := range args {
+		if a == "--tree" || a == "-t" {
+			tree = true
+			continue
+		}
+		n, err := strconv.ParseInt(a, 10, 32)
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("invalid pid %q", a)
+		}
+		pids = append(pids, int32(n))
+	}
+	if len(pids) == 0 {
+		return "", fmt.Errorf("missing pid\n%s", procUsage)
+	}
+
+	var out strings.Builder
+	attempts, failed := 0, 0
+	for _, pid := range pids {
+		attempts++
+		p, err := process.NewProcess(pid)
+		if err != nil {
+			failed++
+			fmt.Fprintf(&out, "process %d not found: %v\n", pid, err)
+			continue
+		}
+
+		// Kill descendants first so they are not re-parented before we reach them
+		targets := []*process.Process{p}
+		if tree {
+			targets = append(collectDescendants(p), p)
+		}
+		attempts += len(targets) - 1
+		for _, t := range targets {
+			if err := t.Kill(); err != nil {
+				failed++
+				fmt.Fprintf(&out, "Failed to kill %d: %v\n", t.Pid, err)
+				continue
+			}
+			log.Printf("Killed process %d", t.Pid)
+			fmt.Fprintf(&out, "Killed %d\n", t.Pid)
+		}
+	}
+	if failed == attempts {
+		return "", fmt.Errorf("%s", strings.TrimSpace(out.String()))
+	}
+	return out.String(), nil
+}
+
+// sampleCPU measures the CPU usage of procs over cpuSample, for
+// readProcRow to report
+func sampleCPU(procs ...*process.Process) {
+	for _, p := range procs {
+		p.Percent(0)
+	}
+	time.Sleep(cpuSample)
+}
+
+// collectDescendants returns the children of p, deepest first
+func collectDescendants(p *process.Process) []*process.Process {
+	children, err := p.Children()
+	if err != nil {
+		return nil
+	}
+	var result []*process.Process
+	for _, c := range children {
+		result = append(result, collectDescendants(c)...)
+		result = append(result, c)
+	}
+	return result
+}
+
+func procInfo(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: proc info <pid>")
+	}
+	n, err := strconv.ParseInt(args[0], 10, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid pid %q", args[0])
+	}
+
+	p, err := process.NewProcess(int32(n))
+	if err != nil {
+		return "", fmt.Errorf("process %d not found: %v", n, err)
+	}
+
+	sampleCPU(p)
+	r := readProcRow(p)
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "PID:\t%d\n", r.PID)
+	fmt.Fprintf(w, "PPID:\t%d\n", r.PPID)
+	fmt.Fprintf(w, "Name:\t%s\n", r.Name)
+	fmt.Fprintf(w, "User:\t%s\n", r.User)
+	fmt.Fprintf(w, "CPU%%:\t%.1f\n", r.CPU)
+	fmt.Fprintf(w, "RSS:\t%s\n", formatBytes(r.RSS))
+	fmt.Fprintf(w, "Started:\t%s\n", formatStart(r.Started))
+	if exe, err := p.Exe(); err == nil {
+		fmt.Fprintf(w, "Exe:\t%s\n", exe)
+	}
+	if cwd, err := p.Cwd(); err == nil {
+		fmt.Fprintf(w, "Cwd:\t%s\n", cwd)
+	}
+	if status, err := p.Status(); err == nil && len(status) > 0 {
+		fmt.Fprintf(w, "Status:\t%s\n", strings.Join(status, ","))
+	}
+	if threads, err := p.NumThreads(); err == nil {
+		fmt.Fprintf(w, "Threads:\t%d\n", threads)
+	}
+	if children, err := p.Children(); err == nil {
+		pids := make([]string, 0, len(children))
+		for _, c := range children {
+			pids = append(pids, strconv.Itoa(int(c.Pid)))
+		}
+		fmt.Fprintf(w, "Children:\t%s\n", strings.Join(pids, " "))
+	}
+	fmt.Fprintf(w, "Cmdline:\t%s\n", r.Cmdline)
+	w.Flush()
+	return buf.String(), nil
+}
+
+// readProcRow collects the fields we report, the CPU usage since
+// sampleCPU. Processes we are not allowed to inspect still show up, just
+// with empty columns.
+func readProcRow(p *process.Process) procRow {
+	row := procRow{PID: p.Pid}
+	row.PPID, _ = p.Ppid()
+	row.User, _ = p.Username()
+	row.CPU, _ = p.Percent(0)
+	row.Name, _ = p.Name()
+	if mem, err := p.MemoryInfo(); err == nil && mem != nil {
+		row.RSS = mem.RSS
+	}
+	if ms, err := p.CreateTime(); err == nil {
+		row.Started = time.UnixMilli(ms)
+	}
+	row.Cmdline, _ = p.Cmdline()
+	if row.Cmdline == "" {
+		row.Cmdline = row.Name
+	}
+	return row
+}
+
+func formatStart(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
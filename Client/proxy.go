@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const dialTimeout = 30 * time.Second
+
+var proxyFlag = flag.String("proxy", "", "Proxy for the server connection: http://[user:pass@]host:port or socks5://[user:pass@]host:port (defaults to HTTPS_PROXY / ALL_PROXY)")
+
+// proxyURL returns the proxy to use, or nil for a direct connection
+func proxyURL() (*url.URL, error) {
+	raw := *proxyFlag
+	if raw == "" {
+		for _, env := range []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy"} {
+			if v := os.Getenv(env); v != "" {
+				raw = v
+				break
+			}
+		}
+	}
+	if raw == "" || raw == "direct" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		// Accept the common "host:port" shorthand
+		u, err = url.Parse("http://" + raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %v", raw, err)
+		}
+	}
+	return u, nil
+}
+
+// dialServer opens a TCP connection to addr, tunneled through the
+// configured proxy if there is one.
+func dialServer(addr string) (net.Conn, error) {
+	u, err := proxyURL()
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return net.DialTimeout("tcp", addr, dialTimeout)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return dialHTTPConnect(u, addr)
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", u.Host, auth, &net.Dialer{Timeout: dialTimeout})
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("socks5 proxy %s: %v", u.Host, err)
+		}
+		return conn, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+}
+
+// dialHTTPConnect asks an HTTP proxy to open a tunnel with CONNECT
+func dialHTTPConnect(u *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("http proxy %s: %v", proxyAddr, err)
+	}
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("http proxy %s: TLS handshake failed: %v", proxyAddr, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		token := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+token)
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %v", proxyAddr, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %v", proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s refused CONNECT: %s", proxyAddr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The server may already have sent data after the proxy's reply
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose first bytes come from a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
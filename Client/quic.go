@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"gofrpprotocol"
+)
+
+// quicProtocol is the ALPN name both sides agree on
+const quicProtocol = "gofrp"
+
+// quicHandshakeTimeout is how long to wait before assuming UDP is blocked
+const quicHandshakeTimeout = 5 * time.Second
+
+// quicTransport runs the session over QUIC, where every command the server
+// sends arrives on its own stream. It falls back to TCP on the same port
+// when the QUIC handshake fails, unless the server's certificate is
+// pinned: TCP would send the key without the protection asked for.
+type quicTransport struct{}
+
+func (quicTransport) Dial(addr string) (net.Conn, error) {
+	if u, _ := proxyURL(); u != nil {
+		if *quicPin != "" {
+			return nil, fmt.Errorf("proxy %s cannot carry QUIC, and -quic-fingerprint rules out TCP", u.Host)
+		}
+		log.Printf("Proxy %s cannot carry QUIC, using TCP", u.Host)
+		return dialServer(addr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), quicHandshakeTimeout)
+	defer cancel()
+	qc, err := quic.DialAddr(ctx, addr, quicTLSConfig(), &quic.Config{
+		MaxIdleTimeout:     time.Minute,
+		KeepAlivePeriod:    15 * time.Second,
+		MaxIncomingStreams: 1000,
+	})
+	if err != nil && *quicPin != "" {
+		return nil, fmt.Errorf("QUIC connection to %s failed: %v", addr, err)
+	}
+	if err != nil {
+		log.Printf("QUIC connection to %s failed (%v), falling back to TCP", addr, err)
+		return dialServer(addr)
+	}
+
+	stream, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "no control stream")
+		return nil, err
+	}
+
+	// The server only sees the control stream once the AUTH line is written
+	log.Printf("Using QUIC transport to %s", addr)
+	return &quicConn{Stream: stream, conn: qc, control: true}, nil
+}
+
+// quicTLSConfig checks the server's certificate as usual, or, with
+// -quic-fingerprint, that it is the one pinned, as for the self-signed
+// certificate of a server without one of its own
+func quicTLSConfig() *tls.Config {
+	conf := &tls.Config{InsecureSkipVerify: *insecureTLS, NextProtos: []string{quicProtocol}}
+	if *quicPin == "" {
+		return conf
+	}
+	pin := strings.ToLower(strings.ReplaceAll(*quicPin, ":", ""))
+	conf.InsecureSkipVerify = true
+	conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("the server sent no certificate")
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		if got := hex.EncodeToString(sum[:]); got != pin {
+			return fmt.Errorf("the server's certificate has fingerprint %s, not the one given with -quic-fingerprint", got)
+		}
+		return nil
+	}
+	return conf
+}
+
+// quicConn is one QUIC stream as a net.Conn. Closing the control stream
+// ends the whole QUIC connection, closing any other stream only ends that
+// stream.
+type quicConn struct {
+	*quic.Stream
+	conn    *quic.Conn
+	control bool
+}
+
+func (c *quicConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *quicConn) Close() error {
+	if c.control {
+		return c.conn.CloseWithError(0, "closed")
+	}
+	return c.Stream.Close()
+}
+
+// AcceptStream waits for the server to open a new stream
+func (c *quicConn) AcceptStream() (net.Conn, error) {
+	stream, err := c.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{Stream: stream, conn: c.conn}, nil
+}
+
+// OpenStream opens a new stream on the same QUIC connection
+func (c *quicConn) OpenStream() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{Stream: stream, conn: c.conn}, nil
+}
+
+// streamAccepter is implemented by connections of multiplexing transports
+type streamAccepter interface {
+	AcceptStream() (net.Conn, error)
+}
+
+// serveStreams handles the streams the server opens, one command each,
+// until the connection goes away.
+func serveStreams(accepter streamAccepter) {
+	for {
+		stream, err := accepter.AcceptStream()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer stream.Close()
+
+			reader := newReader(stream)
+			msg, err := reader.Read()
+			if err != nil && !errors.Is(err, protocol.ErrMalformed) {
+				if err != io.EOF {
+					log.Printf("Failed to read command from stream: %v", err)
+				}
+				return
+			}
+			message := msg.String()
+			if message == "" {
+				return
+			}
+
+			switch m := msg.(type) {
+			case protocol.UploadStart:
+				receiveUpload(stream, reader, m, func(protocol.Message) bool { return false })
+				return
+			case protocol.UpdateStart:
+				receiveUpdate(stream, reader, m, func(protocol.Message) bool { return false })
+				return
+			}
+
+			log.Printf("Received server command: [%s]", message)
+			if send, ok := msg.(protocol.SendFile); ok {
+				startTransfer(send.ID)
+			}
+			processCommand(stream, message)
+		}()
+	}
+}
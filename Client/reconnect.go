@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	failoverMode = flag.String("failover", "order", "How multiple servers are tried: order (primary first) or round-robin")
+	retryBase    = flag.Duration("retry-base", 2*time.Second, "Initial reconnect delay")
+	retryMax     = flag.Duration("retry-max", 2*time.Minute, "Maximum reconnect delay")
+)
+
+// backoff computes exponentially growing reconnect delays with jitter
+type backoff struct {
+	base    time.Duration
+	max     time.Duration
+	attempt int
+}
+
+// next returns the delay before the next attempt. The delay doubles each
+// time up to max, and a random part of it is dropped so that many clients
+// cut off by the same outage do not reconnect in lockstep.
+func (b *backoff) next() time.Duration {
+	d := b.base << b.attempt
+	if d <= 0 || d > b.max {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + rand.N(half+1)
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// parseEndpoints turns "host1[:port],host2[:port]" into dialable addresses,
+// using defaultPort for entries without a port.
+func parseEndpoints(list string, defaultPort string) []string {
+	var endpoints []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(entry); err != nil {
+			entry = net.JoinHostPort(strings.Trim(entry, "[]"), defaultPort)
+		}
+		endpoints = append(endpoints, entry)
+	}
+	return endpoints
+}
+
+// runClient keeps the client connected to one of the endpoints until the
+// client is asked to stop
+func runClient(endpoints []string) {
+	bo := &backoff{base: *retryBase, max: *retryMax}
+	roundRobin := *failoverMode == "round-robin"
+	start := 0
+	reason := "startup"
+	attempt := 0
+
+	for clientCtx.Err() == nil {
+		connected := false
+		var lastErr error
+
+		// Try every endpoint once, beginning with the preferred one
+		for i := 0; i < len(endpoints); i++ {
+			index := (start + i) % len(endpoints)
+			addr := endpoints[index]
+			if clientCtx.Err() != nil {
+				return
+			}
+			attempt++
+			log.Printf("Connection attempt %d to %s (reason: %s)", attempt, addr, reason)
+
+			ok, err := connectToServer(addr)
+			if !ok {
+				lastErr = err
+				log.Printf("Connection attempt %d to %s failed: %v", attempt, addr, err)
+				reason = fmt.Sprintf("failover after %s failed", addr)
+				continue
+			}
+
+			connected = true
+			// A rejected key or version is not a working connection, keep
+			// backing off
+			if !errors.Is(err, errAuthFailed) && !errors.Is(err, errIncompatible) {
+				bo.reset()
+			}
+			if roundRobin {
+				start = index + 1
+			}
+			lastErr = err
+			break
+		}
+
+		// Closing the connection to stop is no reason to log or retry
+		if clientCtx.Err() != nil {
+			return
+		}
+		if connected {
+			switch {
+			case errors.Is(lastErr, errHeartbeatTimeout):
+				log.Printf("Connection to server lost: %v, reconnecting now...", lastErr)
+				reason = "heartbeat timeout"
+				continue
+			case lastErr != nil:
+				log.Printf("Connection to server disconnected: %v", lastErr)
+				reason = fmt.Sprintf("connection lost: %v", lastErr)
+			default:
+				log.Println("Server connection closed normally")
+				reason = "server closed connection"
+			}
+		} else {
+			reason = fmt.Sprintf("retry after all %d server(s) failed", len(endpoints))
+		}
+
+		delay := bo.next()
+		log.Printf("Will retry connection in %v...", delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-clientCtx.Done():
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var logFile = flag.String("log-file", "", "Write the log to this file instead of the terminal (services use this)")
+
+// underServiceManager is set when a service manager started the client,
+// which starts it again when it fails
+var underServiceManager bool
+
+// serviceConfig is how the client is installed as a service. The service
+// runs the client with the configuration file, so every other setting
+// comes from there.
+type serviceConfig struct {
+	Name       string
+	Executable string
+	Config     string
+	LogFile    string
+}
+
+// serviceManager installs and controls the client with the platform's
+// service manager: systemd on Linux, launchd on macOS and the service
+// control manager on Windows
+type serviceManager interface {
+	install(c serviceConfig) error
+	uninstall() error
+	start() error
+	stop() error
+	// status is "running", "stopped" or "not installed", or whatever
+	// else the platform reports
+	status() (string, error)
+}
+
+// runService implements "gofrpclient service install|uninstall|start|stop|status"
+func runService(args []string) {
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	name := fs.String("name", "gofrpclient", "Service name")
+	config := fs.String("config", "", "Client configuration file the service runs with (install only, required)")
+	logPath := fs.String("log-file", "", "Log file of the service (install only, default "+defaultServiceLog("NAME")+")")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s service install -config FILE [-log-file FILE] [-name NAME]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s service uninstall|start|stop|status [-name NAME]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	action := args[0]
+	fs.Parse(args[1:])
+
+	m, err := newServiceManager(*name)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch action {
+	case "install":
+		c, err := newServiceConfig(*name, *config, *logPath)
+		if err == nil {
+			err = m.install(c)
+		}
+		if err != nil {
+			fmt.Printf("Error: failed to install service %s: %v\n", *name, err)
+			os.Exit(1)
+		}
+		start := os.Args[0] + " service start"
+		if *name != "gofrpclient" {
+			start += " -name " + *name
+		}
+		fmt.Printf("Service %s installed, it logs to %s. Start it with: %s\n", *name, c.LogFile, start)
+	case "uninstall":
+		if err := m.uninstall(); err != nil {
+			fmt.Printf("Error: failed to uninstall service %s: %v\n", *name, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Service %s uninstalled\n", *name)
+	case "start":
+		if err := m.start(); err != nil {
+			fmt.Printf("Error: failed to start service %s: %v\n", *name, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Service %s started\n", *name)
+	case "stop":
+		if err := m.stop(); err != nil {
+			fmt.Printf("Error: failed to stop service %s: %v\n", *name, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Service %s stopped\n", *name)
+	case "status":
+		status, err := m.status()
+		if err != nil {
+			fmt.Printf("Error: failed to query service %s: %v\n", *name, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Service %s is %s\n", *name, status)
+		if status != "running" {
+			os.Exit(3)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// newServiceConfig checks what install was given. Paths are made absolute
+// since services do not start in the current directory.
+func newServiceConfig(name, config, logPath string) (serviceConfig, error) {
+	if config == "" {
+		return serviceConfig{}, fmt.Errorf("-config is required, the service reads its settings from it")
+	}
+	if logPath == "" {
+		logPath = defaultServiceLog(name)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return serviceConfig{}, err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return serviceConfig{}, err
+	}
+	if config, err = filepath.Abs(config); err != nil {
+		return serviceConfig{}, err
+	}
+	if logPath, err = filepath.Abs(logPath); err != nil {
+		return serviceConfig{}, err
+	}
+
+	// Refuse a configuration the service would fail to start with
+	*configPath = config
+	if err := loadConfig(); err != nil {
+		return serviceConfig{}, fmt.Errorf("%s: %v", config, err)
+	}
+	return serviceConfig{Name: name, Executable: exe, Config: config, LogFile: logPath}, nil
+}
+
+// args are the command line the service runs the client with
+func (c serviceConfig) args() []string {
+	return []string{"-config", c.Config, "-log-file", c.LogFile}
+}
+
+// openLogFile sends the log, and anything else written to stdout or
+// stderr, to the -log-file file
+func openLogFile() error {
+	if *logFile == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(*logFile), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	os.Stdout, os.Stderr = f, f
+	return nil
+}
+
+// runTool runs a service manager command, with its output in the error
+// if it fails
+func runTool(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, msg)
+		}
+		return fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+)
+
+// launchdPlist keeps the client alive unless it exits cleanly: after
+// "service stop" or the server's client-quit. Launch daemons run as root
+// without a home directory, so one is given for the client ID and audit
+// log.
+var launchdPlist = template.Must(template.New("plist").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{xml .Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+{{- range .Args}}
+		<string>{{xml .}}</string>
+{{- end}}
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ThrottleInterval</key>
+	<integer>5</integer>
+	<key>EnvironmentVariables</key>
+	<dict>
+		<key>HOME</key>
+		<string>/var/root</string>
+	</dict>
+	<key>StandardOutPath</key>
+	<string>{{xml .LogFile}}</string>
+	<key>StandardErrorPath</key>
+	<string>{{xml .LogFile}}</string>
+</dict>
+</plist>
+`))
+
+type launchdService struct {
+	label string
+}
+
+func newServiceManager(name string) (serviceManager, error) {
+	return &launchdService{label: "com.gofrp." + name}, nil
+}
+
+func (s *launchdService) plistPath() string {
+	return "/Library/LaunchDaemons/" + s.label + ".plist"
+}
+
+func (s *launchdService) target() string {
+	return "system/" + s.label
+}
+
+func (s *launchdService) install(c serviceConfig) error {
+	if _, err := os.Stat(s.plistPath()); err == nil {
+		return fmt.Errorf("%s already exists, uninstall the service first", s.plistPath())
+	}
+	var plist strings.Builder
+	launchdPlist.Execute(&plist, map[string]any{
+		"Label":   s.label,
+		"Args":    append([]string{c.Executable}, c.args()...),
+		"LogFile": c.LogFile,
+	})
+	// launchd ignores daemons whose plist others can write to
+	return os.WriteFile(s.plistPath(), []byte(plist.String()), 0644)
+}
+
+func (s *launchdService) uninstall() error {
+	if _, err := os.Stat(s.plistPath()); os.IsNotExist(err) {
+		return fmt.Errorf("not installed")
+	}
+	runTool("launchctl", "bootout", s.target())
+	return os.Remove(s.plistPath())
+}
+
+// start loads the daemon, which starts it since it runs at load. Loaded,
+// it also starts at boot.
+func (s *launchdService) start() error {
+	if exec.Command("launchctl", "print", s.target()).Run() == nil {
+		return runTool("launchctl", "kickstart", s.target())
+	}
+	return runTool("launchctl", "bootstrap", "system", s.plistPath())
+}
+
+// stop unloads the daemon, as KeepAlive would start it again otherwise
+// if it exited with an error. It is loaded again at boot.
+func (s *launchdService) stop() error {
+	return runTool("launchctl", "bootout", s.target())
+}
+
+func (s *launchdService) status() (string, error) {
+	if _, err := os.Stat(s.plistPath()); os.IsNotExist(err) {
+		return "not installed", nil
+	}
+	out, err := exec.Command("launchctl", "print", s.target()).Output()
+	if err != nil {
+		// Not loaded
+		return "stopped", nil
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if state, ok := strings.CutPrefix(strings.TrimSpace(line), "state = "); ok {
+			if state == "running" {
+				return "running", nil
+			}
+			return "stopped", nil
+		}
+	}
+	return "stopped", nil
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// startedByServiceManager reports whether launchd started the client as
+// a daemon installed with "service install"
+func startedByServiceManager() bool {
+	return os.Getppid() == 1 && strings.HasPrefix(os.Getenv("XPC_SERVICE_NAME"), "com.gofrp.")
+}
+
+func defaultServiceLog(name string) string {
+	return "/Library/Logs/" + name + ".log"
+}
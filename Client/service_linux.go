@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// systemdUnit restarts the client when it fails, but not when it exits
+// cleanly: after "systemctl stop" or the server's client-quit. The client
+// ID and audit log go under /var/lib, as a system service has no home
+// directory to keep them in.
+var systemdUnit = template.Must(template.New("unit").Parse(`[Unit]
+Description=GoFRP client ({{.Name}})
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart={{.Command}}
+Restart=on-failure
+RestartSec=5
+Environment=XDG_CONFIG_HOME=/var/lib
+KillSignal=SIGTERM
+TimeoutStopSec={{.StopTimeout}}
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+type systemdService struct {
+	name string
+}
+
+func newServiceManager(name string) (serviceManager, error) {
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return nil, fmt.Errorf("systemd is required to run the client as a service: %v", err)
+	}
+	return &systemdService{name: name}, nil
+}
+
+func (s *systemdService) unitPath() string {
+	return "/etc/systemd/system/" + s.name + ".service"
+}
+
+func (s *systemdService) install(c serviceConfig) error {
+	if _, err := os.Stat(s.unitPath()); err == nil {
+		return fmt.Errorf("%s already exists, uninstall the service first", s.unitPath())
+	}
+
+	words := []string{systemdQuote(c.Executable)}
+	for _, arg := range c.args() {
+		words = append(words, systemdQuote(arg))
+	}
+	var unit strings.Builder
+	systemdUnit.Execute(&unit, map[string]string{
+		"Name":    c.Name,
+		"Command": strings.Join(words, " "),
+		// The client waits this long for uploads when stopping
+		"StopTimeout": strconv.Itoa(int(shutdownTimeout.Seconds()) + 10),
+	})
+	if err := os.WriteFile(s.unitPath(), []byte(unit.String()), 0644); err != nil {
+		return err
+	}
+	if err := runTool("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	return runTool("systemctl", "enable", s.name)
+}
+
+func (s *systemdService) uninstall() error {
+	if _, err := os.Stat(s.unitPath()); os.IsNotExist(err) {
+		return fmt.Errorf("not installed")
+	}
+	runTool("systemctl", "stop", s.name)
+	runTool("systemctl", "disable", s.name)
+	if err := os.Remove(s.unitPath()); err != nil {
+		return err
+	}
+	return runTool("systemctl", "daemon-reload")
+}
+
+func (s *systemdService) start() error {
+	return runTool("systemctl", "start", s.name)
+}
+
+func (s *systemdService) stop() error {
+	return runTool("systemctl", "stop", s.name)
+}
+
+func (s *systemdService) status() (string, error) {
+	if _, err := os.Stat(s.unitPath()); os.IsNotExist(err) {
+		return "not installed", nil
+	}
+	// is-active exits non-zero for anything but active, its output says what
+	out, _ := exec.Command("systemctl", "is-active", s.name).Output()
+	switch state := strings.TrimSpace(string(out)); state {
+	case "active":
+		return "running", nil
+	case "inactive", "":
+		return "stopped", nil
+	default:
+		return state, nil
+	}
+}
+
+// systemdQuote quotes a word of ExecStart if it needs it
+func systemdQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\$%;") {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "$", "$$")
+	s = strings.ReplaceAll(s, "%", "%%")
+	return `"` + s + `"`
+}
+
+// startedByServiceManager reports whether systemd started the client as
+// a system service
+func startedByServiceManager() bool {
+	return os.Getppid() == 1 && os.Getenv("INVOCATION_ID") != ""
+}
+
+func defaultServiceLog(name string) string {
+	return "/var/log/" + name + ".log"
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+)
+
+// runAsService runs the client. Outside Windows, service managers start
+// it like any other program and stop it with SIGTERM.
+func runAsService(run func() int) int {
+	underServiceManager = startedByServiceManager()
+	return run()
+}
+
+// restartProcess replaces the client with the executable now in its
+// place, keeping the process, so service managers see no restart
+func restartProcess() int {
+	exe, err := executable()
+	if err == nil {
+		err = syscall.Exec(exe, os.Args, os.Environ())
+	}
+	log.Printf("Failed to restart: %v", err)
+	return 1
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func newServiceManager(name string) (serviceManager, error) {
+	return nil, fmt.Errorf("running the client as a service is not supported on %s", runtime.GOOS)
+}
+
+func startedByServiceManager() bool {
+	return false
+}
+
+func defaultServiceLog(name string) string {
+	return name + ".log"
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+type windowsService struct {
+	name string
+}
+
+func newServiceManager(name string) (serviceManager, error) {
+	return &windowsService{name: name}, nil
+}
+
+// open connects to the service control manager and opens the service
+func (s *windowsService) open() (*mgr.Mgr, *mgr.Service, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, nil, err
+	}
+	service, err := m.OpenService(s.name)
+	if err != nil {
+		m.Disconnect()
+		return nil, nil, err
+	}
+	return m, service, nil
+}
+
+// install registers the client to start at boot and to be restarted when
+// it fails. A clean exit, after "service stop" or the server's
+// client-quit, is not a failure.
+func (s *windowsService) install(c serviceConfig) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if service, err := m.OpenService(s.name); err == nil {
+		service.Close()
+		return fmt.Errorf("already installed, uninstall the service first")
+	}
+	service, err := m.CreateService(s.name, c.Executable, mgr.Config{
+		DisplayName: "GoFRP client (" + c.Name + ")",
+		Description: "Keeps this machine connected to the GoFRP server",
+		StartType:   mgr.StartAutomatic,
+	}, c.args()...)
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: 5 * time.Second}
+	if err := service.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, 24*60*60); err != nil {
+		return err
+	}
+	return service.SetRecoveryActionsOnNonCrashFailures(true)
+}
+
+func (s *windowsService) uninstall() error {
+	m, service, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer service.Close()
+
+	if status, err := service.Query(); err == nil && status.State != svc.Stopped {
+		s.stopService(service)
+	}
+	return service.Delete()
+}
+
+func (s *windowsService) start() error {
+	m, service, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer service.Close()
+	return service.Start()
+}
+
+func (s *windowsService) stop() error {
+	m, service, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer service.Close()
+	return s.stopService(service)
+}
+
+// stopService asks the service to stop and waits while it finishes its
+// uploads
+func (s *windowsService) stopService(service *mgr.Service) error {
+	status, err := service.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(*shutdownTimeout + 10*time.Second)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("still stopping after %v", *shutdownTimeout+10*time.Second)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = service.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *windowsService) status() (string, error) {
+	m, service, err := s.open()
+	if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+		return "not installed", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer m.Disconnect()
+	defer service.Close()
+
+	status, err := service.Query()
+	if err != nil {
+		return "", err
+	}
+	switch status.State {
+	case svc.Running:
+		return "running", nil
+	case svc.Stopped:
+		return "stopped", nil
+	case svc.StartPending:
+		return "starting", nil
+	case svc.StopPending:
+		return "stopping", nil
+	default:
+		return fmt.Sprintf("in state %d", status.State), nil
+	}
+}
+
+func defaultServiceLog(name string) string {
+	dir := os.Getenv("ProgramData")
+	if dir == "" {
+		dir = `C:\ProgramData`
+	}
+	return filepath.Join(dir, "gofrpclient", name+".log")
+}
+
+// runAsService runs the client, under the service control manager when it
+// started the process. A stop request from it stops the client the way
+// SIGTERM does elsewhere.
+func runAsService(run func() int) int {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return run()
+	}
+	underServiceManager = true
+	h := &serviceHandler{run: run}
+	if err := svc.Run("", h); err != nil {
+		return 1
+	}
+	return h.status
+}
+
+// restartProcess starts the executable now in the client's place. A
+// service exits with an error instead, and the service control manager
+// starts it again.
+func restartProcess() int {
+	if underServiceManager {
+		log.Println("Exiting so that the service manager restarts the client")
+		return 1
+	}
+	exe, err := executable()
+	if err == nil {
+		cmd := exec.Command(exe, os.Args[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Printf("Failed to restart: %v", err)
+		return 1
+	}
+	return 0
+}
+
+type serviceHandler struct {
+	run    func() int
+	status int
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	done := make(chan int, 1)
+	go func() { done <- h.run() }()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	stopping := false
+	for {
+		select {
+		case h.status = <-done:
+			// Exiting with an error on its own is a failure, which
+			// restarts the service; being stopped never is
+			if stopping {
+				return false, 0
+			}
+			return h.status != 0, uint32(h.status)
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				changes <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				stopping = true
+				changes <- svc.Status{State: svc.StopPending}
+				stopClient(errors.New("stop requested by the service manager"))
+			}
+		}
+	}
+}
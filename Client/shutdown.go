@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "How long stopping the client waits for uploads in progress")
+
+var (
+	// clientCtx ends when the client is asked to stop, by a signal or by
+	// the server's client-quit; its cause says which
+	clientCtx, stopClient = context.WithCancelCause(context.Background())
+
+	// connCtx ends once the uploads in progress are done with, which
+	// closes the server connection
+	connCtx, closeConnections = context.WithCancel(context.Background())
+)
+
+// activeUploads counts uploads being written, which stopping waits for
+var activeUploads atomic.Int64
+
+// watchShutdownSignals stops the client on SIGINT or SIGTERM. A second
+// signal exits at once.
+func watchShutdownSignals() {
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-sigChan
+	log.Printf("%v received, stopping client...", sig)
+	stopClient(fmt.Errorf("%v received", sig))
+
+	sig = <-sigChan
+	log.Printf("%v received again, exiting without waiting for uploads", sig)
+	localAudit.close()
+	os.Exit(1)
+}
+
+// shutdown stops the client once clientCtx has ended and returns its exit
+// status. Uploads in progress get up to the shutdown timeout to finish;
+// closing the connection then aborts the rest, which remove their partial
+// files. The status is 1 if uploads had to be aborted.
+func shutdown() int {
+	log.Printf("Client stopping (%v)", context.Cause(clientCtx))
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	drained := waitForUploads(ctx)
+	closeConnections()
+
+	status := 0
+	if !drained {
+		status = 1
+		// Give the aborted uploads a moment to clean up after themselves
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		waitForUploads(ctx)
+	}
+	localAudit.close()
+	log.Println("Client stopped")
+	return status
+}
+
+// waitForUploads waits until no upload is in progress, or ctx ends. It
+// reports whether the uploads finished.
+func waitForUploads(ctx context.Context) bool {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	var last int64
+	for n := activeUploads.Load(); n > 0; n = activeUploads.Load() {
+		if n != last {
+			log.Printf("Waiting for %d upload(s) to finish...", n)
+			last = n
+		}
+		select {
+		case <-ctx.Done():
+			log.Printf("Giving up on %d upload(s) still in progress", n)
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
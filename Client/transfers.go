@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"gofrpprotocol"
+)
+
+var (
+	errTransferCanceled = errors.New("transfer canceled by the server")
+	errConnectionLost   = errors.New("connection to the server lost")
+)
+
+// transferControl is how the server pauses, resumes and cancels a file this
+// client sends as one of the transfers it queues
+type transferControl struct {
+	mu      sync.Mutex
+	paused  bool
+	err     error         // why the transfer must stop, if it must
+	changed chan struct{} // closed and replaced on every change
+}
+
+var (
+	transfersMu sync.Mutex
+	transferIDs = map[int64]*transferControl{}
+)
+
+// startTransfer makes transfer id active as its SendFile is read, before
+// the file starts, since the server may pause it right away
+func startTransfer(id int64) {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	transferIDs[id] = &transferControl{changed: make(chan struct{})}
+}
+
+// activeTransfer returns the control of transfer id, nil if it is not
+// active
+func activeTransfer(id int64) *transferControl {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	return transferIDs[id]
+}
+
+func endTransfer(id int64) {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	delete(transferIDs, id)
+}
+
+// handleTransfer applies a pause, resume or cancel from the server. Those
+// for transfers that are over already are ignored.
+func handleTransfer(m protocol.Transfer) {
+	c := activeTransfer(m.ID)
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch m.Action {
+	case protocol.TransferPause:
+		c.paused = true
+	case protocol.TransferResume:
+		c.paused = false
+	case protocol.TransferCancel:
+		c.err = errTransferCanceled
+	default:
+		log.Printf("Ignoring unknown transfer action %q from the server", m.Action)
+		return
+	}
+	log.Printf("Server asked to %s transfer %d", m.Action, m.ID)
+	c.notify()
+}
+
+// dropTransfers stops the transfers in progress once the connection they
+// are controlled over is gone
+func dropTransfers() {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	for id, c := range transferIDs {
+		c.mu.Lock()
+		c.err = errConnectionLost
+		c.notify()
+		c.mu.Unlock()
+		delete(transferIDs, id)
+	}
+}
+
+// notify wakes up wait. c.mu must be held.
+func (c *transferControl) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait is called between the chunks of a file. It blocks while the
+// transfer is paused and reports why it must stop, if it must. A nil
+// control never waits.
+func (c *transferControl) wait() error {
+	if c == nil {
+		return nil
+	}
+	for {
+		c.mu.Lock()
+		paused, err, changed := c.paused, c.err, c.changed
+		c.mu.Unlock()
+		if err != nil || !paused {
+			return err
+		}
+		<-changed
+	}
+}
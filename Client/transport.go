@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/coder/websocket"
+)
+
+var (
+	transportName = flag.String("transport", "tcp", "Transport to the server: tcp, ws, wss or quic (quic falls back to tcp if UDP is blocked)")
+	wsPath        = flag.String("ws-path", "/gofrp", "HTTP path of the server's WebSocket endpoint (ws/wss transports)")
+	insecureTLS   = flag.Bool("insecure", false, "Skip TLS certificate verification (wss and quic transports)")
+	quicPin       = flag.String("quic-fingerprint", "", "SHA-256 fingerprint the server's QUIC certificate must have, as the server prints it for its self-signed one (no TCP fallback then)")
+)
+
+// Transport hides how the bytes reach the server. The session protocol on
+// top is the same for every transport.
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+}
+
+func newTransport(name string) (Transport, error) {
+	switch name {
+	case "", "tcp":
+		return tcpTransport{}, nil
+	case "ws", "wss":
+		return &wsTransport{secure: name == "wss", path: *wsPath}, nil
+	case "quic":
+		return quicTransport{}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q, use tcp, ws, wss or quic", name)
+	}
+}
+
+// tcpTransport is a raw TCP connection, tunneled through a proxy if set
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+	return dialServer(addr)
+}
+
+// wsTransport carries the session over a WebSocket, for networks that
+// only allow outbound HTTP(S).
+type wsTransport struct {
+	secure bool
+	path   string
+}
+
+func (t *wsTransport) Dial(addr string) (net.Conn, error) {
+	u := url.URL{Scheme: "ws", Host: addr, Path: t.path}
+	if t.secure {
+		u.Scheme = "wss"
+	}
+
+	// The underlying TCP connection goes through dialServer so the
+	// -proxy setting applies here too
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialServer(addr)
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecureTLS},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, u.String(), &websocket.DialOptions{HTTPClient: httpClient})
+	if err != nil {
+		return nil, fmt.Errorf("websocket dial %s: %v", u.String(), err)
+	}
+
+	return websocket.NetConn(context.Background(), c, websocket.MessageBinary), nil
+}
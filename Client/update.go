@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gofrpprotocol"
+)
+
+// version is reported to the server; release builds set it with
+//
+//	go build -ldflags "-X main.version=1.2.0"
+var version = "0.01"
+
+var (
+	updateKey   = flag.String("update-key", "", "Base64 ed25519 public key server updates must be signed with (empty refuses updates)")
+	showVersion = flag.Bool("version", false, "Print the version and exit")
+)
+
+const (
+	// updateTrial is how long an updated client has to get connected to
+	// a server before it rolls back to the previous version. It starts
+	// over whenever no server can be reached, which is not the update's
+	// fault.
+	updateTrial = 3 * time.Minute
+)
+
+// errRestart stops the client so that it starts again, with an update or
+// after rolling one back
+var errRestart = errors.New("restarting")
+
+// updateState is kept next to the executable while an update is on
+// trial. The previous binary is kept as <executable>.old until then.
+type updateState struct {
+	Previous string `json:"previous"`
+	Version  string `json:"version"`
+	Starts   int    `json:"starts"`
+}
+
+var (
+	// updating is set while an update is received, one at a time
+	updating atomic.Bool
+
+	// updateConfirmed is closed once the client has stayed connected to
+	// a server for a while, which proves an update works
+	updateConfirmed = make(chan struct{})
+	confirmOnce     sync.Once
+
+	// unreachable is signaled when a connection attempt does not reach a
+	// server, see updateTrial
+	unreachable = make(chan struct{}, 1)
+)
+
+// receiveUpdate reads a new client binary the server pushes as start,
+// Chunk lines and UpdateEnd, checks its signature, tries it and puts it in
+// place of the running executable, then restarts the client with it
+func receiveUpdate(conn net.Conn, reader *protocol.Reader, start protocol.UpdateStart, frame func(protocol.Message) bool) {
+	header := start.String()
+	size, sig := start.Size, start.Signature
+	conn = framed(conn)
+
+	// Counted until the new binary is in place or removed, see shutdown
+	activeUploads.Add(1)
+	defer activeUploads.Add(-1)
+
+	entry := newAuditEntry(header)
+	entry.Command = fmt.Sprintf("update (%d bytes)", size)
+	defer localAudit.record(entry)
+
+	// Chunks are consumed even when the update is refused, so they are
+	// not taken for commands
+	var exe string
+	var file *os.File
+	var refused error
+	public, keyErr := base64.StdEncoding.DecodeString(*updateKey)
+	switch {
+	case !operationAllowed(header):
+		refused = fmt.Errorf("operation %q is not allowed on this client", "update")
+		entry.deny("not allowed by the client configuration")
+	case *updateKey == "":
+		refused = fmt.Errorf("this client has no update_key and accepts no updates")
+		entry.deny("no update key configured")
+	case keyErr != nil || len(public) != ed25519.PublicKeySize:
+		refused = fmt.Errorf("the client's update_key is not a base64 ed25519 public key")
+	case len(sig) != ed25519.SignatureSize:
+		refused = fmt.Errorf("malformed signature")
+	case start.Version == "":
+		// Without the version in the signature, any binary ever signed
+		// could be sent to go back to it
+		refused = fmt.Errorf("the server sent the update without its version, it needs a newer gofrpserver")
+	case !newerVersion(start.Version):
+		refused = fmt.Errorf("version %q is not newer than the running %s", start.Version, version)
+		entry.deny("not a newer version")
+	case !underServiceManager:
+		// Nothing would start the client again to roll back an update
+		// that does not run
+		refused = fmt.Errorf("the client does not run as a service, which updates need, see \"gofrpclient service install\"")
+		entry.deny("not running as a service")
+	case !updating.CompareAndSwap(false, true):
+		refused = fmt.Errorf("another update is in progress")
+	default:
+		defer updating.Store(false)
+		if exe, refused = executable(); refused == nil {
+			file, refused = os.OpenFile(exe+".new", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+		}
+	}
+	installed := false
+	if file != nil {
+		defer func() {
+			file.Close()
+			if !installed {
+				os.Remove(file.Name())
+			}
+		}()
+	}
+
+	log.Printf("Receiving update (%d bytes)", size)
+	sum := newDigest()
+	for {
+		msg, err := reader.Read()
+		if err != nil && !errors.Is(err, protocol.ErrMalformed) {
+			log.Printf("Update interrupted: %v", err)
+			entry.finish(fmt.Errorf("interrupted: %v", err))
+			return
+		}
+		if frame(msg) {
+			continue
+		}
+		if _, ok := msg.(protocol.UpdateEnd); ok {
+			break
+		}
+		if refused != nil {
+			continue
+		}
+
+		chunk, ok := msg.(protocol.Chunk)
+		if !ok {
+			refused = fmt.Errorf("malformed chunk")
+			continue
+		}
+		if _, err := file.Write(chunk.Data); err != nil {
+			refused = err
+		}
+		sum.Write(chunk.Data)
+	}
+
+	var newVersion string
+	if refused == nil && sum.n != size {
+		refused = fmt.Errorf("received %d of %d bytes", sum.n, size)
+	}
+	if refused == nil && !ed25519.Verify(public, protocol.UpdateMessage(runtime.GOOS, runtime.GOARCH, start.Version, sum.h.Sum(nil)), sig) {
+		refused = fmt.Errorf("bad signature, the binary was not signed as version %s for %s/%s with the update key", start.Version, runtime.GOOS, runtime.GOARCH)
+		entry.deny("bad signature")
+	}
+	if refused == nil {
+		refused = file.Close()
+	}
+	if refused == nil {
+		newVersion, refused = tryBinary(file.Name())
+	}
+	if refused == nil && newVersion != start.Version {
+		refused = fmt.Errorf("the new binary reports version %s, it was signed as %s", newVersion, start.Version)
+	}
+	if refused == nil {
+		refused = installUpdate(exe, newVersion)
+	}
+	entry.finish(refused)
+	if refused != nil {
+		log.Printf("Update failed: %v", refused)
+		sendResponse(conn, nil, fmt.Errorf("update failed: %v", refused))
+		return
+	}
+
+	installed = true
+	entry.Files = append(entry.Files, sum.file(exe, "written"))
+	log.Printf("Updated %s from version %s to %s, restarting", exe, version, newVersion)
+	sendResponse(conn, []byte(fmt.Sprintf("Update to version %s verified, restarting\n", newVersion)), nil)
+	stopClient(errRestart)
+}
+
+// newerVersion reports whether v, the version an update is signed as, is
+// newer than the running one
+func newerVersion(v string) bool {
+	c, err := protocol.CompareVersions(v, version)
+	return err == nil && c > 0
+}
+
+// tryBinary runs the new binary with -version, which catches one that
+// does not run here at all, and returns the version it reports
+func tryBinary(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		return "", fmt.Errorf("the new binary does not run: %v", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// installUpdate moves the running executable to .old and the new one in
+// its place, and records the trial
+func installUpdate(exe, newVersion string) error {
+	os.Remove(exe + ".old")
+	if err := os.Rename(exe, exe+".old"); err != nil {
+		return err
+	}
+	if err := os.Rename(exe+".new", exe); err != nil {
+		os.Rename(exe+".old", exe)
+		return err
+	}
+	if err := writeUpdateState(exe, &updateState{Previous: version, Version: newVersion}); err != nil {
+		os.Rename(exe, exe+".new")
+		os.Rename(exe+".old", exe)
+		return err
+	}
+	return nil
+}
+
+// checkUpdate runs when the client starts. After an update it rolls back
+// if the new version already failed to start once, or gives it
+// updateTrial to get connected to a server. A failed start is only rolled
+// back because the service manager starts the client again, which is why
+// clients outside one refuse updates.
+func checkUpdate() {
+	exe, err := executable()
+	if err != nil {
+		return
+	}
+	state, err := readUpdateState(exe)
+	if err != nil {
+		log.Printf("Failed to read update state: %v", err)
+		return
+	}
+	if state == nil {
+		return
+	}
+	if state.Starts > 0 {
+		rollback(exe, state, "the last start did not get connected")
+		return
+	}
+
+	state.Starts++
+	if err := writeUpdateState(exe, state); err != nil {
+		log.Printf("Failed to write update state: %v", err)
+	}
+	log.Printf("Running update to version %s on trial, it must connect within %v of reaching a server", state.Version, updateTrial)
+
+	go func() {
+		trial := time.NewTimer(updateTrial)
+		defer trial.Stop()
+		for {
+			select {
+			case <-updateConfirmed:
+				os.Remove(updateStatePath(exe))
+				os.Remove(exe + ".old")
+				log.Printf("Update to version %s confirmed", state.Version)
+			case <-unreachable:
+				trial.Reset(updateTrial)
+				continue
+			case <-trial.C:
+				rollback(exe, state, fmt.Sprintf("not connected within %v", updateTrial))
+			case <-clientCtx.Done():
+				// Stopped before the trial was over, the next start gets a
+				// new trial. A restart for another update leaves its own state.
+				if context.Cause(clientCtx) != errRestart {
+					state.Starts--
+					writeUpdateState(exe, state)
+				}
+			}
+			return
+		}
+	}()
+}
+
+// serverUnreachable starts the trial of an update over, see updateTrial
+func serverUnreachable() {
+	select {
+	case unreachable <- struct{}{}:
+	default:
+	}
+}
+
+// confirmWhenConnected confirms an update once the connection has lasted
+// a while, which also means the server accepted the client
+func confirmWhenConnected(done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		confirmOnce.Do(func() { close(updateConfirmed) })
+	}
+}
+
+// rollback puts the previous executable back and restarts the client
+// with it
+func rollback(exe string, state *updateState, reason string) {
+	log.Printf("Update to version %s failed (%s), rolling back to %s", state.Version, reason, state.Previous)
+	localAudit.record(&auditEntry{
+		Time:      time.Now(),
+		Command:   fmt.Sprintf("rollback from %s to %s", state.Version, state.Previous),
+		Operation: "update",
+		Decision:  "allowed",
+		Reason:    reason,
+	})
+
+	// The running executable cannot be overwritten on Windows, but it
+	// can be renamed
+	os.Remove(exe + ".failed")
+	if err := os.Rename(exe, exe+".failed"); err != nil {
+		log.Printf("Failed to roll back: %v", err)
+		return
+	}
+	if err := os.Rename(exe+".old", exe); err != nil {
+		// Nothing to go back to, keep the new version
+		log.Printf("Failed to roll back: %v", err)
+		os.Rename(exe+".failed", exe)
+		os.Remove(updateStatePath(exe))
+		return
+	}
+	os.Remove(updateStatePath(exe))
+	stopClient(errRestart)
+}
+
+// executable is the path the client was started from. It is looked up
+// once: after an update is installed, the running binary is the .old file.
+var executable = sync.OnceValues(func() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+})
+
+func updateStatePath(exe string) string {
+	return exe + ".update"
+}
+
+func readUpdateState(exe string) (*updateState, error) {
+	data, err := os.ReadFile(updateStatePath(exe))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &updateState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func writeUpdateState(exe string, state *updateState) error {
+	data, _ := json.Marshal(state)
+	return os.WriteFile(updateStatePath(exe), data, 0644)
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gofrpprotocol"
+)
+
+var (
+	apiListen = flag.String("api-listen", "", "Address of the HTTP management API, e.g. 127.0.0.1:8080 (empty disables)")
+	apiToken  = flag.String("api-token", "", "Bearer token for the HTTP management API")
+)
+
+const (
+	// defaultJobWait is how long a synchronous request waits for its job
+	defaultJobWait = 60 * time.Second
+	// jobRetention is how long finished jobs can still be polled
+	jobRetention = time.Hour
+	// maxJobOutput caps the output lines kept per job
+	maxJobOutput = 10000
+)
+
+// apiServer runs the HTTP API and restarts it when its address changes.
+// Tokens are checked against the current configuration on every request.
+type apiServer struct {
+	mu       sync.Mutex
+	settings apiSettings
+	server   *http.Server
+}
+
+type apiSettings struct {
+	listen    string
+	tls       bool
+	cert, key string
+}
+
+var api = &apiServer{}
+
+func (as *apiServer) apply(c *Config) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	want := apiSettings{listen: c.API.Listen, tls: c.API.TLS, cert: c.TLS.Cert, key: c.TLS.Key}
+	if len(c.API.Tokens) == 0 {
+		if want.listen != "" {
+			log.Println("API not started: it needs at least one token")
+		}
+		want = apiSettings{}
+	}
+	if want == as.settings && (want.listen == "" || as.server != nil) {
+		return nil
+	}
+
+	var srv *http.Server
+	if want.listen != "" {
+		l, err := net.Listen("tcp", want.listen)
+		if err != nil {
+			return err
+		}
+		if want.tls {
+			cert, err := tls.LoadX509KeyPair(want.cert, want.key)
+			if err != nil {
+				l.Close()
+				return fmt.Errorf("api tls: %v", err)
+			}
+			l = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+		}
+
+		srv = &http.Server{Handler: newAPIHandler(), ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+				log.Printf("API server stopped: %v", err)
+			}
+		}()
+		log.Printf("API listening on %s", want.listen)
+	}
+
+	if as.server != nil {
+		as.server.Close()
+	}
+	as.settings, as.server = want, srv
+	return nil
+}
+
+func (as *apiServer) close() {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.server != nil {
+		as.server.Close()
+		as.server = nil
+	}
+}
+
+func newAPIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/sessions", apiListSessions)
+	mux.HandleFunc("GET /api/v1/sessions/{id}", apiGetSession)
+	mux.HandleFunc("POST /api/v1/sessions/{id}/commands", apiRunCommand)
+	mux.HandleFunc("POST /api/v1/sessions/{id}/transfers", apiStartTransfer)
+	mux.HandleFunc("POST /api/v1/sessions/{id}/screenshots", apiTakeScreenshot)
+	mux.HandleFunc("POST /api/v1/sessions/{id}/uploads", apiUpload)
+	mux.HandleFunc("GET /api/v1/jobs/{id}", apiGetJob)
+	mux.HandleFunc("GET /api/v1/jobs/{id}/output", apiStreamOutput)
+	mux.HandleFunc("GET /api/v1/jobs/{id}/files/{n}", apiDownloadFile)
+	mux.HandleFunc("GET /api/v1/forwards", apiListForwards)
+	mux.HandleFunc("POST /api/v1/forwards", apiAddForward)
+	mux.HandleFunc("DELETE /api/v1/forwards/{name}", apiRemoveForward)
+
+	// The web console is static; everything it does goes through the API
+	root := http.NewServeMux()
+	root.Handle("/api/", requireToken(mux))
+	root.Handle("/", webHandler())
+	return root
+}
+
+type operatorKey struct{}
+
+// requireToken rejects requests without a configured bearer token and
+// remembers the token's name as the operator
+func requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		name, valid := cfg().apiOperator(token)
+		if !ok || !valid {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gofrp"`)
+			apiError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), operatorKey{}, name)))
+	})
+}
+
+// apiOperator returns the name of the API token, if it is one
+func (c *Config) apiOperator(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	for _, t := range c.API.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return t.Name, true
+		}
+	}
+	return "", false
+}
+
+func operator(r *http.Request) string {
+	name, _ := r.Context().Value(operatorKey{}).(string)
+	return name
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, ErrorResponse{Error: message})
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		apiError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+func sessionInfo(s *Session, active int) SessionInfo {
+	info := SessionInfo{
+		ID:           s.ID,
+		ClientID:     s.info.ID,
+		Name:         s.info.Name,
+		Tags:         s.info.Tags,
+		Hostname:     s.info.Hostname,
+		OS:           s.info.OS,
+		Arch:         s.info.Arch,
+		Version:      s.info.Version,
+		Protocol:     max(s.info.Protocol, 1),
+		Capabilities: s.capabilities(),
+		Compression:  s.compression,
+		Address:      s.addr,
+		ConnectedAt:  s.connectedAt,
+		LastSeen:     time.Unix(0, s.lastSeen.Load()),
+		Active:       s.ID == active,
+	}
+	if m, ok := s.metrics.latest(); ok {
+		info.Metrics = &m
+	}
+	return info
+}
+
+func apiListSessions(w http.ResponseWriter, r *http.Request) {
+	active := sessions.activeID()
+	list := []SessionInfo{}
+	for _, s := range sessions.list() {
+		list = append(list, sessionInfo(s, active))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// apiSession looks up the session in the path, answering 404 if it is gone
+func apiSession(w http.ResponseWriter, r *http.Request) *Session {
+	s := sessions.find(r.PathValue("id"))
+	if s == nil {
+		apiError(w, http.StatusNotFound, fmt.Sprintf("no such client: %s", r.PathValue("id")))
+	}
+	return s
+}
+
+func apiGetSession(w http.ResponseWriter, r *http.Request) {
+	s := apiSession(w, r)
+	if s == nil {
+		return
+	}
+	info := sessionInfo(s, sessions.activeID())
+	info.History = s.metrics.all()
+	writeJSON(w, http.StatusOK, info)
+}
+
+func apiRunCommand(w http.ResponseWriter, r *http.Request) {
+	var req CommandRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	command := strings.TrimSpace(req.Command)
+	if command == "" {
+		apiError(w, http.StatusBadRequest, "command is required")
+		return
+	}
+	if p := cfg().dangerousMatch(command); p != "" && !req.Force {
+		apiError(w, http.StatusPreconditionRequired, fmt.Sprintf("%q matches the dangerous pattern %s, set force to send it", command, p))
+		return
+	}
+	apiStartJob(w, r, "command", command, req.WaitOptions)
+}
+
+func apiStartTransfer(w http.ResponseWriter, r *http.Request) {
+	var req TransferRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Path) == "" {
+		apiError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	apiStartJob(w, r, "transfer", "send "+strings.TrimSpace(req.Path), req.WaitOptions)
+}
+
+func apiTakeScreenshot(w http.ResponseWriter, r *http.Request) {
+	var req ScreenshotRequest
+	if r.ContentLength != 0 && !readJSON(w, r, &req) {
+		return
+	}
+	apiStartJob(w, r, "screenshot", "cmd capture screen", req.WaitOptions)
+}
+
+// apiUpload pushes the request body to the client as the file given by
+// the path query parameter. The body is sent before the response, the
+// options only decide whether to wait for the client to confirm.
+func apiUpload(w http.ResponseWriter, r *http.Request) {
+	dest := strings.TrimSpace(r.URL.Query().Get("path"))
+	if dest == "" {
+		apiError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	if r.ContentLength < 0 {
+		apiError(w, http.StatusLengthRequired, "Content-Length is required")
+		return
+	}
+	opts := WaitOptions{Async: r.URL.Query().Get("async") == "true"}
+	opts.Timeout, _ = strconv.Atoi(r.URL.Query().Get("timeout"))
+
+	sent := make(chan struct{})
+	write := func(w io.Writer, j *job) error {
+		defer close(sent)
+		h := sha256.New()
+		err := writeUpload(w, j.transfer, dest, io.TeeReader(r.Body, h), r.ContentLength)
+		j.sentFile(AuditFile{Name: dest, Size: r.ContentLength, SHA256: hex.EncodeToString(h.Sum(nil))})
+		return err
+	}
+	apiStartPayload(w, r, "upload", "upload "+dest, write, opts, sent)
+}
+
+// writeUpload sends size bytes of body as an upload to path, as transfer t
+func writeUpload(w io.Writer, t *transfer, path string, body io.Reader, size int64) error {
+	return writeChunked(w, t, protocol.UploadStart{Size: size, Path: path}, protocol.UploadEnd{}, body)
+}
+
+// writeChunked sends body as start, Chunk lines and end, the framing of
+// uploads and updates. Between chunks it waits while t is paused and
+// stops short if t is canceled.
+func writeChunked(w io.Writer, t *transfer, start, end protocol.Message, body io.Reader) error {
+	activeTransfers.Add(1)
+	defer activeTransfers.Add(-1)
+
+	switch m := start.(type) {
+	case protocol.UploadStart:
+		t.begin(m.Path, m.Size)
+	case protocol.UpdateStart:
+		t.begin(t.name(), m.Size)
+	}
+
+	// Every chunk is a single write, on w itself so that it is framed as
+	// agreed with the client
+	protocol.Write(w, start)
+
+	chunks := protocol.NewChunkWriter(w)
+	buf := make([]byte, protocol.ChunkSize)
+	var err error
+	for {
+		if err = t.checkpoint(); err != nil {
+			break
+		}
+		var k int
+		k, err = io.ReadFull(body, buf)
+		if _, werr := chunks.Write(buf[:k]); werr != nil {
+			// The client is gone, stop reading the body
+			return werr
+		}
+		t.progress(k)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// Always send the end, the client reports a short transfer as failed
+	if endErr := protocol.Write(w, end); err == nil {
+		err = endErr
+	}
+	return err
+}
+
+// apiStartJob sends command to the session in the path and answers with
+// the job, finished or not depending on opts
+func apiStartJob(w http.ResponseWriter, r *http.Request, kind, command string, opts WaitOptions) {
+	apiStartPayload(w, r, kind, command, nil, opts, nil)
+}
+
+// apiStartPayload is apiStartJob for requests that write more than the
+// command line. If sent is given, no response is written before it closes.
+func apiStartPayload(w http.ResponseWriter, r *http.Request, kind, command string, write func(io.Writer, *job) error, opts WaitOptions, sent <-chan struct{}) *job {
+	s := apiSession(w, r)
+	if s == nil {
+		return nil
+	}
+	if !cfg().commandAllowed(s, command) {
+		audit.record(AuditEntry{Operator: operator(r), Source: "api", Action: "command", Command: command, Status: "denied"}.withSession(s))
+		apiError(w, http.StatusForbidden, fmt.Sprintf("command %q is not allowed for client %s by policy", commandVerb(command), s))
+		return nil
+	}
+	if err := s.supports(command); err != nil {
+		apiError(w, http.StatusNotImplemented, err.Error())
+		return nil
+	}
+
+	j := jobs.start(s, kind, command, operator(r), write)
+	log.Printf("Command sent to %s via API by %s: %s", s, operator(r), command)
+
+	if sent != nil {
+		select {
+		case <-sent:
+		case <-j.done:
+		}
+	}
+
+	wait := defaultJobWait
+	if opts.Timeout > 0 {
+		wait = time.Duration(opts.Timeout) * time.Second
+	}
+	if !opts.Async {
+		select {
+		case <-j.done:
+			writeJSON(w, http.StatusOK, j.snapshot())
+			return j
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return j
+		}
+	}
+	writeJSON(w, http.StatusAccepted, j.snapshot())
+	return j
+}
+
+func apiGetJob(w http.ResponseWriter, r *http.Request) {
+	j := apiJob(w, r)
+	if j == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, j.snapshot())
+}
+
+// apiStreamOutput streams a job's output as it arrives, one JSON object
+// per line: {"line": "..."} for output, then {"job": {...}} once it ends
+func apiStreamOutput(w http.ResponseWriter, r *http.Request) {
+	j := apiJob(w, r)
+	if j == nil {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	enc := json.NewEncoder(w)
+
+	for offset := 0; ; {
+		lines, changed, finished := j.outputSince(offset)
+		for _, line := range lines {
+			enc.Encode(map[string]string{"line": line})
+		}
+		offset += len(lines)
+		if finished {
+			enc.Encode(map[string]Job{"job": j.snapshot()})
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func apiJob(w http.ResponseWriter, r *http.Request) *job {
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	j := jobs.get(id)
+	if j == nil {
+		apiError(w, http.StatusNotFound, fmt.Sprintf("no such job: %s", r.PathValue("id")))
+	}
+	return j
+}
+
+func apiDownloadFile(w http.ResponseWriter, r *http.Request) {
+	j := apiJob(w, r)
+	if j == nil {
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("n"))
+	path, ok := j.file(n)
+	if err != nil || !ok {
+		apiError(w, http.StatusNotFound, "no such file")
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		apiError(w, http.StatusGone, fmt.Sprintf("file is no longer available: %v", err))
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	http.ServeContent(w, r, filepath.Base(path), stat.ModTime(), f)
+}
+
+func apiListForwards(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, forwards.list())
+}
+
+func apiAddForward(w http.ResponseWriter, r *http.Request) {
+	var rule ForwardRule
+	if !readJSON(w, r, &rule) {
+		return
+	}
+	if rule.Listen == "" || rule.Target == "" {
+		apiError(w, http.StatusBadRequest, "listen and target are required")
+		return
+	}
+	if rule.Name == "" {
+		rule.Name = rule.Listen
+	}
+	err := forwards.add(rule, false)
+	audit.record(forwardEntry(operator(r), "api", "forward_add", rule, err))
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errForwardExists) {
+			status = http.StatusConflict
+		}
+		apiError(w, status, err.Error())
+		return
+	}
+	log.Printf("Forward %s added via API by %s", rule.Name, operator(r))
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+func apiRemoveForward(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !forwards.remove(name) {
+		apiError(w, http.StatusNotFound, fmt.Sprintf("no such forward: %s", name))
+		return
+	}
+	audit.record(forwardEntry(operator(r), "api", "forward_remove", ForwardRule{Name: name}, nil))
+	log.Printf("Forward %s removed via API by %s", name, operator(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// job is a command started through the API whose result can be polled
+type job struct {
+	mu    sync.Mutex
+	data  Job
+	paths []string
+	bytes int64       // output and files, for the audit log
+	files []AuditFile // files received or sent
+	// transfer is the upload of an upload job in the transfer queue
+	transfer *transfer
+	done     chan struct{}
+	changed  chan struct{} // closed and replaced whenever data changes
+}
+
+// jobStore keeps API jobs until jobRetention after they finish
+type jobStore struct {
+	mu     sync.Mutex
+	jobs   map[int64]*job
+	nextID int64
+}
+
+var jobs = &jobStore{jobs: make(map[int64]*job)}
+
+// start sends command to s, or whatever write writes if it is not nil,
+// and tracks it as a new job
+func (js *jobStore) start(s *Session, kind, command, operator string, write func(io.Writer, *job) error) *job {
+	js.mu.Lock()
+	js.prune()
+	js.nextID++
+	j := &job{
+		data: Job{
+			ID:        js.nextID,
+			Kind:      kind,
+			Session:   s.ID,
+			ClientID:  s.info.ID,
+			Command:   command,
+			Operator:  operator,
+			Status:    "running",
+			Output:    []string{},
+			StartedAt: time.Now(),
+		},
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	js.jobs[j.data.ID] = j
+	js.mu.Unlock()
+	if kind == "upload" {
+		j.transfer = transfers.add(s, upload, strings.TrimPrefix(command, "upload "), true)
+	}
+
+	sink := newResponseSink(j.appendOutput)
+	sink.file = j.addFile
+	s.transcript.command("api", operator, command)
+	go func() {
+		var err error
+		switch {
+		case j.transfer != nil:
+			// An upload waits for its turn in the transfer queue
+			if err = j.transfer.wait(nil); err == nil {
+				err = s.runPayload(func(w io.Writer) error { return write(w, j) }, sink, nil)
+				transfers.finish(j.transfer, err)
+			}
+		case write == nil:
+			err = s.run(command, sink, nil)
+		default:
+			err = s.runPayload(func(w io.Writer) error { return write(w, j) }, sink, nil)
+		}
+		j.finish(sink, err)
+		audit.record(j.auditEntry(s))
+	}()
+	return j
+}
+
+// prune drops jobs that finished long ago. js.mu must be held.
+func (js *jobStore) prune() {
+	for id, j := range js.jobs {
+		j.mu.Lock()
+		old := j.data.FinishedAt != nil && time.Since(*j.data.FinishedAt) > jobRetention
+		j.mu.Unlock()
+		if old {
+			delete(js.jobs, id)
+		}
+	}
+}
+
+func (js *jobStore) get(id int64) *job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.jobs[id]
+}
+
+func (j *job) appendOutput(line string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.bytes += int64(len(line)) + 1
+	if len(j.data.Output) >= maxJobOutput {
+		j.data.Truncated = true
+		return
+	}
+	j.data.Output = append(j.data.Output, line)
+	j.notify()
+}
+
+// notify wakes up output streams. j.mu must be held.
+func (j *job) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// outputSince returns the output from line offset on, a channel closed on
+// the next change, and whether the job has finished
+func (j *job) outputSince(offset int) ([]string, <-chan struct{}, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var lines []string
+	if offset < len(j.data.Output) {
+		lines = append(lines, j.data.Output[offset:]...)
+	}
+	return lines, j.changed, j.data.FinishedAt != nil
+}
+
+func (j *job) addFile(path string) {
+	digest := fileDigest(path)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.data.Files = append(j.data.Files, JobFile{
+		Name:   digest.Name,
+		Size:   digest.Size,
+		SHA256: digest.SHA256,
+		URL:    fmt.Sprintf("/api/v1/jobs/%d/files/%d", j.data.ID, len(j.paths)),
+	})
+	j.paths = append(j.paths, path)
+	j.bytes += digest.Size
+	j.files = append(j.files, digest)
+	j.notify()
+}
+
+// sentFile records a file the job sent to the client
+func (j *job) sentFile(f AuditFile) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.bytes += f.Size
+	j.files = append(j.files, f)
+}
+
+func (j *job) file(n int) (string, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if n < 0 || n >= len(j.paths) {
+		return "", false
+	}
+	return j.paths[n], true
+}
+
+func (j *job) finish(sink *responseSink, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	j.data.FinishedAt = &now
+	j.data.Status = "done"
+	switch {
+	case err != nil:
+		j.data.Status = "failed"
+		j.data.Error = err.Error()
+	case sink.exited:
+		code := sink.status
+		j.data.ExitCode = &code
+		if code != 0 {
+			j.data.Status = "failed"
+		}
+	case (j.data.Kind == "transfer" || j.data.Kind == "screenshot") && len(j.paths) == 0:
+		// The client explains why in the output
+		j.data.Status = "failed"
+		j.data.Error = "nothing was received"
+	}
+	j.notify()
+	close(j.done)
+}
+
+// auditEntry describes the finished job for the audit log
+func (j *job) auditEntry(s *Session) AuditEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return AuditEntry{
+		Time:     *j.data.FinishedAt,
+		Operator: j.data.Operator,
+		Source:   "api",
+		Action:   "command",
+		Command:  j.data.Command,
+		Status:   j.data.Status,
+		ExitCode: j.data.ExitCode,
+		Bytes:    j.bytes,
+		Files:    j.files,
+		Error:    j.data.Error,
+	}.withSession(s)
+}
+
+func (j *job) snapshot() Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	data := j.data
+	data.Output = append([]string{}, j.data.Output...)
+	data.Files = append([]JobFile(nil), j.data.Files...)
+	return data
+}
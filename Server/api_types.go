@@ -0,0 +1,103 @@
+package main
+
+import "time"
+
+// Request and response bodies of the HTTP API. All endpoints live under
+// /api/v1 and need an "Authorization: Bearer <token>" header.
+//
+//	GET    /sessions                    []SessionInfo
+//	GET    /sessions/{id}               SessionInfo, with metrics history
+//	POST   /sessions/{id}/commands      CommandRequest -> Job
+//	POST   /sessions/{id}/transfers     TransferRequest -> Job
+//	POST   /sessions/{id}/screenshots   ScreenshotRequest -> Job
+//	POST   /sessions/{id}/uploads       file contents -> Job
+//	       ?path=<destination on the client>[&async=true][&timeout=<seconds>]
+//	GET    /jobs/{id}                   Job
+//	GET    /jobs/{id}/output            streamed output, one JSON object per line:
+//	                                    {"line": "..."}, then {"job": Job}
+//	GET    /jobs/{id}/files/{n}         file contents
+//	GET    /forwards                    []ForwardRule
+//	POST   /forwards                    ForwardRule -> ForwardRule
+//	DELETE /forwards/{name}
+//
+// {id} of a session is anything "use" accepts: the session number, the
+// client name or ID, or its address. Errors come back as ErrorResponse.
+
+// SessionInfo describes a connected client
+type SessionInfo struct {
+	ID           int               `json:"id"`
+	ClientID     string            `json:"client_id,omitempty"`
+	Name         string            `json:"name,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Hostname     string            `json:"hostname,omitempty"`
+	OS           string            `json:"os,omitempty"`
+	Arch         string            `json:"arch,omitempty"`
+	Version      string            `json:"version,omitempty"`
+	Protocol     int               `json:"protocol"`              // 1 for clients without a hello
+	Capabilities []string          `json:"capabilities"`          // commands the client handles
+	Compression  map[string]string `json:"compression,omitempty"` // encoding agreed for each kind of frame
+	Address      string            `json:"address"`
+	ConnectedAt  time.Time         `json:"connected_at"`
+	LastSeen     time.Time         `json:"last_seen"`
+	Active       bool              `json:"active"` // the console's active session
+	Metrics      *Metrics          `json:"metrics,omitempty"`
+	History      []Metrics         `json:"history,omitempty"`
+}
+
+// WaitOptions say how long a request waits for its job. A job that is
+// not finished in time is returned with status "running" and HTTP 202, to
+// be polled at /jobs/{id}.
+type WaitOptions struct {
+	Async   bool `json:"async"`   // return at once
+	Timeout int  `json:"timeout"` // seconds, default 60
+}
+
+// CommandRequest runs a command on a client
+type CommandRequest struct {
+	Command string `json:"command"` // as typed on the console, e.g. "cmd dir c:\\"
+	// Force sends commands matching a dangerous pattern; without it they
+	// are refused with 428 Precondition Required
+	Force bool `json:"force,omitempty"`
+	WaitOptions
+}
+
+// TransferRequest fetches a file from a client
+type TransferRequest struct {
+	Path string `json:"path"`
+	WaitOptions
+}
+
+// ScreenshotRequest takes a screenshot of a client
+type ScreenshotRequest struct {
+	WaitOptions
+}
+
+// Job is a command, transfer, screenshot or upload started through the API
+type Job struct {
+	ID         int64      `json:"id"`
+	Kind       string     `json:"kind"` // command, transfer, screenshot or upload
+	Session    int        `json:"session"`
+	ClientID   string     `json:"client_id,omitempty"`
+	Command    string     `json:"command"`
+	Operator   string     `json:"operator"`
+	Status     string     `json:"status"`              // running, done or failed
+	ExitCode   *int       `json:"exit_code,omitempty"` // for cmd and ps
+	Output     []string   `json:"output"`
+	Truncated  bool       `json:"truncated,omitempty"` // output was cut at maxJobOutput lines
+	Files      []JobFile  `json:"files,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// JobFile is a file or screenshot a job received
+type JobFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	URL    string `json:"url"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
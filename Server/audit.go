@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var auditPath = flag.String("audit-log", "", "Append-only JSON lines audit log of operator actions (empty disables)")
+
+// AuditEntry is one line of the audit log. Each entry carries the hash of
+// the one before it, so removing or editing a line breaks the chain; see
+// "gofrpserver audit verify".
+type AuditEntry struct {
+	Seq      int64       `json:"seq"`
+	Time     time.Time   `json:"time"`
+	Operator string      `json:"operator"` // local user, or API token name
+	Source   string      `json:"source"`   // console, exec, api or signal
+	Action   string      `json:"action"`   // command, command_exit, file_received, forward_add, forward_remove, disconnect, reload or shutdown
+	Client   string      `json:"client,omitempty"`
+	ClientID string      `json:"client_id,omitempty"`
+	Command  string      `json:"command,omitempty"`
+	Status   string      `json:"status,omitempty"` // sent, done, failed or denied
+	ExitCode *int        `json:"exit_code,omitempty"`
+	Bytes    int64       `json:"bytes,omitempty"`
+	Files    []AuditFile `json:"files,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	PrevHash string      `json:"prev_hash"`
+	Hash     string      `json:"hash"`
+}
+
+// AuditFile is a file received from or sent to a client
+type AuditFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// auditLog appends entries to the configured file, rotating it when it
+// grows past maxSize. The hash chain continues across rotated files.
+type auditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	path     string
+	size     int64
+	maxSize  int64
+	keep     int
+	seq      int64
+	lastHash string
+}
+
+var audit = &auditLog{}
+
+// open switches the log to path. An empty path disables auditing.
+func (a *auditLog) open(c AuditConfig) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.maxSize = int64(c.MaxSize) << 20
+	a.keep = c.Keep
+	if c.File == a.path {
+		return nil
+	}
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	a.path = c.File
+	if c.File == "" {
+		return nil
+	}
+
+	// Pick the chain up where the last entry left it
+	last, err := lastAuditEntry(c.File)
+	if err != nil {
+		return fmt.Errorf("audit log %s: %v", c.File, err)
+	}
+	a.seq, a.lastHash = 0, ""
+	if last != nil {
+		a.seq, a.lastHash = last.Seq, last.Hash
+	}
+
+	f, err := os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("audit log %s: %v", c.File, err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.size = f, stat.Size()
+	return nil
+}
+
+// record completes e with sequence number, time and hashes and appends it
+func (a *auditLog) record(e AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+
+	if a.maxSize > 0 && a.size >= a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Printf("Failed to rotate audit log: %v", err)
+		}
+	}
+
+	// The chain only moves on once the entry is written, so that a
+	// failed write does not look like a removed entry
+	e.Seq = a.seq + 1
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.PrevHash = a.lastHash
+	e.Hash = auditHash(e)
+
+	n, err := a.file.Write(encodeAuditEntry(e))
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+		// Nor does part of a line stay behind to break it
+		if n > 0 {
+			a.file.Truncate(a.size)
+		}
+		return
+	}
+	a.size += int64(n)
+	a.seq, a.lastHash = e.Seq, e.Hash
+}
+
+// close flushes and closes the log; later entries are dropped
+func (a *auditLog) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Sync()
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+// rotate renames the current file with a timestamp suffix, starts a new
+// one and drops the oldest rotated files beyond keep. a.mu must be held.
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+
+	rotated := a.path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(a.path, rotated); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	a.file, a.size = f, 0
+
+	if a.keep > 0 {
+		old := rotatedAuditFiles(a.path)
+		for len(old) > a.keep {
+			os.Remove(old[0])
+			old = old[1:]
+		}
+	}
+	return nil
+}
+
+// rotatedAuditFiles lists the rotated files of path, oldest first
+func rotatedAuditFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	sort.Strings(matches)
+	return matches
+}
+
+// lastAuditEntry returns the newest entry of path, looking at rotated
+// files if path itself is empty or missing
+func lastAuditEntry(path string) (*AuditEntry, error) {
+	candidates := append(rotatedAuditFiles(path), path)
+	for i := len(candidates) - 1; i >= 0; i-- {
+		data, err := os.ReadFile(candidates[i])
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+		if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("last entry of %s: %v", candidates[i], err)
+		}
+		return &e, nil
+	}
+	return nil, nil
+}
+
+// auditHash is the SHA-256 of the entry with an empty Hash field, which
+// includes PrevHash and so the whole chain before it
+func auditHash(e AuditEntry) string {
+	e.Hash = ""
+	sum := sha256.Sum256(encodeAuditEntry(e))
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeAuditEntry is the JSON line of e. Commands are kept readable
+// rather than HTML escaped.
+func encodeAuditEntry(e AuditEntry) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(e)
+	return buf.Bytes()
+}
+
+// withSession fills in the client of an entry
+func (e AuditEntry) withSession(s *Session) AuditEntry {
+	if s != nil {
+		e.Client = s.String()
+		e.ClientID = s.info.ID
+	}
+	return e
+}
+
+// consoleOperator is the local user running the server's console. The
+// entry's source tells operators of the console, exec and the API apart.
+var consoleOperator = sync.OnceValue(localUser)
+
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// fileDigest returns the size and SHA-256 of a saved file
+func fileDigest(path string) AuditFile {
+	af := AuditFile{Name: filepath.Base(path)}
+	f, err := os.Open(path)
+	if err != nil {
+		return af
+	}
+	defer f.Close()
+	h := sha256.New()
+	af.Size, _ = io.Copy(h, f)
+	af.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return af
+}
+
+// runAudit implements "gofrpserver audit verify FILE...". Files are read
+// in the order given, so list rotated files oldest first and the current
+// file last.
+func runAudit(args []string) {
+	if len(args) < 2 || args[0] != "verify" {
+		fmt.Fprintf(os.Stderr, "Usage: %s audit verify <file> [file...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Example: %s audit verify audit.log.* audit.log\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	count, err := verifyAudit(args[1:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("OK: %d entries, chain intact\n", count)
+}
+
+// verifyAudit checks the hash chain through the files in order and
+// returns the number of entries
+func verifyAudit(names []string) (int, error) {
+	var prev *AuditEntry
+	count := 0
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			return count, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+		for lineNo := 1; scanner.Scan(); lineNo++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var e AuditEntry
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				f.Close()
+				return count, fmt.Errorf("%s:%d: unreadable entry: %v", name, lineNo, err)
+			}
+			if auditHash(e) != e.Hash {
+				f.Close()
+				return count, fmt.Errorf("%s:%d: entry %d was modified", name, lineNo, e.Seq)
+			}
+			if prev != nil && (e.PrevHash != prev.Hash || e.Seq != prev.Seq+1) {
+				f.Close()
+				return count, fmt.Errorf("%s:%d: chain broken between entries %d and %d", name, lineNo, prev.Seq, e.Seq)
+			}
+			prev = &e
+			count++
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return count, fmt.Errorf("reading %s: %v", name, err)
+		}
+	}
+	return count, nil
+}
+
+// forwardEntry describes adding or removing a port forward
+func forwardEntry(operator, source, action string, rule ForwardRule, err error) AuditEntry {
+	e := AuditEntry{Operator: operator, Source: source, Action: action, Client: rule.Client, Command: rule.Name, Status: "done"}
+	if rule.Listen != "" {
+		e.Command = fmt.Sprintf("%s -> %s", rule.Listen, rule.Target)
+		if rule.Name != rule.Listen {
+			e.Command = rule.Name + ": " + e.Command
+		}
+	}
+	if err != nil {
+		e.Status, e.Error = "failed", err.Error()
+	}
+	return e
+}
+
+// auditConsoleFile records a file received for a console command
+func auditConsoleFile(s *Session, path string) {
+	f := fileDigest(path)
+	audit.record(AuditEntry{
+		Operator: consoleOperator(),
+		Source:   "console",
+		Action:   "file_received",
+		Status:   "done",
+		Bytes:    f.Size,
+		Files:    []AuditFile{f},
+	}.withSession(s))
+}
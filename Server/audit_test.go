@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a := &auditLog{}
+	if err := a.open(AuditConfig{File: path}); err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+
+	record := func(command string) {
+		a.record(AuditEntry{Operator: "op", Source: "console", Action: "command", Command: command, Status: "sent"})
+	}
+
+	// Entries on both sides of a rotation, and one whose write fails in
+	// between, which must leave no gap
+	record("cmd dir")
+	record("send a.txt")
+	a.mu.Lock()
+	err := a.rotate()
+	a.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writable := a.file
+	if a.file, err = os.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	record("cmd lost")
+	a.file.Close()
+	a.file = writable
+	record("cmd ver")
+	if a.seq != 3 {
+		t.Fatalf("seq %d after 3 entries written", a.seq)
+	}
+
+	files := append(rotatedAuditFiles(path), path)
+	if len(files) != 2 {
+		t.Fatalf("got files %v, want one rotated file and the log", files)
+	}
+	if n, err := verifyAudit(files); err != nil || n != 3 {
+		t.Fatalf("verifyAudit = %d, %v, want 3 entries", n, err)
+	}
+
+	for _, c := range []struct {
+		name string
+		edit func(lines [][]byte) [][]byte
+		want string
+	}{
+		{"edited", func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte("send a.txt"), []byte("send b.txt"), 1)
+			return lines
+		}, "entry 2 was modified"},
+		{"removed", func(lines [][]byte) [][]byte {
+			return lines[:1]
+		}, "chain broken between entries 1 and 3"},
+		{"truncated", func(lines [][]byte) [][]byte {
+			lines[1] = lines[1][:len(lines[1])/2]
+			return lines
+		}, "unreadable entry"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			rotated := files[0]
+			orig, err := os.ReadFile(rotated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.WriteFile(rotated, orig, 0600)
+
+			lines := bytes.Split(bytes.TrimSpace(orig), []byte("\n"))
+			edited := append(bytes.Join(c.edit(lines), []byte("\n")), '\n')
+			if err := os.WriteFile(rotated, edited, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := verifyAudit(files); err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("verifyAudit = %v, want %q", err, c.want)
+			}
+		})
+	}
+}
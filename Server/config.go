@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"gofrpprotocol"
+)
+
+const defaultPrompt = "Please enter command (cmd <command> or ps <command>): "
+
+var configPath = flag.String("config", "", "YAML configuration file (reloaded on SIGHUP or with the reload command)")
+
+// Config is everything the server can be configured with. Command line
+// flags provide the defaults, the file given with -config overrides them.
+type Config struct {
+	Listen      []ListenConfig    `yaml:"listen"`
+	TLS         TLSConfig         `yaml:"tls"`
+	TrustProxy  bool              `yaml:"trust_proxy"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Output      OutputConfig      `yaml:"output"`
+	Console     ConsoleConfig     `yaml:"console"`
+	ReadTimeout time.Duration     `yaml:"read_timeout"`
+	Heartbeat   HeartbeatConfig   `yaml:"heartbeat"`
+	Alerts      AlertConfig       `yaml:"alerts"`
+	Forwards    []ForwardRule     `yaml:"forwards"`
+	Clients     []ClientPolicy    `yaml:"clients"`
+	Logging     LoggingConfig     `yaml:"logging"`
+	Control     string            `yaml:"control"` // control socket for "gofrpserver exec"
+	API         APIConfig         `yaml:"api"`
+	Audit       AuditConfig       `yaml:"audit"`
+	Updates     string            `yaml:"updates"` // signed client binaries for "update"
+	Compression CompressionConfig `yaml:"compression"`
+	Limits      LimitConfig       `yaml:"limits"`
+
+	// ControlToken is the file with the token a TCP control socket
+	// requires, see execRequest
+	ControlToken string `yaml:"control_token"`
+
+	// MaxTransfers is how many transfers run at once for each client, 0
+	// for no limit
+	MaxTransfers int `yaml:"max_transfers"`
+
+	// ShutdownTimeout is how long shutdown waits for transfers in progress
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// Dangerous are regular expressions of commands that need confirming
+	// on the console, or --force from exec and the API
+	Dangerous []string `yaml:"dangerous_commands"`
+	dangerous []*regexp.Regexp
+}
+
+type ListenConfig struct {
+	Address   string `yaml:"address"`
+	Transport string `yaml:"transport"` // tcp, ws, wss or quic
+	WSPath    string `yaml:"ws_path"`
+}
+
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+type AuthConfig struct {
+	// Keys clients may authenticate with. Empty means no authentication.
+	Keys []string `yaml:"keys"`
+}
+
+type OutputConfig struct {
+	Files       string `yaml:"files"`
+	Screenshots string `yaml:"screenshots"`
+	Transcripts string `yaml:"transcripts"` // empty disables transcripts
+}
+
+type ConsoleConfig struct {
+	HistoryFile string `yaml:"history_file"`
+	Prompt      string `yaml:"prompt"`
+}
+
+type HeartbeatConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Misses   int           `yaml:"misses"`
+}
+
+type AlertConfig struct {
+	CPU     float64 `yaml:"cpu"`
+	Mem     float64 `yaml:"mem"`
+	Disk    float64 `yaml:"disk"`
+	Webhook string  `yaml:"webhook"`
+}
+
+// ForwardRule exposes Target, as seen from a client, on Listen on the server
+type ForwardRule struct {
+	Name   string `yaml:"name" json:"name"`
+	Listen string `yaml:"listen" json:"listen"`
+	Client string `yaml:"client" json:"client"` // session id, address, client name or ID; empty means the active session
+	Target string `yaml:"target" json:"target"`
+}
+
+// ClientPolicy limits the commands that may be sent to matching clients.
+// The first policy whose Match pattern matches the client applies.
+type ClientPolicy struct {
+	Match string   `yaml:"match"` // glob against session id, address, client name or ID, or "tag:<tag>"
+	Allow []string `yaml:"allow"` // command verbs, empty allows all
+	Deny  []string `yaml:"deny"`
+}
+
+// APIConfig is the HTTP management API. It only starts with a listen
+// address and at least one token.
+type APIConfig struct {
+	Listen string     `yaml:"listen"`
+	TLS    bool       `yaml:"tls"` // serve HTTPS with the tls certificate
+	Tokens []APIToken `yaml:"tokens"`
+}
+
+// APIToken is a bearer token; Name identifies the operator using it
+type APIToken struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+}
+
+// AuditConfig is the audit log of operator actions. The file is rotated
+// once it reaches MaxSize megabytes; Keep rotated files are kept.
+type AuditConfig struct {
+	File    string `yaml:"file"`
+	MaxSize int    `yaml:"max_size"`
+	Keep    int    `yaml:"keep"`
+}
+
+// CompressionConfig is the encoding, zstd, gzip or none, asked of clients
+// for each kind of frame. A client that cannot do it gets the other one.
+type CompressionConfig struct {
+	Output string `yaml:"output"` // command output and other lines
+	Data   string `yaml:"data"`   // chunks of files, uploads, updates and screenshots
+}
+
+// kinds maps the kinds of frames to the encoding asked for
+func (c CompressionConfig) kinds() map[string]string {
+	return map[string]string{protocol.OutputFrames: c.Output, protocol.DataFrames: c.Data}
+}
+
+func (c CompressionConfig) check() error {
+	for kind, enc := range c.kinds() {
+		if enc != protocol.None && !slices.Contains(protocol.Encodings, enc) {
+			return fmt.Errorf("compression %s: unknown encoding %q, want zstd, gzip or none", kind, enc)
+		}
+	}
+	return nil
+}
+
+type LoggingConfig struct {
+	File string `yaml:"file"`
+}
+
+var (
+	currentConfig atomic.Pointer[Config]
+	configMu      sync.Mutex // serializes reloads
+	logFile       *os.File
+)
+
+// cfg returns the configuration in effect
+func cfg() *Config {
+	return currentConfig.Load()
+}
+
+// flagConfig builds the configuration from the command line flags alone
+func flagConfig() *Config {
+	c := &Config{
+		Listen: []ListenConfig{{
+			Address:   ":" + *serverPort,
+			Transport: *transportName,
+			WSPath:    *wsPath,
+		}},
+		TLS:             TLSConfig{Cert: *tlsCert, Key: *tlsKey},
+		TrustProxy:      *trustProxy,
+		Output:          OutputConfig{Files: ".", Screenshots: ".", Transcripts: *transcriptDir},
+		Console:         ConsoleConfig{HistoryFile: "/tmp/gofrp_history", Prompt: defaultPrompt},
+		ReadTimeout:     30 * time.Second,
+		ShutdownTimeout: *shutdownTimeout,
+		Heartbeat:       HeartbeatConfig{Interval: *heartbeatInterval, Misses: *heartbeatMisses},
+		Alerts:          AlertConfig{CPU: *alertCPU, Mem: *alertMem, Disk: *alertDisk, Webhook: *alertWebhook},
+		Control:         *controlAddr,
+		ControlToken:    *controlTokenPath,
+		API:             APIConfig{Listen: *apiListen},
+		Audit:           AuditConfig{File: *auditPath, MaxSize: 100, Keep: 10},
+		Updates:         *updatesDir,
+		Compression:     CompressionConfig{Output: *compressionName, Data: *compressionName},
+		Limits:          LimitConfig{Transfer: *transferLimit, Forward: *forwardLimit},
+		MaxTransfers:    *maxTransfers,
+		Dangerous:       append([]string(nil), defaultDangerous...),
+	}
+	if *apiToken != "" {
+		c.API.Tokens = []APIToken{{Name: "default", Token: *apiToken}}
+	}
+	return c
+}
+
+// loadConfig reads the -config file on top of the flag defaults
+func loadConfig() (*Config, error) {
+	c := flagConfig()
+	if *configPath == "" {
+		return c, c.check()
+	}
+
+	data, err := os.ReadFile(*configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", *configPath, err)
+	}
+
+	for i := range c.Listen {
+		if c.Listen[i].Transport == "" {
+			c.Listen[i].Transport = "tcp"
+		}
+		if c.Listen[i].WSPath == "" {
+			c.Listen[i].WSPath = *wsPath
+		}
+	}
+	for i, f := range c.Forwards {
+		if f.Listen == "" || f.Target == "" {
+			return nil, fmt.Errorf("forward %d: listen and target are required", i+1)
+		}
+		if f.Name == "" {
+			c.Forwards[i].Name = f.Listen
+		}
+	}
+	if c.Console.Prompt == "" {
+		c.Console.Prompt = defaultPrompt
+	}
+	if c.ReadTimeout <= 0 {
+		c.ReadTimeout = 30 * time.Second
+	}
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// check validates and parses the settings that need it
+func (c *Config) check() error {
+	if err := c.Compression.check(); err != nil {
+		return err
+	}
+	if err := c.Limits.parse(); err != nil {
+		return err
+	}
+	return c.compileDangerous()
+}
+
+// applyConfig makes c the active configuration. Connected sessions are
+// kept; listeners and forwards are started or stopped to match c.
+func applyConfig(c *Config) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	for _, dir := range []string{c.Output.Files, c.Output.Screenshots, c.Output.Transcripts} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("output directory %s: %v", dir, err)
+		}
+	}
+
+	if err := openLogFile(c.Logging.File); err != nil {
+		return err
+	}
+
+	if err := audit.open(c.Audit); err != nil {
+		return err
+	}
+
+	// Connections accepted by new listeners must already see c
+	old := currentConfig.Swap(c)
+	if err := listeners.apply(c); err != nil {
+		if old != nil {
+			currentConfig.Store(old)
+		}
+		return err
+	}
+
+	// A control socket or API that cannot move is not worth failing a
+	// reload for
+	if err := control.apply(c.Control, c.ControlToken); err != nil {
+		log.Printf("Failed to start control socket: %v", err)
+	}
+	if err := api.apply(c); err != nil {
+		log.Printf("Failed to start API: %v", err)
+	}
+
+	forwards.apply(c.Forwards)
+	sessions.applyLimits(c.Limits)
+	return nil
+}
+
+func openLogFile(name string) error {
+	if logFile != nil && logFile.Name() == name {
+		return nil
+	}
+	if name == "" {
+		log.SetOutput(os.Stderr)
+		if logFile != nil {
+			logFile.Close()
+			logFile = nil
+		}
+		return nil
+	}
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("log file %s: %v", name, err)
+	}
+	log.SetOutput(io.MultiWriter(os.Stderr, f))
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+	return nil
+}
+
+// reloadConfig re-reads the configuration file. On any error the old
+// configuration stays in effect.
+func reloadConfig() {
+	c, err := loadConfig()
+	if err == nil {
+		err = applyConfig(c)
+	}
+	if err != nil {
+		log.Printf("Failed to reload configuration, keeping the old one: %v", err)
+		return
+	}
+	log.Printf("Configuration reloaded (%d listener(s), %d forward(s))", len(c.Listen), len(c.Forwards))
+}
+
+// watchReloadSignal reloads the configuration on SIGHUP
+func watchReloadSignal() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		log.Println("SIGHUP received, reloading configuration")
+		reloadConfig()
+	}
+}
+
+// authorized reports whether key is one of the configured auth keys
+func (c *Config) authorized(key string) bool {
+	if len(c.Auth.Keys) == 0 {
+		return true
+	}
+	for _, k := range c.Auth.Keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// commandAllowed checks command against the first policy matching s
+func (c *Config) commandAllowed(s *Session, command string) bool {
+	verb := commandVerb(command)
+	for _, p := range c.Clients {
+		if !s.matches(p.Match) {
+			continue
+		}
+		for _, d := range p.Deny {
+			if d == verb {
+				return false
+			}
+		}
+		if len(p.Allow) == 0 {
+			return true
+		}
+		for _, a := range p.Allow {
+			if a == verb {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// commandVerb is the name policies use for a command
+func commandVerb(command string) string {
+	if command == "cmd capture screen" {
+		return "screenshot"
+	}
+	verb, _, _ := strings.Cut(command, " ")
+	return verb
+}
+
+// matches reports whether pattern, a glob, matches any of the session's
+// identifiers
+func (s *Session) matches(pattern string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	for _, candidate := range s.identifiers() {
+		if ok, _ := path.Match(pattern, candidate); ok {
+			return true
+		}
+	}
+	return false
+}
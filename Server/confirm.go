@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// defaultDangerous are the patterns of commands that need confirmation
+// unless the configuration lists its own
+var defaultDangerous = []string{
+	`^shutdown$`,
+	`^client-quit$`,
+	`^update(\s|$)`,
+	`(?i)^cmd\s.*\b(del|erase)\b.*\s/[sq]\b`,
+	`(?i)^cmd\s.*\b(rd|rmdir)\b.*\s/s\b`,
+	`(?i)^cmd\s.*\bformat\s+[a-z]:`,
+	`(?i)^(cmd|ps)\s.*\b(shutdown|stop-computer|restart-computer)\b`,
+	`(?i)^ps\s.*\bremove-item\b.*-recurse`,
+	`(?i)^ps\s.*\b(format-volume|clear-disk)\b`,
+	`(?i)^cmd\s.*\brm\s+(-\S+\s+)*-[a-z]*(r[a-z]*f|f[a-z]*r)`,
+}
+
+const (
+	forcePrefix  = "--force "
+	dryRunPrefix = "--dry-run "
+)
+
+// compileDangerous checks the dangerous_commands patterns
+func (c *Config) compileDangerous() error {
+	c.dangerous = nil
+	for _, p := range c.Dangerous {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("dangerous_commands: %v", err)
+		}
+		c.dangerous = append(c.dangerous, re)
+	}
+	return nil
+}
+
+// cutForce returns command without the --force that skips its
+// confirmation, and whether it had one
+func cutForce(command string) (string, bool) {
+	forced, ok := strings.CutPrefix(command, forcePrefix)
+	if !ok {
+		return command, false
+	}
+	return strings.TrimSpace(forced), true
+}
+
+// dangerousMatch returns the pattern command matches, or "" if it is safe
+// to send without asking
+func (c *Config) dangerousMatch(command string) string {
+	for _, re := range c.dangerous {
+		if re.MatchString(command) {
+			return re.String()
+		}
+	}
+	return ""
+}
+
+// dryRun describes what command would do without doing it: which client
+// it would go to, and whether policy and confirmation let it through
+func dryRun(command string, s *Session) []string {
+	if command == "shutdown" {
+		return []string{
+			fmt.Sprintf("Would shut down the server and disconnect %d client(s)", len(sessions.list())),
+			confirmationNote(command),
+		}
+	}
+	if fields := strings.Fields(command); len(fields) > 0 {
+		if c, ok := consoleCommands[fields[0]]; ok && !c.client {
+			return []string{"Handled by the server itself, nothing is sent to a client"}
+		}
+	}
+	if s == nil {
+		return []string{"No matching client is connected, nothing would be sent"}
+	}
+
+	lines := []string{fmt.Sprintf("Would send to %s", s)}
+	if !cfg().commandAllowed(s, command) {
+		lines = append(lines, fmt.Sprintf("Refused: %q is not allowed for this client by policy", commandVerb(command)))
+	}
+	if err := s.supports(command); err != nil {
+		lines = append(lines, fmt.Sprintf("Refused: %v", err))
+	}
+	return append(lines, confirmationNote(command))
+}
+
+func confirmationNote(command string) string {
+	if p := cfg().dangerousMatch(command); p != "" {
+		return fmt.Sprintf("Needs confirmation or --force: matches dangerous pattern %s", p)
+	}
+	return "No confirmation needed"
+}
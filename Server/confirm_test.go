@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestDangerousMatch(t *testing.T) {
+	c := Config{Dangerous: defaultDangerous}
+	if err := c.compileDangerous(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		command string
+		want    string // the pattern it matches, "" for none
+	}{
+		{"shutdown", `^shutdown$`},
+		{"shutdown now", ""},
+		{"client-quit", `^client-quit$`},
+		{"update", `^update(\s|$)`},
+		{"update ./gofrpclient", `^update(\s|$)`},
+		{"updates", ""},
+		{`cmd del /s /q C:\temp`, `(?i)^cmd\s.*\b(del|erase)\b.*\s/[sq]\b`},
+		{`CMD ERASE C:\temp\a.txt /Q`, `(?i)^cmd\s.*\b(del|erase)\b.*\s/[sq]\b`},
+		{`cmd del C:\temp\a.txt`, ""},
+		{`cmd rmdir /s C:\temp`, `(?i)^cmd\s.*\b(rd|rmdir)\b.*\s/s\b`},
+		{`cmd dir /s C:\temp`, ""},
+		{"cmd format d: /q", `(?i)^cmd\s.*\bformat\s+[a-z]:`},
+		{"cmd echo format", ""},
+		{"cmd shutdown /r /t 0", `(?i)^(cmd|ps)\s.*\b(shutdown|stop-computer|restart-computer)\b`},
+		{"ps Restart-Computer -Force", `(?i)^(cmd|ps)\s.*\b(shutdown|stop-computer|restart-computer)\b`},
+		{`ps Remove-Item C:\temp -Recurse`, `(?i)^ps\s.*\bremove-item\b.*-recurse`},
+		{`ps Remove-Item C:\temp\a.txt`, ""},
+		{"ps Get-Disk | Clear-Disk -RemoveData", `(?i)^ps\s.*\b(format-volume|clear-disk)\b`},
+		{"cmd rm -rf /tmp/x", `(?i)^cmd\s.*\brm\s+(-\S+\s+)*-[a-z]*(r[a-z]*f|f[a-z]*r)`},
+		{"cmd rm -fr /tmp/x", `(?i)^cmd\s.*\brm\s+(-\S+\s+)*-[a-z]*(r[a-z]*f|f[a-z]*r)`},
+		{"cmd rm -v -Rf /tmp/x", `(?i)^cmd\s.*\brm\s+(-\S+\s+)*-[a-z]*(r[a-z]*f|f[a-z]*r)`},
+		{"cmd rm -f /tmp/x", ""},
+		{"cmd ls -la", ""},
+		{"ps Get-Process", ""},
+		// Only at the start of a command
+		{"send /tmp/shutdown", ""},
+		{"--force shutdown", ""},
+	} {
+		if got := c.dangerousMatch(test.command); got != test.want {
+			t.Errorf("dangerousMatch(%q) = %q, want %q", test.command, got, test.want)
+		}
+	}
+
+	// No patterns, nothing needs confirmation; a bad one is an error
+	if got := (&Config{}).dangerousMatch("shutdown"); got != "" {
+		t.Errorf("dangerousMatch without patterns = %q", got)
+	}
+	if err := (&Config{Dangerous: []string{`(`}}).compileDangerous(); err == nil {
+		t.Error("dangerous pattern ( compiles")
+	}
+}
+
+func TestCutForce(t *testing.T) {
+	for _, test := range []struct {
+		command, want string
+		forced        bool
+	}{
+		{"--force shutdown", "shutdown", true},
+		{"--force   cmd del /s /q C:\\temp ", "cmd del /s /q C:\\temp", true},
+		{"--force ", "", true},
+		{"shutdown", "shutdown", false},
+		{"--force", "--force", false},
+		{"--forceshutdown", "--forceshutdown", false},
+		{"--FORCE shutdown", "--FORCE shutdown", false},
+		{"cmd --force shutdown", "cmd --force shutdown", false},
+	} {
+		if got, forced := cutForce(test.command); got != test.want || forced != test.forced {
+			t.Errorf("cutForce(%q) = %q, %v, want %q, %v", test.command, got, forced, test.want, test.forced)
+		}
+	}
+}
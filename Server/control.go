@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var controlAddr = flag.String("control", filepath.Join(os.TempDir(), "gofrpserver.sock"),
+	"Control socket for \"gofrpserver exec\": a unix socket path or a localhost host:port (empty disables)")
+
+var controlTokenPath = flag.String("control-token", "",
+	"File with the token a localhost host:port control socket requires, created if missing")
+
+// The control protocol is one JSON execRequest line from the caller, then
+// lines from the server: "OUT <line>" for output, and finally either
+// "EXIT <code>" or "ERR <message>".
+//
+// Only the user the server runs as can use it: a unix socket is private to
+// that user, and a TCP one, which every local user can reach, requires the
+// token in a file only that user can read. That user is who the audit log
+// records as the operator.
+type execRequest struct {
+	Client  string `json:"client"` // session selector, empty means the active session
+	Command string `json:"command"`
+	Token   string `json:"token,omitempty"` // from the token file, for TCP sockets
+	Force   bool   `json:"force"`           // send even if the command matches a dangerous pattern
+	DryRun  bool   `json:"dry_run"`         // only describe what would happen
+}
+
+// controlServer is the local socket scripts talk to the server through
+type controlServer struct {
+	mu        sync.Mutex
+	addr      string
+	tokenPath string
+	listener  net.Listener
+}
+
+var control = &controlServer{}
+
+// controlNetwork tells unix socket paths from host:port addresses
+func controlNetwork(addr string) string {
+	if strings.ContainsAny(addr, `/\`) {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// apply moves the control socket to addr. A TCP socket takes its token
+// from the file at tokenPath.
+func (cs *controlServer) apply(addr, tokenPath string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if addr == cs.addr && tokenPath == cs.tokenPath && (addr == "" || cs.listener != nil) {
+		return nil
+	}
+
+	var l net.Listener
+	var token string
+	if addr != "" {
+		var err error
+		if controlNetwork(addr) == "tcp" {
+			if token, err = controlToken(tokenPath); err != nil {
+				return fmt.Errorf("control socket %s: %v", addr, err)
+			}
+		}
+		if l, err = listenControl(addr); err != nil {
+			return fmt.Errorf("control socket %s: %v", addr, err)
+		}
+		log.Printf("Control socket listening on %s", addr)
+	}
+
+	if cs.listener != nil {
+		cs.listener.Close()
+	}
+	cs.addr, cs.tokenPath, cs.listener = addr, tokenPath, l
+	if l != nil {
+		go cs.serve(l, token)
+	}
+	return nil
+}
+
+// controlToken reads the token of a TCP control socket from the file at
+// path, and writes a new one there if there is no file yet
+func controlToken(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("a TCP control socket needs control_token, the file with its token")
+	}
+	token, err := readControlToken(path)
+	if !os.IsNotExist(err) {
+		return token, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	token = rand.Text()
+	_, err = fmt.Fprintln(f, token)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	log.Printf("Wrote a new control token to %s", path)
+	return token, nil
+}
+
+func readControlToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("no token in %s", path)
+	}
+	return token, nil
+}
+
+func listenControl(addr string) (net.Listener, error) {
+	if controlNetwork(addr) == "tcp" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		// Anyone who can connect can run commands, so stay on loopback
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("only loopback addresses are allowed")
+		}
+		return net.Listen("tcp", addr)
+	}
+
+	// A socket file left by a server that died can be replaced, one that
+	// still answers belongs to a running server
+	if _, err := os.Stat(addr); err == nil {
+		if c, err := net.DialTimeout("unix", addr, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("already in use by another server")
+		}
+		os.Remove(addr)
+	}
+
+	// The socket is made in a directory only we can enter and moved to
+	// addr once it is private, so nobody can connect in between
+	dir, err := os.MkdirTemp(filepath.Dir(addr), ".gofrpserver-control")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0600); err == nil {
+		err = os.Rename(tmp, addr)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, path: addr}, nil
+}
+
+// unixListener removes the socket file from where it was moved on Close
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+func (cs *controlServer) close() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.listener != nil {
+		cs.listener.Close()
+		cs.listener = nil
+	}
+}
+
+func (cs *controlServer) serve(l net.Listener, token string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go handleControl(conn, token)
+	}
+}
+
+// handleControl runs one exec request, if it has token when one is needed
+func handleControl(conn net.Conn, token string) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := reader.ReadString('\n')
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+
+	var writeMu sync.Mutex
+	reply := func(kind, text string) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		fmt.Fprintf(conn, "%s %s\n", kind, text)
+	}
+
+	var req execRequest
+	if err := json.Unmarshal([]byte(line), &req); err != nil || strings.TrimSpace(req.Command) == "" {
+		reply("ERR", "malformed request")
+		return
+	}
+	if token != "" && subtle.ConstantTimeCompare([]byte(req.Token), []byte(token)) != 1 {
+		log.Printf("Refused control request from %s: wrong token", conn.RemoteAddr())
+		reply("ERR", "wrong control token")
+		return
+	}
+
+	s := sessions.find(req.Client)
+	if req.DryRun {
+		for _, line := range dryRun(req.Command, s) {
+			reply("OUT", line)
+		}
+		reply("EXIT", "0")
+		return
+	}
+	if s == nil {
+		reply("ERR", fmt.Sprintf("no such client: %s", describeClient(req.Client)))
+		return
+	}
+	entry := AuditEntry{Operator: consoleOperator(), Source: "exec", Action: "command", Command: req.Command}.withSession(s)
+	if !cfg().commandAllowed(s, req.Command) {
+		entry.Status = "denied"
+		audit.record(entry)
+		reply("ERR", fmt.Sprintf("command %q is not allowed for client %s by policy", commandVerb(req.Command), s))
+		return
+	}
+	if err := s.supports(req.Command); err != nil {
+		reply("ERR", err.Error())
+		return
+	}
+	if p := cfg().dangerousMatch(req.Command); p != "" && !req.Force {
+		reply("ERR", fmt.Sprintf("%q matches the dangerous pattern %s, add --force to send it", req.Command, p))
+		return
+	}
+
+	// entryMu guards entry, which the response reader fills in
+	var entryMu sync.Mutex
+	sink := newResponseSink(func(line string) {
+		entryMu.Lock()
+		entry.Bytes += int64(len(line)) + 1
+		entryMu.Unlock()
+		reply("OUT", line)
+	})
+	sink.file = func(path string) {
+		f := fileDigest(path)
+		entryMu.Lock()
+		entry.Bytes += f.Size
+		entry.Files = append(entry.Files, f)
+		entryMu.Unlock()
+	}
+
+	// The caller hanging up cancels the wait
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, reader)
+		close(gone)
+	}()
+
+	s.transcript.command("exec", consoleOperator(), req.Command)
+	log.Printf("Command sent to %s via control socket: %s", s, req.Command)
+	err = s.run(req.Command, sink, gone)
+	entryMu.Lock()
+	defer entryMu.Unlock()
+	switch err {
+	case nil:
+		// Clients that report no exit status for a file they could not
+		// send explain why in the output
+		if verb := commandVerb(req.Command); !sink.exited && len(entry.Files) == 0 && (verb == "send" || verb == "screenshot") {
+			sink.status = 1
+		}
+		reply("EXIT", strconv.Itoa(sink.status))
+		entry.Status, entry.ExitCode = "done", &sink.status
+	case errCanceled:
+		entry.Status, entry.Error = "failed", "caller hung up"
+	default:
+		reply("ERR", fmt.Sprintf("%s: %v", s, err))
+		entry.Status, entry.Error = "failed", err.Error()
+	}
+	audit.record(entry)
+}
+
+// runExec implements "gofrpserver exec": send one command to a client of
+// the running server and print its output. The process exits with the
+// remote exit code, or 255 if the command could not be run.
+func runExec(args []string) {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	client := fs.String("client", "", "Session id, address, client name or client id (default: the active session)")
+	addr := fs.String("control", *controlAddr, "Control socket of the running server")
+	tokenPath := fs.String("control-token", *controlTokenPath, "File with the token of a TCP control socket")
+	timeout := fs.Duration("timeout", 0, "Give up after this long (0 waits forever)")
+	force := fs.Bool("force", false, "Send the command even if it matches a dangerous pattern")
+	dry := fs.Bool("dry-run", false, "Show which client the command would go to without sending it")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s exec [--client ID] [--control ADDR] [--control-token FILE] [--timeout D] [--force] [--dry-run] -- <command>\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Example: gofrpserver exec --client office-pc -- cmd dir d:\\test")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	command := strings.Join(fs.Args(), " ")
+	if command == "" {
+		fs.Usage()
+		os.Exit(255)
+	}
+
+	var token string
+	if controlNetwork(*addr) == "tcp" {
+		var err error
+		if *tokenPath == "" {
+			err = fmt.Errorf("a TCP control socket needs --control-token")
+		} else {
+			token, err = readControlToken(*tokenPath)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read the control token: %v\n", err)
+			os.Exit(255)
+		}
+	}
+
+	conn, err := net.DialTimeout(controlNetwork(*addr), *addr, 5*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to the server's control socket: %v\n", err)
+		os.Exit(255)
+	}
+	defer conn.Close()
+	if *timeout > 0 {
+		conn.SetDeadline(time.Now().Add(*timeout))
+	}
+
+	req, _ := json.Marshal(execRequest{Client: *client, Command: command, Token: token, Force: *force, DryRun: *dry})
+	if _, err := conn.Write(append(req, '\n')); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to send command: %v\n", err)
+		os.Exit(255)
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				fmt.Fprintf(os.Stderr, "Timed out after %v\n", *timeout)
+			} else {
+				fmt.Fprintf(os.Stderr, "Connection to the server lost: %v\n", err)
+			}
+			os.Exit(255)
+		}
+		kind, text, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		switch kind {
+		case "OUT":
+			fmt.Println(text)
+		case "EXIT":
+			code, _ := strconv.Atoi(text)
+			os.Exit(code)
+		case "ERR":
+			fmt.Fprintf(os.Stderr, "Error: %s\n", text)
+			os.Exit(255)
+		}
+	}
+}
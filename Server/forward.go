@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"gofrpprotocol"
+	"gofrpserver/network"
+)
+
+// forwardTimeout is how long a client gets to open the data connection
+const forwardTimeout = 15 * time.Second
+
+var errForwardExists = errors.New("forward already exists")
+
+// forwardManager exposes client-side addresses on server ports. For each
+// connection accepted on a forward's port the client is asked, with a
+// NEW_CONNECTION line, to dial the target and open a data connection back
+// to the server, which is then joined with the accepted one. The data
+// connection brings the random ID of the request, and the auth key if the
+// client has "forward-auth".
+type forwardManager struct {
+	mu      sync.Mutex
+	active  map[string]*forwardListener
+	pending map[int64]*pendingForward
+}
+
+// pendingForward waits for the data connection of a forwarded connection
+type pendingForward struct {
+	data chan net.Conn
+	// authenticated is set for clients that send their auth key on data
+	// connections; a data connection without it is refused
+	authenticated bool
+}
+
+type forwardListener struct {
+	rule       ForwardRule
+	listener   net.Listener
+	fromConfig bool
+}
+
+var forwards = &forwardManager{
+	active:  make(map[string]*forwardListener),
+	pending: make(map[int64]*pendingForward),
+}
+
+// apply replaces the forwards that came from the configuration file with
+// rules. Forwards added on the console are kept.
+func (fm *forwardManager) apply(rules []ForwardRule) {
+	wanted := make(map[string]ForwardRule)
+	for _, r := range rules {
+		wanted[r.Name] = r
+	}
+
+	fm.mu.Lock()
+	for name, fl := range fm.active {
+		if r, ok := wanted[name]; fl.fromConfig && (!ok || r != fl.rule) {
+			fl.listener.Close()
+			delete(fm.active, name)
+			log.Printf("Forward %s stopped", name)
+		}
+	}
+	fm.mu.Unlock()
+
+	for _, r := range rules {
+		if err := fm.add(r, true); err != nil && !errors.Is(err, errForwardExists) {
+			log.Printf("Failed to start forward %s: %v", r.Name, err)
+		}
+	}
+}
+
+func (fm *forwardManager) add(rule ForwardRule, fromConfig bool) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	if _, ok := fm.active[rule.Name]; ok {
+		return fmt.Errorf("%w: %s", errForwardExists, rule.Name)
+	}
+	l, err := net.Listen("tcp", rule.Listen)
+	if err != nil {
+		return err
+	}
+
+	fl := &forwardListener{rule: rule, listener: l, fromConfig: fromConfig}
+	fm.active[rule.Name] = fl
+	go fm.serve(fl)
+	log.Printf("Forward %s started: %s -> %s on client %s", rule.Name, rule.Listen, rule.Target, describeClient(rule.Client))
+	return nil
+}
+
+func (fm *forwardManager) remove(name string) bool {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	fl, ok := fm.active[name]
+	if !ok {
+		return false
+	}
+	fl.listener.Close()
+	delete(fm.active, name)
+	return true
+}
+
+func (fm *forwardManager) list() []ForwardRule {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	rules := make([]ForwardRule, 0, len(fm.active))
+	for _, fl := range fm.active {
+		rules = append(rules, fl.rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
+
+func (fm *forwardManager) serve(fl *forwardListener) {
+	for {
+		conn, err := fl.listener.Accept()
+		if err != nil {
+			return
+		}
+		go fm.handle(fl.rule, conn)
+	}
+}
+
+func (fm *forwardManager) handle(rule ForwardRule, conn net.Conn) {
+	s := sessions.find(rule.Client)
+	if s == nil {
+		log.Printf("Forward %s: client %s is not connected", rule.Name, describeClient(rule.Client))
+		conn.Close()
+		return
+	}
+	if !cfg().commandAllowed(s, "forward") {
+		log.Printf("Forward %s: forwarding is not allowed for client %s", rule.Name, s)
+		conn.Close()
+		return
+	}
+	if err := s.supports("forward"); err != nil {
+		log.Printf("Forward %s: %v", rule.Name, err)
+		conn.Close()
+		return
+	}
+
+	fm.mu.Lock()
+	id := fm.newID()
+	p := &pendingForward{data: make(chan net.Conn, 1), authenticated: slices.Contains(s.capabilities(), "forward-auth")}
+	fm.pending[id] = p
+	fm.mu.Unlock()
+
+	defer func() {
+		fm.mu.Lock()
+		delete(fm.pending, id)
+		fm.mu.Unlock()
+	}()
+
+	if err := s.send(protocol.NewConnection{ID: id, Target: rule.Target}); err != nil {
+		log.Printf("Forward %s: failed to notify client %s: %v", rule.Name, s, err)
+		conn.Close()
+		return
+	}
+
+	select {
+	case data := <-p.data:
+		if data == nil {
+			conn.Close()
+			return
+		}
+		network.Join2Conn(conn, s.limits[protocol.ForwardLimit].Conn(data))
+	case <-time.After(forwardTimeout):
+		log.Printf("Forward %s: client %s did not open a data connection in time", rule.Name, s)
+		conn.Close()
+	}
+}
+
+// newID returns an unused ID for a forwarded connection. IDs are random, so
+// that nobody can guess the one a data connection has to bring. fm.mu must
+// be held.
+func (fm *forwardManager) newID() int64 {
+	for {
+		var b [8]byte
+		rand.Read(b[:])
+		id := int64(binary.BigEndian.Uint64(b[:]) >> 1)
+		if _, ok := fm.pending[id]; id != 0 && !ok {
+			return id
+		}
+	}
+}
+
+// attach hands a data connection opened by a client to the waiting
+// forward. authenticated tells whether it came with the auth key, which
+// clients with "forward-auth" always send.
+func (fm *forwardManager) attach(id int64, conn net.Conn, authenticated bool) {
+	fm.mu.Lock()
+	p, ok := fm.pending[id]
+	ok = ok && (authenticated || !p.authenticated)
+	if ok {
+		delete(fm.pending, id)
+	}
+	fm.mu.Unlock()
+
+	if !ok {
+		log.Printf("Unexpected data connection from %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	p.data <- conn
+}
+
+// fail reports that the client could not reach the forward's target
+func (fm *forwardManager) fail(m protocol.NewConnFailed) {
+	log.Printf("Forward connection %d failed on client: %s", m.ID, m.Reason)
+
+	fm.mu.Lock()
+	p, ok := fm.pending[m.ID]
+	delete(fm.pending, m.ID)
+	fm.mu.Unlock()
+	if ok {
+		p.data <- nil
+	}
+}
+
+func describeClient(selector string) string {
+	if selector == "" {
+		return "(active session)"
+	}
+	return selector
+}
+
+// handleForwardCommand implements the console "forward" command
+func handleForwardCommand(fields []string) {
+	if len(fields) < 2 || fields[1] == "list" {
+		rules := forwards.list()
+		if len(rules) == 0 {
+			fmt.Println("No forwards")
+			return
+		}
+		for _, r := range rules {
+			fmt.Printf("%s\t%s -> %s on client %s\n", r.Name, r.Listen, r.Target, describeClient(r.Client))
+		}
+		return
+	}
+
+	switch fields[1] {
+	case "add":
+		if len(fields) < 4 || len(fields) > 5 {
+			fmt.Println("Usage: forward add <listen addr> <target addr> [client]")
+			return
+		}
+		rule := ForwardRule{Name: fields[2], Listen: fields[2], Target: fields[3]}
+		if len(fields) == 5 {
+			rule.Client = fields[4]
+		}
+		err := forwards.add(rule, false)
+		if err != nil {
+			fmt.Printf("Failed to add forward: %v\n", err)
+		}
+		audit.record(forwardEntry(consoleOperator(), "console", "forward_add", rule, err))
+	case "remove", "rm":
+		if len(fields) != 3 {
+			fmt.Println("Usage: forward remove <name>")
+			return
+		}
+		if !forwards.remove(fields[2]) {
+			fmt.Printf("No such forward: %s\n", fields[2])
+			return
+		}
+		audit.record(forwardEntry(consoleOperator(), "console", "forward_remove", ForwardRule{Name: fields[2]}, nil))
+		fmt.Printf("Forward %s removed\n", fields[2])
+	default:
+		fmt.Println("Usage: forward [list] | forward add <listen addr> <target addr> [client] | forward remove <name>")
+	}
+}
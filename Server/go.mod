@@ -2,6 +2,23 @@ module gofrpserver
 
 go 1.24.7
 
-require github.com/chzyer/readline v1.5.1
+require (
+	github.com/chzyer/readline v1.5.1
+	github.com/coder/websocket v1.8.13
+	github.com/quic-go/quic-go v0.54.1
+	gofrpprotocol v0.0.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
-require golang.org/x/sys v0.35.0 // indirect
+require (
+	github.com/klauspost/compress v1.18.0 // indirect
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)
+
+replace gofrpprotocol => ../protocol
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"gofrpprotocol"
+)
+
+var (
+	heartbeatInterval = flag.Duration("heartbeat-interval", 15*time.Second, "Interval between keep-alive pings to clients (0 disables)")
+	heartbeatMisses   = flag.Int("heartbeat-misses", 3, "Missed keep-alive intervals before a client is considered dead")
+)
+
+// touch records that something was received from the client
+func (s *Session) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// heartbeat pings the client and closes the session once it has been
+// silent for more than heartbeatMisses intervals. Any line from the client
+// counts as a sign of life, not only KEEP_ALIVE_ACK.
+func heartbeat(s *Session) {
+	interval := cfg().Heartbeat.Interval
+	if interval <= 0 {
+		return
+	}
+	deadline := interval * time.Duration(cfg().Heartbeat.Misses)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var pinging atomic.Bool
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			silent := time.Since(time.Unix(0, s.lastSeen.Load()))
+			if silent > deadline {
+				log.Printf("Client %s silent for %v, marking connection dead", s, silent.Round(time.Second))
+				s.close()
+				return
+			}
+
+			// A write to a half-open connection can block, so never let it
+			// hold up the dead-connection check above
+			if pinging.CompareAndSwap(false, true) {
+				go func() {
+					defer pinging.Store(false)
+					if err := s.send(protocol.KeepAlive{}); err != nil {
+						log.Printf("Failed to send keep-alive to %s: %v", s, err)
+					}
+				}()
+			}
+		}
+	}
+}
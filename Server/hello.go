@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"runtime"
+	"slices"
+
+	"gofrpprotocol"
+)
+
+// version is reported to clients; release builds set it with
+//
+//	go build -ldflags "-X main.version=1.2.0"
+var version = "0.01"
+
+var compressionName = flag.String("compression", protocol.Zstd, "Compression asked of clients for output and file data: zstd, gzip or none")
+
+// minClientProtocol is the oldest protocol clients may speak. Clients
+// that came before the hello speak protocol 1.
+const minClientProtocol = 1
+
+// serverCapabilities are the optional things the server does for clients
+var serverCapabilities = []string{"heartbeat", "metrics", "exit-status", "forward-auth"}
+
+// legacyCapabilities are what clients without a hello can be sent: the
+// commands every version of the client had
+var legacyCapabilities = []string{"cmd", "ps", "send", "screenshot"}
+
+// checkProtocol tells whether the server and a client can work together
+func checkProtocol(info protocol.ClientInfo) error {
+	speaks := max(info.Protocol, 1)
+	if speaks < minClientProtocol {
+		return fmt.Errorf("client version %s speaks protocol %d, this server (version %s) needs %d or later: update the client",
+			describeVersion(info.Version), speaks, version, minClientProtocol)
+	}
+	if info.MinProtocol > protocol.Version {
+		return fmt.Errorf("client version %s needs protocol %d or later, this server (version %s) speaks %d: update the server",
+			describeVersion(info.Version), info.MinProtocol, version, protocol.Version)
+	}
+	return nil
+}
+
+// negotiateCompression picks the compression for a client from the
+// configuration and what it can read. Clients before
+// protocol.FramingVersion get nil and frames as they always were.
+func negotiateCompression(info protocol.ClientInfo) protocol.Compression {
+	if info.Protocol < protocol.FramingVersion {
+		return nil
+	}
+	return protocol.Negotiate(cfg().Compression.kinds(), info.Compression)
+}
+
+// sendHello answers a client that sent a hello, with refused as the
+// reason if it is not accepted
+func sendHello(conn net.Conn, compression protocol.Compression, refused error) error {
+	hello := protocol.Hello{
+		Protocol:     protocol.Version,
+		MinProtocol:  minClientProtocol,
+		Version:      version,
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		Capabilities: serverCapabilities,
+		Compression:  compression,
+	}
+	if refused != nil {
+		hello.Error = refused.Error()
+	}
+	return protocol.Write(conn, hello)
+}
+
+// framed sends the messages written on conn, the session's connection or
+// one of its streams, in the framing agreed with the client
+func (s *Session) framed(conn net.Conn) net.Conn {
+	if s.compression == nil {
+		return conn
+	}
+	return protocol.NewConn(conn, s.compression)
+}
+
+// reader reads what the client sends on conn, the session's connection or
+// one of its streams, in the framing agreed with it
+func (s *Session) reader(conn net.Conn) *protocol.Reader {
+	r := protocol.NewReader(conn)
+	r.SetFramed(s.compression != nil)
+	return r
+}
+
+// capabilities are what the client said it can do
+func (s *Session) capabilities() []string {
+	if s.info.Protocol == 0 {
+		return legacyCapabilities
+	}
+	return s.info.Capabilities
+}
+
+// supports checks that the client can handle command, so that a command
+// it does not know is refused here with a clear message instead of by
+// the client
+func (s *Session) supports(command string) error {
+	verb := commandVerb(command)
+	if verb == "help" || slices.Contains(s.capabilities(), verb) {
+		return nil
+	}
+	return fmt.Errorf("%s does not support %q (client version %s), update it", s, verb, describeVersion(s.info.Version))
+}
+
+func describeVersion(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	return v
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"gofrpprotocol"
+)
+
+var (
+	transferLimit = flag.String("limit", "", "Rate limit for commands, uploads and updates sent to each client, e.g. 500KB/s (empty for none)")
+	forwardLimit  = flag.String("forward-limit", "", "Rate limit for forward traffic sent to each client, e.g. 1MB/s (empty for none)")
+)
+
+// LimitConfig is the rate each client gets, such as 500KB/s, until the
+// limit command changes it. Empty means no limit.
+type LimitConfig struct {
+	Transfer string `yaml:"transfer"` // commands, uploads and updates sent to a client
+	Forward  string `yaml:"forward"`  // forward traffic sent to a client
+
+	rates map[string]int64
+}
+
+func (c *LimitConfig) parse() error {
+	c.rates = map[string]int64{}
+	for kind, text := range map[string]string{protocol.TransferLimit: c.Transfer, protocol.ForwardLimit: c.Forward} {
+		rate, err := protocol.ParseRate(text)
+		if err != nil {
+			return fmt.Errorf("limits %s: %v", kind, err)
+		}
+		c.rates[kind] = rate
+	}
+	return nil
+}
+
+// limitKinds are the kinds of traffic the limit command sets, in the
+// order it lists them
+var limitKinds = []string{protocol.TransferLimit, protocol.ForwardLimit}
+
+// clientLimits pace what the server sends a client, by kind of traffic.
+// They are kept with the client's ID, so a limit set on the console holds
+// when it reconnects.
+type clientLimits map[string]*clientLimit
+
+type clientLimit struct {
+	*protocol.Limiter
+	set atomic.Bool // set with the limit command, which a reload leaves alone
+}
+
+func newClientLimits(c LimitConfig) clientLimits {
+	l := clientLimits{}
+	for _, kind := range limitKinds {
+		l[kind] = &clientLimit{Limiter: protocol.NewLimiter(c.rates[kind])}
+	}
+	return l
+}
+
+// reset applies c to the kinds not set with the limit command
+func (l clientLimits) reset(c LimitConfig) {
+	for kind, limit := range l {
+		if !limit.set.Load() {
+			limit.SetRate(c.rates[kind])
+		}
+	}
+}
+
+// applyLimits gives every client the configured limits, except where they
+// were set with the limit command
+func (r *sessionRegistry) applyLimits(c LimitConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		s.limits.reset(c)
+	}
+	for _, k := range r.known {
+		k.limits.reset(c)
+	}
+}
+
+// setLimit changes the rate of kind for s, on the server and, if it can
+// pace what it sends, on the client
+func (s *Session) setLimit(kind string, rate int64) error {
+	limit := s.limits[kind]
+	limit.SetRate(rate)
+	limit.set.Store(true)
+	if !slices.Contains(s.capabilities(), "limit") {
+		return nil
+	}
+	return s.send(protocol.Limit{Kind: kind, Rate: rate})
+}
+
+// restoreLimits sends a client that reconnects the limits set for it with
+// the limit command
+func restoreLimits(s *Session) {
+	if !slices.Contains(s.capabilities(), "limit") {
+		return
+	}
+	for _, kind := range limitKinds {
+		if limit := s.limits[kind]; limit.set.Load() {
+			if err := s.send(protocol.Limit{Kind: kind, Rate: limit.Rate()}); err != nil {
+				log.Printf("Failed to send %s limit to %s: %v", kind, s, err)
+			}
+		}
+	}
+}
+
+// handleLimitCommand implements the console "limit" command: without
+// arguments it lists the limits of every client, otherwise it sets one
+// or both limits of a client
+func handleLimitCommand(fields []string) {
+	if len(fields) == 1 {
+		list := sessions.list()
+		if len(list) == 0 {
+			fmt.Println("No clients connected")
+		}
+		for _, s := range list {
+			fmt.Printf("%d\t%s", s.ID, s.name())
+			for _, kind := range limitKinds {
+				fmt.Printf("\t%s %s", kind, s.limits[kind])
+			}
+			fmt.Println()
+		}
+		return
+	}
+
+	if len(fields) != 3 && len(fields) != 4 {
+		fmt.Println("Usage: limit [<session id | client name | client id> [transfer|forward] <rate>]")
+		return
+	}
+	s := sessions.find(fields[1])
+	if s == nil {
+		fmt.Printf("No such session: %s\n", fields[1])
+		return
+	}
+	kinds := limitKinds
+	if len(fields) == 4 {
+		if !slices.Contains(limitKinds, fields[2]) {
+			fmt.Printf("Unknown kind of traffic %q, want transfer or forward\n", fields[2])
+			return
+		}
+		kinds = []string{fields[2]}
+	}
+	rate, err := protocol.ParseRate(fields[len(fields)-1])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	entry := AuditEntry{Operator: consoleOperator(), Source: "console", Action: "limit", Command: strings.Join(fields, " "), Status: "done"}.withSession(s)
+	for _, kind := range kinds {
+		if err := s.setLimit(kind, rate); err != nil {
+			fmt.Printf("Failed to send the %s limit to %s: %v\n", kind, s, err)
+			entry.Status, entry.Error = "failed", err.Error()
+		}
+	}
+	audit.record(entry)
+
+	fmt.Printf("Limited %s traffic of %s to %s\n", strings.Join(kinds, " and "), s, protocol.FormatRate(rate))
+	if !slices.Contains(s.capabilities(), "limit") {
+		fmt.Printf("Client version %s cannot limit what it sends, only what the server sends it is limited\n", describeVersion(s.info.Version))
+	}
+}
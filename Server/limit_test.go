@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"gofrpprotocol"
+)
+
+func TestClientLimitsReset(t *testing.T) {
+	config := func(transfer, forward string) LimitConfig {
+		c := LimitConfig{Transfer: transfer, Forward: forward}
+		if err := c.parse(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	l := newClientLimits(config("500KB/s", ""))
+
+	// A reload changes what the limit command left alone
+	l[protocol.ForwardLimit].SetRate(1 << 20)
+	l[protocol.ForwardLimit].set.Store(true)
+	for _, c := range []struct {
+		transfer, forward string
+		want              map[string]int64
+	}{
+		{"500KB/s", "", map[string]int64{protocol.TransferLimit: 500 << 10, protocol.ForwardLimit: 1 << 20}},
+		{"2MB/s", "100KB/s", map[string]int64{protocol.TransferLimit: 2 << 20, protocol.ForwardLimit: 1 << 20}},
+		{"off", "off", map[string]int64{protocol.TransferLimit: 0, protocol.ForwardLimit: 1 << 20}},
+	} {
+		l.reset(config(c.transfer, c.forward))
+		for kind, want := range c.want {
+			if got := l[kind].Rate(); got != want {
+				t.Errorf("transfer %q, forward %q: %s rate %d, want %d", c.transfer, c.forward, kind, got, want)
+			}
+		}
+	}
+
+	if err := (&LimitConfig{Transfer: "fast"}).parse(); err == nil {
+		t.Error("limits with a rate of fast parse")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"gofrpserver/network"
+)
+
+// listenerSet runs one accept loop per configured listen address
+type listenerSet struct {
+	mu     sync.Mutex
+	active map[ListenConfig]net.Listener
+	tls    TLSConfig
+	proxy  bool
+}
+
+var listeners = &listenerSet{active: make(map[ListenConfig]net.Listener)}
+
+// apply starts listeners that are new in c and stops the ones that are
+// gone. New listeners are started before any old one is stopped, and a
+// failure leaves the running ones as they were. Sessions accepted by a
+// stopped listener stay connected.
+func (ls *listenerSet) apply(c *Config) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if len(c.Listen) == 0 {
+		return fmt.Errorf("no listen address configured")
+	}
+
+	// Certificate or proxy changes need every listener to be restarted
+	restart := c.TLS != ls.tls || c.TrustProxy != ls.proxy
+
+	wanted := make(map[ListenConfig]bool)
+	for _, lc := range c.Listen {
+		wanted[lc] = true
+	}
+	// Listeners that are replaced or gone, by the address they hold
+	leaving := make(map[string][]ListenConfig)
+	for lc := range ls.active {
+		if restart || !wanted[lc] {
+			leaving[lc.Address] = append(leaving[lc.Address], lc)
+		}
+	}
+
+	// Addresses that are still held by a leaving listener are rebound
+	// once everything else is up
+	started := make(map[ListenConfig]net.Listener)
+	var rebind []ListenConfig
+	for lc := range wanted {
+		if _, ok := ls.active[lc]; ok && !restart {
+			continue
+		}
+		if len(leaving[lc.Address]) > 0 {
+			rebind = append(rebind, lc)
+			continue
+		}
+		l, err := listen(lc, c.TLS, c.TrustProxy)
+		if err != nil {
+			closeListeners(started)
+			return fmt.Errorf("listen on %s (%s): %v", lc.Address, lc.Transport, err)
+		}
+		started[lc] = l
+	}
+
+	closed := make(map[ListenConfig]bool)
+	for _, lc := range rebind {
+		for _, old := range leaving[lc.Address] {
+			if !closed[old] {
+				ls.active[old].Close()
+				closed[old] = true
+			}
+		}
+		l, err := listen(lc, c.TLS, c.TrustProxy)
+		if err != nil {
+			closeListeners(started)
+			ls.restore(closed)
+			return fmt.Errorf("listen on %s (%s): %v", lc.Address, lc.Transport, err)
+		}
+		started[lc] = l
+	}
+
+	for _, lcs := range leaving {
+		for _, lc := range lcs {
+			if !closed[lc] {
+				ls.active[lc].Close()
+			}
+			if !wanted[lc] {
+				log.Printf("Stopped listening on %s (%s)", lc.Address, lc.Transport)
+			}
+			delete(ls.active, lc)
+		}
+	}
+	ls.tls, ls.proxy = c.TLS, c.TrustProxy
+	for lc, l := range started {
+		log.Printf("Server started, listening on %s (%s)", lc.Address, lc.Transport)
+		ls.active[lc] = l
+		go acceptConnections(l)
+	}
+	return nil
+}
+
+// restore listens again on the addresses of the closed listeners, as they
+// were configured before
+func (ls *listenerSet) restore(closed map[ListenConfig]bool) {
+	for lc := range closed {
+		l, err := listen(lc, ls.tls, ls.proxy)
+		if err != nil {
+			log.Printf("Failed to listen on %s (%s) again: %v", lc.Address, lc.Transport, err)
+			delete(ls.active, lc)
+			continue
+		}
+		ls.active[lc] = l
+		go acceptConnections(l)
+	}
+}
+
+func listen(lc ListenConfig, tlsConf TLSConfig, trustProxy bool) (net.Listener, error) {
+	transport, err := network.NewTransport(lc.Transport, network.TransportOptions{
+		Path:       lc.WSPath,
+		CertFile:   tlsConf.Cert,
+		KeyFile:    tlsConf.Key,
+		TrustProxy: trustProxy,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transport.Listen(lc.Address)
+}
+
+func closeListeners(started map[ListenConfig]net.Listener) {
+	for _, l := range started {
+		l.Close()
+	}
+}
+
+func (ls *listenerSet) closeAll() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for lc, l := range ls.active {
+		l.Close()
+		delete(ls.active, lc)
+	}
+}
+
+func acceptConnections(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		go handleConnection(conn)
+	}
+}
@@ -15,7 +15,7 @@ import (
 	"archive/zip"
 	"bufio"
 	"bytes"
-	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"image/png"
@@ -24,11 +24,12 @@ import (
 	"net"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"gofrpprotocol"
+	"gofrpserver/network"
+
 	"github.com/chzyer/readline"
 )
 
@@ -38,115 +39,406 @@ const (
 
 var (
 	serverPort = flag.String("port", DefaultServerPort, "Server port")
-	exitChan   = make(chan struct{})
+
+	transportName = flag.String("transport", "tcp", "Transport clients connect with: tcp, ws, wss or quic (quic also accepts tcp on the same port)")
+	wsPath        = flag.String("ws-path", "/gofrp", "HTTP path for WebSocket upgrades (ws/wss transports)")
+	tlsCert       = flag.String("tls-cert", "", "TLS certificate file (wss and quic transports)")
+	tlsKey        = flag.String("tls-key", "", "TLS private key file (wss and quic transports)")
+	trustProxy    = flag.Bool("trust-proxy", false, "Take client addresses from X-Forwarded-For when behind a reverse proxy")
+	noConsole     = flag.Bool("no-console", false, "Do not read console commands from stdin, for servers run by a service manager")
 )
 
 func main() {
+	// One-shot mode for scripts, talks to an already running server
+	if len(os.Args) > 1 && os.Args[1] == "exec" {
+		runExec(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		runAudit(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		runSign(os.Args[2:])
+		return
+	}
+
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-port PORT]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-port PORT] [-config FILE]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s exec [--client ID] -- <command>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s audit verify <file> [file...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s sign [-generate] [-key FILE] [-version VERSION] <client binary>...\n", os.Args[0])
 		fmt.Println("Example: gofrpserver.exe -port 2006")
 		fmt.Println("         gofrpserver.exe")
+		fmt.Println("         gofrpserver.exe -transport ws -ws-path /gofrp -trust-proxy")
+		fmt.Println("         gofrpserver.exe -config gofrpserver.yaml")
+		fmt.Println("         gofrpserver.exe exec --client office-pc -- cmd dir d:\\test")
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
 
 	log.Println("Starting server")
-	listener, err := net.Listen("tcp", ":"+*serverPort)
+	config, err := loadConfig()
 	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if err := applyConfig(config); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
+	go watchReloadSignal()
+	go watchShutdownSignals()
 
-	log.Printf("Server started, listening on port %s", *serverPort)
+	// One console for all sessions
+	commandChan := make(chan string, 10)
+	if !*noConsole {
+		go readCommandsFromStdin(commandChan)
+	}
+	go dispatchCommands(commandChan)
 
 	// Handle graceful shutdown
-	go func() {
-		<-exitChan
-		log.Println("Shutting down server...")
-		listener.Close()
-		os.Exit(0)
-	}()
+	<-serverCtx.Done()
+	os.Exit(gracefulShutdown())
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			// Check if we're shutting down
-			select {
-			case <-exitChan:
-				return
-			default:
-				log.Printf("Failed to accept connection: %v", err)
-				continue
-			}
+// handleConnection reads the first line of a new connection to tell client
+// sessions (AUTH:<key>) apart from forward data connections
+// (NEW_CONNECTION:<id>, after AUTH:<key> for clients with "forward-auth").
+func handleConnection(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	first, err := reader.ReadString('\n')
+	conn.SetReadDeadline(time.Time{})
+	first = strings.TrimSpace(first)
+
+	if err != nil && first == "" {
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			conn.Close()
+			return
+		}
+		// Older clients say nothing until asked
+	}
+
+	msg, err := protocol.Parse(first)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if m, ok := msg.(protocol.NewConnection); ok {
+		forwards.attach(m.ID, &network.BufferedConn{Conn: conn, Reader: reader}, false)
+		return
+	}
+
+	auth, isAuth := msg.(protocol.Auth)
+	if !cfg().authorized(auth.Key) || (!isAuth && len(cfg().Auth.Keys) > 0) {
+		log.Printf("Rejected connection from %s: authentication failed", conn.RemoteAddr())
+		protocol.Write(conn, protocol.AuthFailed{})
+		conn.Close()
+		return
+	}
+
+	var info protocol.ClientInfo
+	if isAuth {
+		switch m := readClientIdentity(conn, reader).(type) {
+		case protocol.NewConnection:
+			forwards.attach(m.ID, &network.BufferedConn{Conn: conn, Reader: reader}, true)
+			return
+		case protocol.ClientInfo:
+			info = m
+		}
+	}
+	refused := checkProtocol(info)
+	compression := negotiateCompression(info)
+	if info.Protocol > 0 {
+		// Clients before the hello would take the answer for a command
+		if err := sendHello(conn, compression, refused); err != nil && refused == nil {
+			conn.Close()
+			return
 		}
+	}
+	if refused != nil {
+		log.Printf("Rejected connection from %s: %v", conn.RemoteAddr(), refused)
+		conn.Close()
+		return
+	}
+
+	s := sessions.add(conn, info, compression)
+	log.Printf("New connection from: %s (session %s)", conn.RemoteAddr(), s)
+	reportUpdate(s)
+	restoreLimits(s)
+	handleClient(s, &network.BufferedConn{Conn: conn, Reader: reader})
+}
+
+// readClientIdentity reads the line clients send right after AUTH: the
+// CLIENT_INFO of a session, or the NEW_CONNECTION of a forward's data
+// connection. Clients that send neither are left unidentified, with nil.
+func readClientIdentity(conn net.Conn, reader *bufio.Reader) protocol.Message {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := reader.Peek(1)
+	sent := err == nil && (protocol.Peek(reader, protocol.ClientInfo{}) || protocol.Peek(reader, protocol.NewConnection{}))
+	conn.SetReadDeadline(time.Time{})
+	if !sent {
+		return nil
+	}
 
-		log.Printf("New connection from: %s", conn.RemoteAddr())
-		go handleClient(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil
+	}
+	msg, err := protocol.Parse(line)
+	if info, ok := msg.(protocol.ClientInfo); ok && err == nil && len(info.ID) > 64 {
+		err = fmt.Errorf("client id too long")
+	}
+	if err != nil {
+		log.Printf("Invalid client identity from %s: %v", conn.RemoteAddr(), err)
+		return nil
 	}
+	return msg
 }
 
-func handleClient(conn net.Conn) {
-	defer conn.Close()
+func handleClient(s *Session, conn net.Conn) {
+	defer sessions.remove(s)
+	defer s.close()
+	defer transfers.dropSession(s)
 
-	// Channels for communication between goroutines
-	commandChan := make(chan string, 10)
-	shutdownChan := make(chan struct{})
-	var once sync.Once
+	go heartbeat(s)
+	readClientResponse(s, conn, nil)
+	log.Printf("Client %s disconnected", s)
+}
 
-	// Start a goroutine to read client responses
-	go readClientResponse(conn, shutdownChan)
+// dispatchCommands handles console-only commands and sends everything
+// else to the active session.
+func dispatchCommands(commandChan <-chan string) {
+	// pending is a dangerous command waiting for the operator's "yes"
+	var pending string
 
-	// Start a goroutine to read commands from stdin with readline support
-	go readCommandsFromStdin(commandChan)
+	for command := range commandChan {
+		if command == "" {
+			continue
+		}
 
-	// Main loop to send commands to client
-	for {
-		select {
-		case command := <-commandChan:
-			if command == "" {
+		if pending != "" {
+			confirmed := pending
+			pending = ""
+			if command != "yes" {
+				fmt.Println("Cancelled")
 				continue
 			}
-
-			// Exit command
-			if command == "exit" {
-				log.Println("Exit command received, shutting down server...")
-				// Send exit command to client
-				conn.Write([]byte("exit\n"))
-				// Close shutdown channel safely
-				once.Do(func() {
-					close(shutdownChan)
-				})
-				// Signal server to exit
-				close(exitChan)
-				return
+			command = confirmed
+		} else {
+			if dry, ok := strings.CutPrefix(command, dryRunPrefix); ok {
+				dry = strings.TrimSpace(dry)
+				fmt.Printf("\n--- Dry run: %s ---\n", dry)
+				for _, line := range dryRun(dry, sessions.active()) {
+					fmt.Println(line)
+				}
+				continue
 			}
-
-			// Send command to client
-			_, err := conn.Write([]byte(command + "\n"))
-			if err != nil {
-				log.Printf("Failed to send command: %v", err)
-				once.Do(func() {
-					close(shutdownChan)
-				})
-				return
+			if forced, ok := cutForce(command); ok {
+				command = forced
+			} else if p := cfg().dangerousMatch(command); p != "" {
+				target := "the server and all clients"
+				if s := sessions.active(); s != nil && command != "shutdown" {
+					target = s.String()
+				}
+				fmt.Printf("%q matches the dangerous pattern %s and affects %s.\n", command, p, target)
+				fmt.Println(`Type "yes" to go ahead, anything else cancels.`)
+				pending = command
+				continue
 			}
+		}
 
-			log.Printf("Command sent: %s", command)
-		case <-shutdownChan:
-			log.Println("Client handler shutting down")
+		// Stop the server; gracefulShutdown tells the clients
+		if command == "shutdown" {
+			log.Println("Shutdown command received, shutting down server...")
+			audit.record(AuditEntry{Operator: consoleOperator(), Source: "console", Action: "shutdown"})
+			stopServer(errors.New("shutdown command"))
 			return
 		}
+		if handleConsoleCommand(command) {
+			continue
+		}
+
+		s := sessions.active()
+		if s == nil {
+			fmt.Println("No client connected")
+			continue
+		}
+		entry := AuditEntry{Operator: consoleOperator(), Source: "console", Action: "command", Command: command}.withSession(s)
+		if !cfg().commandAllowed(s, command) {
+			fmt.Printf("Command %q is not allowed for client %s by policy\n", commandVerb(command), s)
+			entry.Status = "denied"
+			audit.record(entry)
+			continue
+		}
+		if err := s.supports(command); err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		// The command waits for an exec that owns the output of the main
+		// connection, the console does not
+		if s.execBusy() {
+			fmt.Printf("\n--- Command queued behind the exec running on %s ---\n", s)
+			go sendConsoleCommand(s, command, entry)
+			continue
+		}
+		sendConsoleCommand(s, command, entry)
 	}
 }
 
+// sendConsoleCommand sends a command typed at the console to s and
+// records it in the audit log
+func sendConsoleCommand(s *Session, command string, entry AuditEntry) {
+	if err := s.sendCommand(command); errors.Is(err, errUploadPaused) {
+		fmt.Println(err)
+		entry.Status, entry.Error = "failed", err.Error()
+		audit.record(entry)
+		return
+	} else if err != nil {
+		log.Printf("Failed to send command to %s: %v", s, err)
+		entry.Status, entry.Error = "failed", err.Error()
+		audit.record(entry)
+		s.close()
+		return
+	}
+
+	// Several console commands can be in flight on one connection, so
+	// their exit status and files are recorded as separate entries when
+	// they come back
+	entry.Status = "sent"
+	audit.record(entry)
+	s.transcript.command("console", consoleOperator(), command)
+	log.Printf("Command sent to %s: %s", s, command)
+}
+
+// consoleCommand is a console command the server answers itself
+type consoleCommand struct {
+	handle func(fields []string)
+	// client is set for commands that send something to a client, which
+	// a dry run describes like the commands sent as they are
+	client bool
+}
+
+// consoleCommands are the commands the server answers itself instead of
+// sending them to the active client, by their first word. It is filled in
+// by init, as reload refers back to it through the control socket's dry
+// runs.
+var consoleCommands map[string]consoleCommand
+
+func init() {
+	consoleCommands = map[string]consoleCommand{
+		"sessions":   {handle: func([]string) { printSessions() }},
+		"use":        {handle: handleUseCommand},
+		"top":        {handle: func([]string) { printTop() }},
+		"disconnect": {handle: handleDisconnectCommand},
+		"update":     {handle: handleUpdateCommand, client: true},
+		"forward":    {handle: handleForwardCommand},
+		"limit":      {handle: handleLimitCommand},
+		"transfers":  {handle: func([]string) { printTransfers() }},
+		"pause":      {handle: handleTransferCommand},
+		"resume":     {handle: handleTransferCommand},
+		"cancel":     {handle: handleTransferCommand},
+		"replay":     {handle: handleReplayCommand},
+		"reload":     {handle: func([]string) { handleReloadCommand() }},
+		"help":       {handle: func([]string) { fmt.Println(consoleHelp) }},
+		"exit": {handle: func([]string) {
+			fmt.Println(`"exit" is ambiguous: use "disconnect" to drop the active client (it reconnects later), "client-quit" to stop the client process, or "shutdown" to stop the server`)
+		}},
+	}
+}
+
+const consoleHelp = `Help:
+Input "cmd dir d:\test" to execute a CMD command
+Input "cmd capture screen" to take current picture and send back, which will be saved to current folder as image
+Input "send d:\test\test.txt" to request client to send a file back
+Input "ps <command>" to execute a PowerShell command
+Input "proc list [--filter name] [--sort cpu|mem]" to list client processes
+Input "proc kill <pid>... [--tree]" to kill client processes (and their children)
+Input "proc info <pid>" to show details of a client process
+Input "ls [path]" to list a directory on the client
+Input "sessions" to list connected clients, "use <id|name>" to switch the active client
+Input "top" to show resource usage of all clients
+Input "forward add <listen addr> <target addr> [client]" to expose a client-side address on the server, "forward" to list, "forward remove <name>" to stop
+Input "limit <id|name> [transfer|forward] <rate>" to limit a client's transfers and forwards, e.g. 500KB/s or off; "limit" to list
+Input "transfers" to list file transfers with their progress, "pause <id>", "resume <id>" or "cancel <id>" to control one
+Input "replay <transcript file> [speed]" to play back a recorded session, "replay stop" or Ctrl-C to stop it
+Input "reload" to re-read the configuration file
+Input "help" to show this help message
+Input "--dry-run <command>" to see which client a command would go to without sending it
+Input "--force <command>" to skip the confirmation of dangerous commands
+Input "disconnect [session]" to drop a client's session, it reconnects later
+Input "client-quit" to make the active client process exit
+Input "update [session]" to send a client the signed binary for its platform, it restarts with it
+Input "shutdown" to stop the server once transfers in progress have finished`
+
+// handleConsoleCommand runs commands that are answered by the server
+// itself. It reports whether the command was handled.
+func handleConsoleCommand(command string) bool {
+	fields := strings.Fields(command)
+	c, ok := consoleCommands[fields[0]]
+	if ok {
+		c.handle(fields)
+	}
+	return ok
+}
+
+// printSessions implements the console "sessions" command
+func printSessions() {
+	list := sessions.list()
+	if len(list) == 0 {
+		fmt.Println("No clients connected")
+		return
+	}
+	active := sessions.activeID()
+	for _, s := range list {
+		mark := " "
+		if s.ID == active {
+			mark = "*"
+		}
+		fmt.Printf("%s %d\t%s\t%s\tconnected %s", mark, s.ID, s.name(), s.addr, s.connectedAt.Format("2006-01-02 15:04:05"))
+		if len(s.info.Tags) > 0 {
+			fmt.Printf("\t[%s]", strings.Join(s.info.Tags, ","))
+		}
+		if s.info.Version != "" {
+			fmt.Printf("\tversion %s", s.info.Version)
+		}
+		fmt.Println()
+	}
+}
+
+// handleUseCommand implements the console "use" command
+func handleUseCommand(fields []string) {
+	if len(fields) != 2 {
+		fmt.Println("Usage: use <session id | client name | client id>")
+		return
+	}
+	target := sessions.find(fields[1])
+	if target == nil || !sessions.setActive(target.ID) {
+		fmt.Printf("No such session: %s\n", fields[1])
+		return
+	}
+	fmt.Printf("Active session is now %s\n", target)
+}
+
+// handleReloadCommand implements the console "reload" command
+func handleReloadCommand() {
+	if *configPath == "" {
+		fmt.Println("No configuration file given with -config")
+		return
+	}
+	audit.record(AuditEntry{Operator: consoleOperator(), Source: "console", Action: "reload"})
+	reloadConfig()
+}
+
 func readCommandsFromStdin(commandChan chan<- string) {
 	// Create readline instance with history support
 	rl, err := readline.NewEx(&readline.Config{
-		Prompt:          "Please enter command (cmd <command> or ps <command>): ",
-		HistoryFile:     "/tmp/gofrp_history",
+		Prompt:          cfg().Console.Prompt,
+		HistoryFile:     cfg().Console.HistoryFile,
 		AutoComplete:    completer,
 		InterruptPrompt: "^C",
-		EOFPrompt:       "exit",
+		EOFPrompt:       "shutdown",
 	})
 	if err != nil {
 		log.Printf("Failed to initialize readline: %v", err)
@@ -160,13 +452,10 @@ func readCommandsFromStdin(commandChan chan<- string) {
 		line, err := rl.Readline()
 		if err != nil {
 			if err == readline.ErrInterrupt {
+				stopReplay()
 				continue
 			} else if err == io.EOF {
-				// Send exit command when EOF
-				select {
-				case commandChan <- "exit":
-				default:
-				}
+				consoleClosed(commandChan)
 				return
 			}
 			log.Printf("Failed to read command from stdin: %v", err)
@@ -180,14 +469,8 @@ func readCommandsFromStdin(commandChan chan<- string) {
 
 		// Special case: help command
 		if command == "help" {
-			fmt.Println(`Help:
-Input "cmd dir d:\test" to execute a CMD command
-Input "cmd capture screen" to take current picture and send back, which will be saved to current folder as image
-Input "send d:\test\test.txt" to request client to send a file back
-Input "ps <command>" to execute a PowerShell command
-Input "help" to show this help message
-Input "exit" to terminate the server and client`)
-			rl.SetPrompt("Please enter command (cmd <command> or ps <command>): ")
+			fmt.Println(consoleHelp)
+			rl.SetPrompt(cfg().Console.Prompt)
 			continue
 		}
 
@@ -201,7 +484,21 @@ Input "exit" to terminate the server and client`)
 		}
 
 		// Update prompt for next iteration
-		rl.SetPrompt("Please enter command (cmd <command> or ps <command>): ")
+		rl.SetPrompt(cfg().Console.Prompt)
+	}
+}
+
+// consoleClosed is called when stdin ends. Ctrl-D at a terminal shuts the
+// server down; a server whose stdin is /dev/null or a pipe, as under cron,
+// CI or nohup, keeps running without a console.
+func consoleClosed(commandChan chan<- string) {
+	if !readline.IsTerminal(int(os.Stdin.Fd())) {
+		log.Println("Console input closed, the server keeps running until SIGINT or SIGTERM")
+		return
+	}
+	select {
+	case commandChan <- forcePrefix + "shutdown":
+	default:
 	}
 }
 
@@ -209,9 +506,35 @@ Input "exit" to terminate the server and client`)
 var completer = readline.NewPrefixCompleter(
 	readline.PcItem("cmd"),
 	readline.PcItem("ps"),
+	readline.PcItem("proc",
+		readline.PcItem("list"),
+		readline.PcItem("kill"),
+		readline.PcItem("info"),
+	),
 	readline.PcItem("send"),
+	readline.PcItem("ls"),
+	readline.PcItem("sessions"),
+	readline.PcItem("use"),
+	readline.PcItem("top"),
+	readline.PcItem("forward",
+		readline.PcItem("list"),
+		readline.PcItem("add"),
+		readline.PcItem("remove"),
+	),
+	readline.PcItem("limit"),
+	readline.PcItem("transfers"),
+	readline.PcItem("pause"),
+	readline.PcItem("resume"),
+	readline.PcItem("cancel"),
+	readline.PcItem("replay",
+		readline.PcItem("stop"),
+	),
+	readline.PcItem("reload"),
 	readline.PcItem("help"),
-	readline.PcItem("exit"),
+	readline.PcItem("disconnect"),
+	readline.PcItem("update"),
+	readline.PcItem("client-quit"),
+	readline.PcItem("shutdown"),
 )
 
 // Fallback function for simple input when readline setup fails
@@ -219,17 +542,13 @@ func readCommandsSimple(commandChan chan<- string) {
 	stdinReader := bufio.NewReader(os.Stdin)
 
 	for {
-		fmt.Print("Please enter command (cmd <command> or ps <command>): ")
+		fmt.Print(cfg().Console.Prompt)
 		command, err := stdinReader.ReadString('\n')
 		if err != nil {
 			if err != io.EOF {
 				log.Printf("Failed to read command from stdin: %v", err)
 			}
-			// Send exit command when EOF
-			select {
-			case commandChan <- "exit":
-			default:
-			}
+			consoleClosed(commandChan)
 			return
 		}
 
@@ -240,13 +559,7 @@ func readCommandsSimple(commandChan chan<- string) {
 
 		// Special case: help command
 		if command == "help" {
-			fmt.Println(`Help:
-Input "cmd dir d:\test" to execute a CMD command
-Input "cmd capture screen" to take current picture and send back, which will be saved to current folder as image
-Input "send d:\test\test.txt" to request client to send a file back
-Input "ps <command>" to execute a PowerShell command
-Input "help" to show this help message
-Input "exit" to terminate the server and client`)
+			fmt.Println(consoleHelp)
 			continue
 		}
 
@@ -257,7 +570,16 @@ Input "exit" to terminate the server and client`)
 		}
 	}
 }
-func readClientResponse(conn net.Conn, shutdownChan chan struct{}) {
+
+// readClientResponse reads and handles everything the client sends on conn,
+// which is either the session's main connection or one of its streams.
+// Command output goes to sink if given, to the session's sink while an
+// exec runs on the main connection, and to the console otherwise.
+func readClientResponse(s *Session, conn net.Conn, sink *responseSink) {
+	// A stream that ends before its end marker still ends the command
+	if sink != nil {
+		defer sink.finish()
+	}
 	defer func() {
 		// Recover from potential panic when closing already closed channels
 		if r := recover(); r != nil {
@@ -265,12 +587,26 @@ func readClientResponse(conn net.Conn, shutdownChan chan struct{}) {
 		}
 	}()
 
-	reader := bufio.NewReader(conn)
-	var isReceivingScreenshot bool
+	// A transfer cut short still ends for the shutdown's purposes
+	var isReceivingFile, isReceivingScreenshot bool
+	// current is the transfer of the file being received, or the one the
+	// client announced
+	var current *transfer
+	defer func() {
+		if isReceivingFile {
+			activeTransfers.Add(-1)
+		}
+		if isReceivingScreenshot {
+			activeTransfers.Add(-1)
+		}
+		transfers.finish(current, errClientGone)
+	}()
+
+	reader := s.reader(conn)
 	var screenshotData strings.Builder
+	var screenshotChunks bytes.Buffer // clients that do not need base64 send chunks
 	var expectedSize int
 
-	var isReceivingFile bool
 	var fileData bytes.Buffer // 使用bytes.Buffer替代strings.Builder处理二进制数据
 	var expectedFileSize int64
 	var fileName string
@@ -281,24 +617,49 @@ func readClientResponse(conn net.Conn, shutdownChan chan struct{}) {
 	var chunkCount int
 	var errorCount int
 
+	// endFile ends the file being received, saved or not. A transfer
+	// has no end marker of its own.
+	endFile := func(saved string) {
+		isReceivingFile = false
+		activeTransfers.Add(-1)
+		fileData.Reset()
+		totalBytes = 0
+		chunkCount = 0
+		errorCount = 0
+		lastProgress = 0
+
+		if out := responseOutput(s, sink); out != nil {
+			if saved != "" && out.file != nil {
+				out.file(saved)
+			}
+			s.sink.CompareAndSwap(out, nil)
+			out.finish()
+			return
+		}
+		if saved != "" {
+			auditConsoleFile(s, saved)
+		}
+		s.consoleAnswered()
+	}
+
 	for {
 		// Check if we should shutdown
 		select {
-		case <-shutdownChan:
+		case <-s.done:
 			log.Println("Client response reader shutting down")
 			return
 		default:
 		}
 
 		// 设置更长的超时时间，避免大数据传输时超时
-		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		conn.SetReadDeadline(time.Now().Add(cfg().ReadTimeout))
 
 		// Read client response
-		response, err := reader.ReadString('\n')
-		if err != nil {
+		msg, err := reader.Read()
+		if err != nil && !errors.Is(err, protocol.ErrMalformed) {
 			// Check if it's a timeout (used for shutdown checking)
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				if isReceivingFile {
+				if isReceivingFile && (current == nil || current.getState() != transferPaused) {
 					fmt.Printf("\r--- Waiting for data... (timeout) ---")
 				}
 				continue
@@ -312,12 +673,73 @@ func readClientResponse(conn net.Conn, shutdownChan chan struct{}) {
 
 		// Reset read deadline
 		conn.SetReadDeadline(time.Time{})
+		s.touch()
+
+		// Anything that does not decode comes as Text and is shown as
+		// output. Chunks are never shown and too large to encode for it.
+		var response string
+		if _, ok := msg.(protocol.Chunk); !ok {
+			response = strings.TrimSpace(msg.String())
+		}
+		if err != nil && isReceivingFile {
+			errorCount++
+			log.Printf("Warning: %v", err)
+			continue
+		}
+
+		switch m := msg.(type) {
+		// Heartbeats are answered here and never reach the output
+		case protocol.KeepAlive:
+			// Not while an upload holds the connection, see trySend
+			s.trySend(protocol.KeepAliveAck{})
+			continue
+		case protocol.KeepAliveAck:
+			continue
+
+		// The client could not reach a forward's target
+		case protocol.NewConnFailed:
+			forwards.fail(m)
+			continue
+
+		// Telemetry frames can arrive at any time, even during a transfer
+		case protocol.Metrics:
+			handleMetrics(s, m)
+			continue
+
+		// Files sent for a transfer of the queue are announced with its ID,
+		// and the transfer ended with it however they end
+		case protocol.Transfer:
+			t := transfers.get(m.ID)
+			if t == nil || t.session != s {
+				continue
+			}
+			if m.Action == protocol.TransferStart {
+				current = t
+				continue
+			}
+			if current == t {
+				current = nil
+			}
+			transfers.finish(t, errors.New("the client sent no file"))
+			continue
+		}
 
-		response = strings.TrimSpace(response)
+		// Clients since the hello send files in chunks only, and may answer
+		// other commands in the middle of one, such as while it is paused.
+		// Their answers are output as usual.
+		interleaved := false
+		if s.info.Protocol > 0 {
+			switch msg.(type) {
+			case protocol.Text, protocol.ExitStatus, protocol.End:
+				interleaved = true
+			}
+		}
 
 		// Handle file transfer data reception
-		if isReceivingFile {
-			if response == "FILE_TRANSFER_END" {
+		if isReceivingFile && !interleaved {
+			var data []byte
+			switch m := msg.(type) {
+			case protocol.FileEnd:
 				// Save the file
 				elapsed := time.Since(startTime)
 				speed := float64(totalBytes) / elapsed.Seconds() / 1024 // KB/s
@@ -325,118 +747,58 @@ func readClientResponse(conn net.Conn, shutdownChan chan struct{}) {
 					elapsed.Seconds(), speed)
 				fmt.Printf("--- Received %d chunks, %d errors ---\n", chunkCount, errorCount)
 
-				saveFile(&fileData, fileName, expectedFileSize, totalBytes)
-				isReceivingFile = false
-				fileData.Reset()
-				//receivedChunks = 0
-				totalBytes = 0
-				chunkCount = 0
-				errorCount = 0
-				lastProgress = 0
+				saved := saveFile(&fileData, fileName, expectedFileSize, totalBytes)
+				if saved != "" {
+					s.transcript.output(fmt.Sprintf("[file received: %s]", saved))
+				}
+				transfers.finish(current, nil)
+				current = nil
+				endFile(saved)
 				continue
-			}
 
-			// 跳过空行
-			if response == "" {
+			case protocol.Error:
+				fmt.Printf("\n--- File transfer of %s failed on the client: %s ---\n", fileName, m.Message)
+				transfers.finish(current, errors.New(m.Message))
+				current = nil
+				endFile("")
 				continue
-			}
 
-			chunkCount++
+			case protocol.Chunk:
+				data = m.Data
 
-			// 解析chunk头信息
-			if strings.HasPrefix(response, "CHUNK:") {
-				// 找到第三个冒号，分离header和data
-				firstColon := strings.Index(response, ":")
-				secondColon := strings.Index(response[firstColon+1:], ":") + firstColon + 1
-				thirdColon := strings.Index(response[secondColon+1:], ":") + secondColon + 1
-
-				if firstColon >= 0 && secondColon > firstColon && thirdColon > secondColon {
-					// 提取base64数据部分
-					base64Data := response[thirdColon+1:]
-
-					// 解码前清理数据
-					base64Data = strings.TrimSpace(base64Data)
-					base64Data = strings.ReplaceAll(base64Data, "\r", "")
-					base64Data = strings.ReplaceAll(base64Data, "\n", "")
-
-					// 确保base64数据长度是4的倍数
-					if len(base64Data)%4 != 0 {
-						padding := 4 - len(base64Data)%4
-						base64Data += strings.Repeat("=", padding)
-					}
-
-					// 解码base64数据
-					decoded, err := base64.StdEncoding.DecodeString(base64Data)
-					if err != nil {
-						// 尝试不同的解码方法
-						decoded, err = base64.RawStdEncoding.DecodeString(base64Data)
-						if err != nil {
-							errorCount++
-							log.Printf("Warning: Failed to decode chunk %d (len=%d): %v",
-								chunkCount, len(base64Data), err)
-							log.Printf("Base64 preview: %.100s...", base64Data)
-							continue
-						}
-					}
-
-					// 写入到缓冲区
-					n, err := fileData.Write(decoded)
-					if err != nil {
-						errorCount++
-						log.Printf("Warning: Failed to write chunk %d: %v", chunkCount, err)
-						continue
-					}
-
-					totalBytes += int64(n)
-
-					// Calculate and display progress
-					if expectedFileSize > 0 {
-						progress := int(float64(totalBytes) / float64(expectedFileSize) * 100)
-						if progress > lastProgress || chunkCount%100 == 0 || progress == 100 {
-							fmt.Printf("\r--- Receiving: %s [%3d%%] %d/%d bytes (chunks: %d, errors: %d) ---",
-								fileName, progress, totalBytes, expectedFileSize, chunkCount, errorCount)
-							lastProgress = progress
-						}
-					}
-				} else {
+			case protocol.Text:
+				// Clients before chunk headers sent plain base64 lines; only
+				// clients without a hello get here
+				if m == "" {
+					continue
+				}
+				data, err = protocol.DecodeBase64(string(m))
+				if err != nil {
+					chunkCount++
 					errorCount++
-					log.Printf("Warning: Malformed chunk header: %.100s...", response)
+					log.Printf("Warning: Failed to decode legacy chunk %d: %v", chunkCount, err)
+					continue
 				}
-			} else {
-				// 处理旧格式的chunk（无header）
-				base64Data := strings.TrimSpace(response)
-				if base64Data != "" {
-					// 确保base64数据长度是4的倍数
-					if len(base64Data)%4 != 0 {
-						padding := 4 - len(base64Data)%4
-						base64Data += strings.Repeat("=", padding)
-					}
-
-					decoded, err := base64.StdEncoding.DecodeString(base64Data)
-					if err != nil {
-						errorCount++
-						log.Printf("Warning: Failed to decode legacy chunk %d: %v", chunkCount, err)
-						continue
-					}
-
-					n, err := fileData.Write(decoded)
-					if err != nil {
-						errorCount++
-						log.Printf("Warning: Failed to write legacy chunk %d: %v", chunkCount, err)
-						continue
-					}
-
-					totalBytes += int64(n)
-
-					// Calculate and display progress
-					if expectedFileSize > 0 {
-						progress := int(float64(totalBytes) / float64(expectedFileSize) * 100)
-						if progress > lastProgress || chunkCount%100 == 0 || progress == 100 {
-							fmt.Printf("\r--- Receiving: %s [%3d%%] %d/%d bytes (chunks: %d, errors: %d) ---",
-								fileName, progress, totalBytes, expectedFileSize, chunkCount, errorCount)
-							lastProgress = progress
-						}
-					}
+
+			default:
+				errorCount++
+				log.Printf("Warning: Unexpected %.100s during a file transfer", response)
+				continue
+			}
+
+			chunkCount++
+			n, _ := fileData.Write(data)
+			totalBytes += int64(n)
+			current.progress(n)
+
+			// Calculate and display progress
+			if expectedFileSize > 0 {
+				progress := int(float64(totalBytes) / float64(expectedFileSize) * 100)
+				if progress > lastProgress || chunkCount%100 == 0 || progress == 100 {
+					rate := protocol.FormatBytes(float64(totalBytes) / time.Since(startTime).Seconds())
+					fmt.Printf("\r--- Receiving: %s [%3d%%] %d/%d bytes at %s/s (chunks: %d, errors: %d) ---",
+						fileName, progress, totalBytes, expectedFileSize, rate, chunkCount, errorCount)
+					lastProgress = progress
 				}
 			}
 			continue
@@ -444,71 +806,124 @@ func readClientResponse(conn net.Conn, shutdownChan chan struct{}) {
 
 		// Handle screenshot data reception
 		if isReceivingScreenshot {
-			if response == "SCREENSHOT_END" {
-				// Save the screenshot
-				saveScreenshot(screenshotData.String(), expectedSize)
+			if _, ok := msg.(protocol.ScreenshotEnd); ok {
+				// Save the screenshot, which clients that do not send chunks
+				// send as base64
+				var saved string
+				var err error
+				data := screenshotChunks.Bytes()
+				if screenshotChunks.Len() == 0 {
+					data, err = protocol.DecodeBase64(screenshotData.String())
+				}
+				if err != nil {
+					log.Printf("Failed to decode screenshot data: %v", err)
+					log.Printf("Data length: %d, First 100 chars: %.100s", screenshotData.Len(), screenshotData.String())
+				} else {
+					saved = saveScreenshot(data, expectedSize)
+				}
+				if saved != "" {
+					s.transcript.output(fmt.Sprintf("[screenshot received: %s]", saved))
+				}
+				if out := responseOutput(s, sink); out != nil && saved != "" && out.file != nil {
+					out.file(saved)
+				} else if out == nil && saved != "" {
+					auditConsoleFile(s, saved)
+				}
 				isReceivingScreenshot = false
+				activeTransfers.Add(-1)
 				screenshotData.Reset()
+				screenshotChunks.Reset()
 				continue
 			}
 
 			// Accumulate screenshot data
+			if chunk, ok := msg.(protocol.Chunk); ok {
+				screenshotChunks.Write(chunk.Data)
+				continue
+			}
 			screenshotData.WriteString(response)
 			continue
 		}
 
-		// Check for file transfer start marker
-		if strings.HasPrefix(response, "FILE_TRANSFER_START:") {
-			parts := strings.SplitN(response, ":", 3)
-			if len(parts) == 3 {
-				name := parts[1]
-				size, err := strconv.ParseInt(parts[2], 10, 64)
-				if err == nil {
-					isReceivingFile = true
-					fileName = name
-					expectedFileSize = size
-					fileData.Reset()
-					//receivedChunks = 0
-					totalBytes = 0
-					chunkCount = 0
-					errorCount = 0
-					lastProgress = 0
-					startTime = time.Now()
-					fmt.Printf("\n--- Receiving file: %s (size: %d bytes) ---\n", name, size)
-					fmt.Printf("Progress: [  0%%] 0/%d bytes", size)
-					continue
-				}
+		out := responseOutput(s, sink)
+
+		switch m := msg.(type) {
+		case protocol.FileStart:
+			isReceivingFile = true
+			activeTransfers.Add(1)
+			fileName = m.Name
+			expectedFileSize = m.Size
+			fileData.Reset()
+			totalBytes = 0
+			chunkCount = 0
+			errorCount = 0
+			lastProgress = 0
+			startTime = time.Now()
+			// Clients before "transfers" send files that were not queued
+			if current == nil {
+				current = transfers.add(s, download, m.Name, false)
 			}
-		}
+			current.begin(m.Name, m.Size)
+			fmt.Printf("\n--- Receiving file: %s (transfer %d, size: %d bytes) ---\n", m.Name, current.ID, m.Size)
+			fmt.Printf("Progress: [  0%%] 0/%d bytes", m.Size)
+			continue
 
-		// Check for screenshot start marker
-		if strings.HasPrefix(response, "SCREENSHOT_START:") {
-			parts := strings.Split(response, ":")
-			if len(parts) == 2 {
-				size, err := strconv.Atoi(parts[1])
-				if err == nil {
-					isReceivingScreenshot = true
-					expectedSize = size
-					screenshotData.Reset()
-					fmt.Println("\n--- Receiving screenshot ---")
-					continue
-				}
+		case protocol.ScreenshotStart:
+			isReceivingScreenshot = true
+			activeTransfers.Add(1)
+			expectedSize = m.Size
+			screenshotData.Reset()
+			screenshotChunks.Reset()
+			fmt.Println("\n--- Receiving screenshot ---")
+			continue
+
+		// Exit code of the command, for scripted callers and the audit log
+		case protocol.ExitStatus:
+			code := m.Code
+			s.transcript.output(fmt.Sprintf("[exit status %d]", code))
+			if out != nil {
+				out.status = code
+				out.exited = true
+			} else {
+				audit.record(AuditEntry{Operator: consoleOperator(), Source: "console", Action: "command_exit", ExitCode: &code}.withSession(s))
 			}
-		}
+			continue
 
 		// Check for end marker
-		if response == "---END---" {
+		case protocol.End:
+			if out != nil {
+				s.sink.CompareAndSwap(out, nil)
+				out.finish()
+				continue
+			}
+			s.consoleAnswered()
 			fmt.Println("\n--- Command execution completed ---")
-			fmt.Print("Please enter command (cmd <command> or ps <command>): ")
+			fmt.Print(cfg().Console.Prompt)
 			continue
 		}
 
 		// Output client response
+		s.transcript.output(response)
+		if out != nil {
+			out.write(response)
+			continue
+		}
 		fmt.Println(response)
 	}
 }
 
-func saveFile(fileData *bytes.Buffer, fileName string, expectedSize int64, actualSize int64) {
+// responseOutput is where command output read for s goes: the stream's own
+// sink, the session's while an exec runs, or nil for the console
+func responseOutput(s *Session, sink *responseSink) *responseSink {
+	if sink != nil {
+		return sink
+	}
+	return s.sink.Load()
+}
+
+// saveFile writes a received file to the output directory and returns its
+// path, or "" if it could not be saved
+func saveFile(fileData *bytes.Buffer, fileName string, expectedSize int64, actualSize int64) string {
 	// 获取缓冲区中的数据
 	decoded := fileData.Bytes()
 
@@ -524,6 +939,9 @@ func saveFile(fileData *bytes.Buffer, fileName string, expectedSize int64, actua
 		}
 	}
 
+	// Save into the configured output directory, never outside it
+	fileName = filepath.Join(cfg().Output.Files, filepath.Base(fileName))
+
 	// 避免覆盖现有文件
 	originalName := fileName
 	counter := 1
@@ -538,18 +956,17 @@ func saveFile(fileData *bytes.Buffer, fileName string, expectedSize int64, actua
 	}
 
 	// Create file
-	file, err := os.Create(fileName)
+	file, err := partialFiles.create(fileName)
 	if err != nil {
 		log.Printf("Failed to create file: %v", err)
-		return
+		return ""
 	}
-	defer file.Close()
 
 	// Write data to file
 	n, err := file.Write(decoded)
-	if err != nil {
+	if err = partialFiles.finish(file, fileName, err); err != nil {
 		log.Printf("Failed to write file: %v", err)
-		return
+		return ""
 	}
 
 	// 验证文件完整性（对于ZIP文件）
@@ -564,66 +981,44 @@ func saveFile(fileData *bytes.Buffer, fileName string, expectedSize int64, actua
 	}
 
 	fmt.Printf("\n--- File saved as %s (%d bytes) ---\n", fileName, n)
-	fmt.Print("Please enter command (cmd <command> or ps <command>): ")
+	fmt.Print(cfg().Console.Prompt)
+	return fileName
 }
 
-// Add padding to base64 string if needed
-func addPadding(data string) string {
-	padding := len(data) % 4
-	if padding > 0 {
-		data += strings.Repeat("=", 4-padding)
-	}
-	return data
-}
-
-func saveScreenshot(data string, expectedSize int) {
-	// Clean the data by removing any whitespace that might have been added
-	data = strings.TrimSpace(data)
-
-	// Decode base64 data
-	decoded, err := base64.StdEncoding.DecodeString(data)
-	if err != nil {
-		log.Printf("Failed to decode screenshot data: %v", err)
-		log.Printf("Data length: %d, First 100 chars: %.100s", len(data), data)
-		// Try to decode with padding if needed
-		data = addPadding(data)
-		decoded, err = base64.StdEncoding.DecodeString(data)
-		if err != nil {
-			log.Printf("Failed to decode screenshot data even with padding: %v", err)
-			return
-		}
-	}
-
+// saveScreenshot writes a received screenshot to the output directory and
+// returns its path, or "" if it could not be saved
+func saveScreenshot(data []byte, expectedSize int) string {
 	// Validate size
-	if len(decoded) != expectedSize {
-		log.Printf("Warning: Expected %d bytes, got %d bytes", expectedSize, len(decoded))
+	if len(data) != expectedSize {
+		log.Printf("Warning: Expected %d bytes, got %d bytes", expectedSize, len(data))
 	}
 
 	// Create filename with timestamp
-	filename := fmt.Sprintf("screenshot_%s.png", time.Now().Format("20060102_150405"))
+	filename := filepath.Join(cfg().Output.Screenshots,
+		fmt.Sprintf("screenshot_%s.png", time.Now().Format("20060102_150405")))
 
-	// Create file
-	file, err := os.Create(filename)
+	// Decode and validate PNG
+	_, err := png.Decode(bytes.NewReader(data))
 	if err != nil {
-		log.Printf("Failed to create screenshot file: %v", err)
-		return
+		log.Printf("Failed to decode PNG data: %v", err)
+		return ""
 	}
-	defer file.Close()
 
-	// Decode and validate PNG
-	_, err = png.Decode(bytes.NewReader(decoded))
+	// Create file
+	file, err := partialFiles.create(filename)
 	if err != nil {
-		log.Printf("Failed to decode PNG data: %v", err)
-		return
+		log.Printf("Failed to create screenshot file: %v", err)
+		return ""
 	}
 
 	// Write raw data to file
-	_, err = file.Write(decoded)
-	if err != nil {
+	_, err = file.Write(data)
+	if err = partialFiles.finish(file, filename, err); err != nil {
 		log.Printf("Failed to write screenshot to file: %v", err)
-		return
+		return ""
 	}
 
 	fmt.Printf("\n--- Screenshot saved as %s ---\n", filename)
-	fmt.Print("Please enter command (cmd <command> or ps <command>): ")
+	fmt.Print(cfg().Console.Prompt)
+	return filename
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gofrpprotocol"
+)
+
+var (
+	metricsHistory = flag.Int("metrics-history", 60, "Number of metrics samples kept per client")
+	alertCPU       = flag.Float64("alert-cpu", 0, "Alert when client CPU usage exceeds this percent (0 disables)")
+	alertMem       = flag.Float64("alert-mem", 0, "Alert when client memory usage exceeds this percent (0 disables)")
+	alertDisk      = flag.Float64("alert-disk", 90, "Alert when client disk usage exceeds this percent (0 disables)")
+	alertWebhook   = flag.String("alert-webhook", "", "URL to POST threshold alerts to as JSON")
+)
+
+// Metrics is one telemetry frame pushed by a client
+type Metrics = protocol.Metrics
+
+// metricsRing keeps the last N samples of a client
+type metricsRing struct {
+	mu      sync.Mutex
+	samples []Metrics
+	next    int
+	full    bool
+	alerts  map[string]bool // metric name -> currently above threshold
+}
+
+func newMetricsRing(size int) *metricsRing {
+	if size < 1 {
+		size = 1
+	}
+	return &metricsRing{samples: make([]Metrics, size), alerts: make(map[string]bool)}
+}
+
+func (r *metricsRing) push(m Metrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples[r.next] = m
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// latest returns the most recent sample, if any
+func (r *metricsRing) latest() (Metrics, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full && r.next == 0 {
+		return Metrics{}, false
+	}
+	i := (r.next - 1 + len(r.samples)) % len(r.samples)
+	return r.samples[i], true
+}
+
+// all returns the buffered samples, oldest first
+func (r *metricsRing) all() []Metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]Metrics(nil), r.samples[:r.next]...)
+	}
+	return append(append([]Metrics(nil), r.samples[r.next:]...), r.samples[:r.next]...)
+}
+
+// handleMetrics stores a metrics frame and checks thresholds
+func handleMetrics(s *Session, m Metrics) {
+	if m.Time == 0 {
+		m.Time = time.Now().Unix()
+	}
+	s.metrics.push(m)
+	checkAlerts(s, m)
+}
+
+func checkAlerts(s *Session, m Metrics) {
+	alerts := cfg().Alerts
+	checks := []struct {
+		name      string
+		value     float64
+		threshold float64
+	}{
+		{"cpu", m.CPU, alerts.CPU},
+		{"mem", m.Mem, alerts.Mem},
+		{"disk", m.Disk, alerts.Disk},
+	}
+
+	for _, c := range checks {
+		if c.threshold <= 0 {
+			continue
+		}
+		above := c.value > c.threshold
+
+		s.metrics.mu.Lock()
+		was := s.metrics.alerts[c.name]
+		s.metrics.alerts[c.name] = above
+		s.metrics.mu.Unlock()
+
+		// Only report transitions so a full disk does not alert every frame
+		if above && !was {
+			fmt.Printf("\n!!! ALERT client %s: %s usage %.1f%% > %.1f%% !!!\n", s, c.name, c.value, c.threshold)
+			go postAlert(s, c.name, c.value, c.threshold, "firing")
+		} else if !above && was {
+			fmt.Printf("\n--- Resolved client %s: %s usage %.1f%% ---\n", s, c.name, c.value)
+			go postAlert(s, c.name, c.value, c.threshold, "resolved")
+		}
+	}
+}
+
+func postAlert(s *Session, metric string, value, threshold float64, state string) {
+	webhook := cfg().Alerts.Webhook
+	if webhook == "" {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"client":    s.ID,
+		"client_id": s.info.ID,
+		"name":      s.info.Name,
+		"address":   s.addr,
+		"metric":    metric,
+		"value":     value,
+		"threshold": threshold,
+		"state":     state,
+		"time":      time.Now().Unix(),
+	})
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to post alert webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Alert webhook returned %s", resp.Status)
+	}
+}
+
+// printTop shows the latest metrics of all sessions at once
+func printTop() {
+	list := sessions.list()
+	if len(list) == 0 {
+		fmt.Println("No clients connected")
+		return
+	}
+
+	active := sessions.activeID()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tID\tCLIENT\tCPU%\tMEM%\tDISK%\tRX/s\tTX/s\tLOAD\tUPDATED")
+	for _, s := range list {
+		mark := ""
+		if s.ID == active {
+			mark = "*"
+		}
+		m, ok := s.metrics.latest()
+		if !ok {
+			fmt.Fprintf(w, "%s\t%d\t%s\t-\t-\t-\t-\t-\t-\tno data\n", mark, s.ID, s.name())
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%.1f\t%.1f\t%.1f\t%s\t%s\t%.2f %.2f %.2f\t%s ago\n",
+			mark, s.ID, s.name(), m.CPU, m.Mem, m.Disk,
+			formatRate(m.NetRx), formatRate(m.NetTx),
+			m.Load1, m.Load5, m.Load15,
+			time.Since(time.Unix(m.Time, 0)).Round(time.Second))
+	}
+	w.Flush()
+}
+
+func formatRate(bytesPerSec float64) string {
+	switch {
+	case bytesPerSec >= 1024*1024:
+		return fmt.Sprintf("%.1fMB", bytesPerSec/1024/1024)
+	case bytesPerSec >= 1024:
+		return fmt.Sprintf("%.1fKB", bytesPerSec/1024)
+	default:
+		return fmt.Sprintf("%.0fB", bytesPerSec)
+	}
+}
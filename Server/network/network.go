@@ -1,16 +1,12 @@
 package network
 
 import (
+	"bufio"
 	"io"
 	"log"
 	"net"
 )
 
-const (
-	KeepAlive     = "KEEP_ALIVE"
-	NewConnection = "NEW_CONNECTION"
-)
-
 func CreateTCPListener(addr string) (*net.TCPListener, error) {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
@@ -35,12 +31,12 @@ func CreateTCPConn(addr string) (*net.TCPConn, error) {
 	return tcpListener, nil
 }
 
-func Join2Conn(local *net.TCPConn, remote *net.TCPConn) {
+func Join2Conn(local net.Conn, remote net.Conn) {
 	go joinConn(local, remote)
 	go joinConn(remote, local)
 }
 
-func joinConn(local *net.TCPConn, remote *net.TCPConn) {
+func joinConn(local net.Conn, remote net.Conn) {
 	defer local.Close()
 	defer remote.Close()
 	_, err := io.Copy(local, remote)
@@ -49,3 +45,14 @@ func joinConn(local *net.TCPConn, remote *net.TCPConn) {
 		return
 	}
 }
+
+// BufferedConn is a net.Conn whose first bytes come from a bufio.Reader,
+// for connections whose first line was read before handing them on.
+type BufferedConn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func (c *BufferedConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
@@ -0,0 +1,273 @@
+package network
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICProtocol is the ALPN name both sides agree on
+const QUICProtocol = "gofrp"
+
+// StreamOpener is implemented by connections of multiplexing transports.
+// Each command, transfer or forwarded connection can get its own stream
+// so a stalled transfer does not block the rest of the session.
+type StreamOpener interface {
+	OpenStream() (net.Conn, error)
+}
+
+// QUICTransport accepts clients over QUIC on a UDP port, and over plain
+// TCP on the same port number for clients whose UDP is blocked.
+type QUICTransport struct {
+	TransportOptions
+}
+
+func (t *QUICTransport) Listen(addr string) (net.Listener, error) {
+	tlsConf, err := t.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	ql, err := quic.ListenAddr(addr, tlsConf, &quic.Config{
+		MaxIdleTimeout:     time.Minute,
+		KeepAlivePeriod:    15 * time.Second,
+		MaxIncomingStreams: 1000,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tl, err := CreateTCPListener(addr)
+	if err != nil {
+		ql.Close()
+		return nil, err
+	}
+
+	l := &multiListener{
+		addr:   tl.Addr(),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+		close:  []func() error{ql.Close, tl.Close},
+	}
+	go l.acceptQUIC(ql)
+	go l.acceptTCP(tl)
+	return l, nil
+}
+
+func (t *QUICTransport) tlsConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if t.CertFile != "" && t.KeyFile != "" {
+		cert, err = tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	} else {
+		var path string
+		cert, path, err = selfSignedCert()
+		if err == nil {
+			log.Printf("No TLS certificate given, QUIC uses the self-signed one in %s; clients verify it with -quic-fingerprint %s",
+				path, Fingerprint(cert.Certificate[0]))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{QUICProtocol}}, nil
+}
+
+// Fingerprint is the SHA-256 of a certificate, as clients pin it
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+var selfSignedMu sync.Mutex
+
+// selfSignedCert returns the certificate of servers without one of their
+// own, and the file it is kept in. It is created on first use and kept in
+// the user's config directory, so that its fingerprint stays the same
+// across restarts.
+func selfSignedCert() (tls.Certificate, string, error) {
+	selfSignedMu.Lock()
+	defer selfSignedMu.Unlock()
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	path := filepath.Join(dir, "gofrpserver", "quic.pem")
+	if data, err := os.ReadFile(path); err == nil {
+		cert, err := tls.X509KeyPair(data, data)
+		return cert, path, err
+	} else if !os.IsNotExist(err) {
+		return tls.Certificate{}, "", err
+	}
+
+	cert, err := newSelfSignedCert()
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})...)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return tls.Certificate{}, "", err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return tls.Certificate{}, "", err
+	}
+	return cert, path, nil
+}
+
+func newSelfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "gofrpserver"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// multiListener merges the QUIC and TCP listeners into one net.Listener
+type multiListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+	close  []func() error
+}
+
+func (l *multiListener) acceptQUIC(ql *quic.Listener) {
+	for {
+		qc, err := ql.Accept(context.Background())
+		if err != nil {
+			l.Close()
+			return
+		}
+
+		go l.acceptStreams(qc)
+	}
+}
+
+// acceptStreams hands out the streams a client opens. The first one is the
+// control stream, which the client writes to right away; later ones carry
+// forwarded connections.
+func (l *multiListener) acceptStreams(qc *quic.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	stream, err := qc.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("QUIC client %s opened no control stream: %v", qc.RemoteAddr(), err)
+		qc.CloseWithError(0, "no control stream")
+		return
+	}
+	l.push(&QUICConn{Stream: stream, conn: qc, control: true})
+
+	for {
+		stream, err := qc.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		l.push(&QUICConn{Stream: stream, conn: qc})
+	}
+}
+
+func (l *multiListener) acceptTCP(tl net.Listener) {
+	for {
+		conn, err := tl.Accept()
+		if err != nil {
+			l.Close()
+			return
+		}
+		l.push(conn)
+	}
+}
+
+func (l *multiListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *multiListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		for _, c := range l.close {
+			c()
+		}
+	})
+	return nil
+}
+
+func (l *multiListener) Addr() net.Addr {
+	return l.addr
+}
+
+// QUICConn is one QUIC stream as a net.Conn. Closing the control stream
+// ends the whole QUIC connection, closing any other stream only ends that
+// stream.
+type QUICConn struct {
+	*quic.Stream
+	conn    *quic.Conn
+	control bool
+}
+
+func (c *QUICConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *QUICConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *QUICConn) Close() error {
+	if c.control {
+		return c.conn.CloseWithError(0, "closed")
+	}
+	return c.Stream.Close()
+}
+
+// OpenStream opens a new stream on the same QUIC connection
+func (c *QUICConn) OpenStream() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &QUICConn{Stream: stream, conn: c.conn}, nil
+}
@@ -0,0 +1,179 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/coder/websocket"
+)
+
+// Transport hides how client connections reach the server. The session
+// protocol on top is the same for every transport.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+}
+
+// NewTransport returns the transport for name: tcp, ws, wss or quic
+func NewTransport(name string, opts TransportOptions) (Transport, error) {
+	switch name {
+	case "", "tcp":
+		return TCPTransport{}, nil
+	case "ws", "wss":
+		if name == "wss" && (opts.CertFile == "" || opts.KeyFile == "") {
+			return nil, errors.New("wss transport requires a TLS certificate and key")
+		}
+		return &WebSocketTransport{TransportOptions: opts, TLS: name == "wss"}, nil
+	case "quic":
+		return &QUICTransport{TransportOptions: opts}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", name)
+	}
+}
+
+// TransportOptions are the settings shared by the non-TCP transports
+type TransportOptions struct {
+	Path       string // HTTP path WebSocket upgrades are accepted on
+	CertFile   string
+	KeyFile    string
+	TrustProxy bool // take the client address from X-Forwarded-For / X-Real-IP
+}
+
+// TCPTransport is the plain TCP transport
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return CreateTCPListener(addr)
+}
+
+// WebSocketTransport accepts clients as WebSocket upgrades on an HTTP(S)
+// path, so it also works behind nginx and other reverse proxies.
+type WebSocketTransport struct {
+	TransportOptions
+	TLS bool
+}
+
+func (t *WebSocketTransport) Listen(addr string) (net.Listener, error) {
+	path := t.Path
+	if path == "" {
+		path = "/"
+	}
+
+	tcpListener, err := CreateTCPListener(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &wsListener{
+		tcp:    tcpListener,
+		addr:   tcpListener.Addr(),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			log.Printf("WebSocket upgrade from %s failed: %v", r.RemoteAddr, err)
+			return
+		}
+
+		// The request context ends with this handler, the session must not
+		conn := websocket.NetConn(context.Background(), c, websocket.MessageBinary)
+		remote := conn.RemoteAddr()
+		if t.TrustProxy {
+			if ip := forwardedFor(r); ip != "" {
+				remote = wsAddr(ip)
+			}
+		}
+
+		select {
+		case l.conns <- &wsConn{Conn: conn, remote: remote}:
+		case <-l.closed:
+			conn.Close()
+		}
+	})
+	l.server = &http.Server{Handler: mux}
+
+	go func() {
+		var err error
+		if t.TLS {
+			err = l.server.ServeTLS(tcpListener, t.CertFile, t.KeyFile)
+		} else {
+			err = l.server.Serve(tcpListener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("WebSocket server stopped: %v", err)
+		}
+		l.Close()
+	}()
+
+	return l, nil
+}
+
+// forwardedFor returns the original client address set by a reverse proxy.
+// Only the last X-Forwarded-For entry is the proxy's own, the ones before
+// it come from the client and can be anything.
+func forwardedFor(r *http.Request) string {
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		last := xff[len(xff)-1]
+		if ip := strings.TrimSpace(last[strings.LastIndex(last, ",")+1:]); ip != "" {
+			return ip
+		}
+	}
+	return strings.TrimSpace(r.Header.Get("X-Real-IP"))
+}
+
+// wsListener turns accepted WebSocket upgrades into a net.Listener
+type wsListener struct {
+	tcp    net.Listener
+	addr   net.Addr
+	server *http.Server
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.server.Close()
+		// Serve may not have taken over the listener yet, the address
+		// must be free once Close returns
+		l.tcp.Close()
+	})
+	return nil
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.addr
+}
+
+type wsConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
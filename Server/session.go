@@ -0,0 +1,514 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gofrpprotocol"
+	"gofrpserver/network"
+)
+
+// Session is one connected client
+type Session struct {
+	ID          int
+	conn        net.Conn
+	addr        string
+	connectedAt time.Time
+	info        protocol.ClientInfo
+	compression protocol.Compression // nil for clients before protocol.FramingVersion
+	limits      clientLimits
+
+	writeMu sync.Mutex
+	done    chan struct{}
+	once    sync.Once
+
+	// payloadMu is held by a request on the main connection across its
+	// writes, so that no other request gets in between
+	payloadMu sync.Mutex
+
+	lastSeen atomic.Int64 // unix nanoseconds of the last line received
+
+	metrics *metricsRing
+
+	transcript *transcript
+
+	// sink receives the output on the main connection instead of the
+	// console while an exec runs; execMu lets only one exec do that.
+	// Console requests hold execMu for reading until they are answered,
+	// so that an exec neither gets their output nor ends at their end.
+	sink    atomic.Pointer[responseSink]
+	execMu  sync.RWMutex
+	console atomic.Int64 // console requests holding execMu
+}
+
+var (
+	errClientGone = errors.New("client disconnected")
+	errCanceled   = errors.New("canceled")
+)
+
+// responseSink collects the output of one command for a caller other than
+// the console, such as "gofrpserver exec" or the HTTP API
+type responseSink struct {
+	write  func(line string)
+	file   func(path string) // optional, called for each file or screenshot saved
+	status int               // exit code reported by the client
+	exited bool              // whether the client reported one
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newResponseSink(write func(line string)) *responseSink {
+	return &responseSink{write: write, done: make(chan struct{})}
+}
+
+func (rs *responseSink) finish() {
+	rs.once.Do(func() { close(rs.done) })
+}
+
+// send writes a frame to the client. Writes are serialized so concurrent
+// senders cannot interleave their lines.
+func (s *Session) send(m protocol.Message) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return protocol.Write(s.framed(s.conn), m)
+}
+
+// trySend is send for frames that can be left out while a request holds
+// the connection, such as the answer to a keep-alive: the client hears
+// from us anyway.
+func (s *Session) trySend(m protocol.Message) error {
+	if !s.writeMu.TryLock() {
+		return nil
+	}
+	defer s.writeMu.Unlock()
+	return protocol.Write(s.framed(s.conn), m)
+}
+
+// lockedConn takes mu for each write, so frames written in between by
+// send stay whole
+type lockedConn struct {
+	net.Conn
+	mu *sync.Mutex
+}
+
+func (c *lockedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+// sendCommand sends a command to the client. On multiplexing transports
+// the command gets its own stream and its output is read from there, so a
+// large transfer cannot hold up other commands.
+func (s *Session) sendCommand(command string) error {
+	return s.sendCommandTo(command, nil)
+}
+
+// sendCommandTo sends a command whose output goes to sink, or to the
+// console if sink is nil. On the main connection the caller must hold
+// execMu while a sink is in use.
+func (s *Session) sendCommandTo(command string, sink *responseSink) error {
+	// The file comes once the transfer gets its turn
+	if path, ok := s.fileRequest(command); ok {
+		t := transfers.add(s, download, path, true)
+		if t.getState() == transferQueued {
+			fmt.Printf("\n--- Transfer %d queued behind the transfers %s runs, see \"transfers\" ---\n", t.ID, s)
+		}
+		go func() {
+			if err := s.requestFile(t, sink, nil); err != nil && !errors.Is(err, errTransferCanceled) {
+				fmt.Printf("\n--- Transfer %d of %s failed: %v ---\n", t.ID, path, err)
+			}
+		}()
+		return nil
+	}
+	return s.sendPayloadTo(func(w io.Writer) error {
+		return protocol.Write(w, protocol.Text(command))
+	}, sink)
+}
+
+// sendPayloadTo is sendCommandTo for requests of more than one line, such
+// as uploads. On the main connection no other request is written
+// meanwhile, and only clients that read them mid-upload get frames such
+// as heartbeats in between. What it writes is paced by the client's
+// transfer limit.
+func (s *Session) sendPayloadTo(write func(w io.Writer) error, sink *responseSink) error {
+	opener, ok := s.conn.(network.StreamOpener)
+	if !ok {
+		if t := transfers.pausedUpload(s); t != nil {
+			return fmt.Errorf("%w of %s: resume or cancel transfer %d first", errUploadPaused, s, t.ID)
+		}
+		if sink != nil {
+			s.sink.Store(sink)
+		} else {
+			s.consoleRequest()
+		}
+		err := s.writeMain(write)
+		// The client still answers a transfer canceled halfway
+		if sink == nil && err != nil && !errors.Is(err, errTransferCanceled) {
+			s.consoleAnswered()
+		}
+		return err
+	}
+
+	stream, err := opener.OpenStream()
+	if err != nil {
+		return err
+	}
+	if err := write(s.framed(s.limits[protocol.TransferLimit].Conn(stream))); err != nil {
+		stream.Close()
+		return err
+	}
+
+	go func() {
+		defer stream.Close()
+		readClientResponse(s, stream, sink)
+	}()
+	return nil
+}
+
+// writeMain writes a request to the main connection
+func (s *Session) writeMain(write func(w io.Writer) error) error {
+	s.payloadMu.Lock()
+	defer s.payloadMu.Unlock()
+	conn := s.conn
+	if s.interleaves() {
+		conn = &lockedConn{Conn: s.conn, mu: &s.writeMu}
+	} else {
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+	}
+	return write(s.framed(s.limits[protocol.TransferLimit].Conn(conn)))
+}
+
+// consoleRequest waits until no exec owns the output of the main
+// connection, and keeps any from taking it until consoleAnswered
+func (s *Session) consoleRequest() {
+	s.execMu.RLock()
+	s.console.Add(1)
+}
+
+// consoleAnswered is called when the client has answered a console
+// request on the main connection, or will not
+func (s *Session) consoleAnswered() {
+	for {
+		n := s.console.Load()
+		if n == 0 {
+			return
+		}
+		if s.console.CompareAndSwap(n, n-1) {
+			s.execMu.RUnlock()
+			return
+		}
+	}
+}
+
+// execBusy reports whether an exec owns the output of the main
+// connection, or waits for it
+func (s *Session) execBusy() bool {
+	if s.multiplexed() {
+		return false
+	}
+	if !s.execMu.TryRLock() {
+		return true
+	}
+	s.execMu.RUnlock()
+	return false
+}
+
+// lockExec takes execMu for an exec, unless cancel is closed or the
+// client goes away first
+func (s *Session) lockExec(cancel <-chan struct{}) error {
+	locked := make(chan struct{})
+	go func() {
+		s.execMu.Lock()
+		close(locked)
+	}()
+
+	var err error
+	select {
+	case <-locked:
+		return nil
+	case <-s.done:
+		err = errClientGone
+	case <-cancel:
+		err = errCanceled
+	}
+	go func() {
+		<-locked
+		s.execMu.Unlock()
+	}()
+	return err
+}
+
+// run sends command with its output going to sink and waits until the
+// client has answered, the client is gone or cancel is closed
+func (s *Session) run(command string, sink *responseSink, cancel <-chan struct{}) error {
+	if path, ok := s.fileRequest(command); ok {
+		return s.requestFile(transfers.add(s, download, path, true), sink, cancel)
+	}
+	return s.runPayload(func(w io.Writer) error {
+		return protocol.Write(w, protocol.Text(command))
+	}, sink, cancel)
+}
+
+// runPayload is run for requests of more than one line
+func (s *Session) runPayload(write func(w io.Writer) error, sink *responseSink, cancel <-chan struct{}) error {
+	// Only one caller at a time can own the output of the main connection
+	if !s.multiplexed() {
+		if err := s.lockExec(cancel); err != nil {
+			return err
+		}
+		defer s.execMu.Unlock()
+		defer s.sink.CompareAndSwap(sink, nil)
+	}
+
+	// The client still answers a transfer canceled halfway, as failed
+	err := s.sendPayloadTo(write, sink)
+	if err != nil && !errors.Is(err, errTransferCanceled) {
+		return err
+	}
+
+	select {
+	case <-sink.done:
+		return err
+	case <-s.done:
+		return errClientGone
+	case <-cancel:
+		return errCanceled
+	}
+}
+
+// multiplexed reports whether every command gets its own stream
+func (s *Session) multiplexed() bool {
+	_, ok := s.conn.(network.StreamOpener)
+	return ok
+}
+
+// close stops the session's goroutines and closes the connection
+func (s *Session) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.conn.Close()
+		s.transcript.close()
+		// No answers come anymore
+		for s.console.Load() > 0 {
+			s.consoleAnswered()
+		}
+	})
+}
+
+// identifiers are the names a session can be selected by: its number,
+// address and host, and the client's ID, name, host name and tags (as
+// "tag:<tag>")
+func (s *Session) identifiers() []string {
+	ids := []string{strconv.Itoa(s.ID), s.addr}
+	if host, _, err := net.SplitHostPort(s.addr); err == nil {
+		ids = append(ids, host)
+	}
+	for _, id := range []string{s.info.ID, s.info.Name, s.info.Hostname} {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	for _, tag := range s.info.Tags {
+		ids = append(ids, "tag:"+tag)
+	}
+	return ids
+}
+
+// name is the client's display name, or its address for older clients
+func (s *Session) name() string {
+	if s.info.Name != "" {
+		return s.info.Name
+	}
+	return s.addr
+}
+
+func (s *Session) String() string {
+	if s.info.Name != "" {
+		return fmt.Sprintf("#%d %s (%s)", s.ID, s.info.Name, s.addr)
+	}
+	return fmt.Sprintf("#%d (%s)", s.ID, s.addr)
+}
+
+// sessionRegistry tracks all connected clients and which one the console
+// is currently talking to.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[int]*Session
+	known    map[string]*knownClient // client ID -> what it had last time
+	nextID   int
+	current  int
+}
+
+// knownClient is kept for a client ID after its session ends, so that a
+// reconnecting machine gets its session number, metrics and limits back
+type knownClient struct {
+	id      int
+	metrics *metricsRing
+	limits  clientLimits
+	left    time.Time // when its last session ended, zero while connected
+}
+
+// maxKnownClients is how many client IDs are remembered; the ones gone
+// longest are forgotten first
+const maxKnownClients = 1024
+
+var sessions = &sessionRegistry{
+	sessions: make(map[int]*Session),
+	known:    make(map[string]*knownClient),
+}
+
+// add registers a new session. A client whose ID was seen before keeps
+// its old session number, even from another address. The ID is only what
+// the client says, so while a session with it is connected another client
+// with the same one, such as a cloned machine, gets a number of its own.
+func (r *sessionRegistry) add(conn net.Conn, info protocol.ClientInfo, compression protocol.Compression) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &Session{
+		conn:        conn,
+		addr:        conn.RemoteAddr().String(),
+		connectedAt: time.Now(),
+		info:        info,
+		compression: compression,
+		done:        make(chan struct{}),
+	}
+	s.touch()
+
+	k, ok := r.known[info.ID]
+	if ok && info.ID != "" && r.sessions[k.id] == nil {
+		s.ID = k.id
+		s.metrics = k.metrics
+		s.limits = k.limits
+		k.left = time.Time{}
+	} else {
+		r.nextID++
+		s.ID = r.nextID
+		s.metrics = newMetricsRing(*metricsHistory)
+		s.limits = newClientLimits(cfg().Limits)
+		if ok && info.ID != "" {
+			log.Printf("Client ID %q of %s is in use by %s, giving it session #%d", info.ID, s.addr, r.sessions[k.id], s.ID)
+		} else if info.ID != "" {
+			r.known[info.ID] = &knownClient{id: s.ID, metrics: s.metrics, limits: s.limits}
+			r.forgetOldest()
+		}
+	}
+
+	s.transcript = openTranscript(s)
+	r.sessions[s.ID] = s
+	if r.current == 0 {
+		r.current = s.ID
+	}
+	return s
+}
+
+func (r *sessionRegistry) remove(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sessions[s.ID] != s {
+		return
+	}
+	delete(r.sessions, s.ID)
+	if k := r.known[s.info.ID]; k != nil && k.id == s.ID {
+		k.left = time.Now()
+	}
+	if r.current == s.ID {
+		r.current = 0
+		// Fall back to the oldest remaining session
+		for id := range r.sessions {
+			if r.current == 0 || id < r.current {
+				r.current = id
+			}
+		}
+	}
+}
+
+// forgetOldest drops the client gone longest once more than
+// maxKnownClients are known. Connected clients are kept.
+func (r *sessionRegistry) forgetOldest() {
+	if len(r.known) <= maxKnownClients {
+		return
+	}
+	var oldest string
+	for id, k := range r.known {
+		if !k.left.IsZero() && (oldest == "" || k.left.Before(r.known[oldest].left)) {
+			oldest = id
+		}
+	}
+	if oldest != "" {
+		delete(r.known, oldest)
+	}
+}
+
+func (r *sessionRegistry) get(id int) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+// active returns the session console commands are sent to, or nil
+func (r *sessionRegistry) active() *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[r.current]
+}
+
+func (r *sessionRegistry) setActive(id int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sessions[id]; !ok {
+		return false
+	}
+	r.current = id
+	return true
+}
+
+// list returns all sessions ordered by ID
+func (r *sessionRegistry) list() []*Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// find returns the session selected by number or any of its identifiers,
+// or the active session for an empty selector
+func (r *sessionRegistry) find(selector string) *Session {
+	if selector == "" {
+		return r.active()
+	}
+	if id, err := strconv.Atoi(selector); err == nil {
+		if s := r.get(id); s != nil {
+			return s
+		}
+	}
+	for _, s := range r.list() {
+		for _, name := range s.identifiers() {
+			if name == selector {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+func (r *sessionRegistry) activeID() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
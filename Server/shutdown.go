@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gofrpprotocol"
+)
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", time.Minute, "How long shutdown waits for file transfers in progress")
+
+// serverCtx ends when the server starts shutting down; its cause is the
+// shutdown command or the signal that asked for it
+var serverCtx, stopServer = context.WithCancelCause(context.Background())
+
+var errShuttingDown = errors.New("the server is shutting down")
+
+// activeTransfers counts files, screenshots and uploads on their way
+// between the server and clients, which a shutdown waits for
+var activeTransfers atomic.Int64
+
+// watchShutdownSignals stops the server on SIGINT or SIGTERM. A second
+// signal gives up on the transfers still in progress and exits at once.
+func watchShutdownSignals() {
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-sigChan
+	log.Printf("%v received, shutting down server...", sig)
+	audit.record(AuditEntry{Source: "signal", Action: "shutdown", Command: sig.String()})
+	stopServer(fmt.Errorf("%v received", sig))
+
+	sig = <-sigChan
+	log.Printf("%v received again, exiting without waiting for transfers", sig)
+	partialFiles.abort()
+	audit.close()
+	os.Exit(1)
+}
+
+// gracefulShutdown stops the server and returns its exit status: no new
+// connections are accepted, transfers in progress get up to the shutdown
+// timeout to finish, then every client is told and disconnected. Clients
+// reconnect once the server is back. Paused and queued transfers are
+// canceled rather than waited for. Files cut off half written are
+// removed, and the status is 1 if transfers in progress had to be given
+// up on.
+func gracefulShutdown() int {
+	log.Printf("Shutting down server (%v)...", context.Cause(serverCtx))
+	listeners.closeAll()
+	forwards.apply(nil)
+	if n := transfers.abortIdle(); n > 0 {
+		log.Printf("Canceled %d paused or queued transfer(s)", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg().ShutdownTimeout)
+	defer cancel()
+	drained := waitForTransfers(ctx)
+
+	// A session still busy sending an upload cannot take the notice in
+	// time; closing it is notice enough
+	notified := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, s := range sessions.list() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.send(protocol.ServerShutdown{})
+			}()
+		}
+		wg.Wait()
+		close(notified)
+	}()
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+	}
+	for _, s := range sessions.list() {
+		s.close()
+	}
+	status := 0
+	if !drained {
+		partialFiles.abort()
+		status = 1
+	}
+	control.close()
+	api.close()
+	audit.close()
+	log.Println("Server stopped")
+	return status
+}
+
+// waitForTransfers waits until no transfer is in progress, or ctx ends.
+// It reports whether the transfers finished.
+func waitForTransfers(ctx context.Context) bool {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	var last int64
+	for n := activeTransfers.Load(); n > 0; n = activeTransfers.Load() {
+		if n != last {
+			log.Printf("Waiting for %d transfer(s) to finish...", n)
+			last = n
+		}
+		select {
+		case <-ctx.Done():
+			log.Printf("Giving up on %d transfer(s) still in progress", n)
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// partialSet tracks output files while they are written, under a ".part"
+// name so that a file cut off by a shutdown is never taken for a whole one
+type partialSet struct {
+	mu      sync.Mutex
+	files   map[*os.File]bool
+	aborted bool
+}
+
+var partialFiles = &partialSet{files: map[*os.File]bool{}}
+
+// create starts writing the file that will be name once finished
+func (ps *partialSet) create(name string) (*os.File, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.aborted {
+		return nil, errShuttingDown
+	}
+	f, err := os.Create(name + ".part")
+	if err != nil {
+		return nil, err
+	}
+	ps.files[f] = true
+	return f, nil
+}
+
+// finish closes f and renames it to name, or removes it if writing it
+// failed with err
+func (ps *partialSet) finish(f *os.File, name string, err error) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if !ps.files[f] {
+		// abort got to it first
+		return errShuttingDown
+	}
+	delete(ps.files, f)
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// abort removes the files still being written and refuses new ones
+func (ps *partialSet) abort() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.aborted = true
+	for f := range ps.files {
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			log.Printf("Failed to remove partial file: %v", err)
+		} else {
+			log.Printf("Removed partial file %s", f.Name())
+		}
+		delete(ps.files, f)
+	}
+}
+
+// handleDisconnectCommand implements the console "disconnect" command: it
+// drops a session without stopping the client, which reconnects later
+func handleDisconnectCommand(fields []string) {
+	if len(fields) > 2 {
+		fmt.Println("Usage: disconnect [session id | client name | client id]")
+		return
+	}
+	s := sessions.active()
+	if len(fields) == 2 {
+		s = sessions.find(fields[1])
+	}
+	if s == nil {
+		fmt.Println("No such session")
+		return
+	}
+
+	audit.record(AuditEntry{Operator: consoleOperator(), Source: "console", Action: "disconnect", Status: "done"}.withSession(s))
+	s.send(protocol.Disconnect{})
+	s.close()
+	fmt.Printf("Disconnected %s, it will reconnect later\n", s)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var transcriptDir = flag.String("transcripts", "", "Directory to record session transcripts in, one asciicast file per connection (empty disables)")
+
+// Transcripts are asciicast v2 files (https://docs.asciinema.org/manual/asciicast/v2/),
+// so they play in asciinema as well as with the replay command: a header
+// line, then one [seconds, "i" or "o", data] event per line. Commands are
+// recorded as input and echoed as output, the client's lines as output.
+const (
+	transcriptWidth  = 120
+	transcriptHeight = 40
+)
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+
+	// IdleTimeLimit caps the pauses when the transcript is played, in seconds
+	IdleTimeLimit float64 `json:"idle_time_limit,omitempty"`
+}
+
+// transcript records one session. A nil transcript records nothing.
+type transcript struct {
+	mu    sync.Mutex
+	file  *os.File
+	start time.Time
+}
+
+// openTranscript starts the transcript of s in a directory of its own per
+// client, or returns nil if transcripts are disabled
+func openTranscript(s *Session) *transcript {
+	root := cfg().Output.Transcripts
+	if root == "" {
+		return nil
+	}
+
+	dir := filepath.Join(root, transcriptClientDir(s))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("Failed to create transcript directory: %v", err)
+		return nil
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%s-%d.cast", s.connectedAt.Format("20060102-150405"), s.ID))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("Failed to open transcript: %v", err)
+		return nil
+	}
+
+	header, _ := json.Marshal(castHeader{
+		Version:   2,
+		Width:     transcriptWidth,
+		Height:    transcriptHeight,
+		Timestamp: s.connectedAt.Unix(),
+		Title:     s.String(),
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	})
+	if _, err := f.Write(append(header, '\n')); err != nil {
+		log.Printf("Failed to write transcript: %v", err)
+		f.Close()
+		return nil
+	}
+	return &transcript{file: f, start: s.connectedAt}
+}
+
+// transcriptClientDir names the directory of a client: its name, else its
+// ID, else its host, with anything unsafe in a file name replaced
+func transcriptClientDir(s *Session) string {
+	key := s.info.Name
+	if key == "" {
+		key = s.info.ID
+	}
+	if key == "" {
+		key = s.addr
+		if host, _, err := net.SplitHostPort(s.addr); err == nil {
+			key = host
+		}
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+func (t *transcript) event(kind, data string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return
+	}
+	line, _ := json.Marshal([]any{time.Since(t.start).Seconds(), kind, data})
+	if _, err := t.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write transcript: %v", err)
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// command records a command sent to the client and who sent it
+func (t *transcript) command(source, operator, command string) {
+	t.event("i", command+"\n")
+	t.event("o", fmt.Sprintf("[%s %s]$ %s\r\n", source, operator, command))
+}
+
+// output records a line the client sent
+func (t *transcript) output(line string) {
+	t.event("o", line+"\r\n")
+}
+
+func (t *transcript) close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// replayIdleLimit caps the pauses of a replay, like asciinema's
+// idle_time_limit, unless the transcript sets its own
+const replayIdleLimit = 2 * time.Second
+
+// replaying is closed to stop the replay running on the console, if any
+var (
+	replayMu  sync.Mutex
+	replaying chan struct{}
+)
+
+// replayTranscript plays a transcript on the console with its original
+// timing, sped up by speed, until it ends or stop is closed. A relative
+// name is also looked for in the transcripts directory.
+func replayTranscript(name string, speed float64, stop <-chan struct{}) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) && !filepath.IsAbs(name) && cfg().Output.Transcripts != "" {
+		f, err = os.Open(filepath.Join(cfg().Output.Transcripts, name))
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		return fmt.Errorf("%s is empty", name)
+	}
+	var header castHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 2 {
+		return fmt.Errorf("%s is not an asciicast v2 file", name)
+	}
+	idleLimit := replayIdleLimit
+	if header.IdleTimeLimit > 0 {
+		idleLimit = time.Duration(header.IdleTimeLimit * float64(time.Second))
+	}
+
+	fmt.Printf("\n--- Replaying %s, recorded %s (\"replay stop\" or Ctrl-C stops) ---\n", header.Title, time.Unix(header.Timestamp, 0).Format("2006-01-02 15:04:05"))
+	var last float64
+	for scanner.Scan() {
+		var ev []any
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil || len(ev) != 3 {
+			continue
+		}
+		at, _ := ev[0].(float64)
+		kind, _ := ev[1].(string)
+		data, _ := ev[2].(string)
+		if kind != "o" {
+			continue
+		}
+		wait := min(time.Duration((at-last)*float64(time.Second)), idleLimit)
+		last = at
+		if wait > 0 {
+			select {
+			case <-time.After(time.Duration(float64(wait) / speed)):
+			case <-stop:
+				fmt.Println("\n--- Replay stopped ---")
+				return nil
+			}
+		}
+		fmt.Print(data)
+	}
+	fmt.Println("--- End of replay ---")
+	return scanner.Err()
+}
+
+// stopReplay stops the replay running on the console and reports whether
+// there was one
+func stopReplay() bool {
+	replayMu.Lock()
+	defer replayMu.Unlock()
+	if replaying == nil {
+		return false
+	}
+	close(replaying)
+	replaying = nil
+	return true
+}
+
+// handleReplayCommand implements the console "replay" command. The replay
+// runs in the background, the console takes commands meanwhile.
+func handleReplayCommand(fields []string) {
+	if len(fields) == 2 && fields[1] == "stop" {
+		if !stopReplay() {
+			fmt.Println("No replay is running")
+		}
+		return
+	}
+	if len(fields) < 2 || len(fields) > 3 {
+		fmt.Println("Usage: replay <transcript file> [speed], or replay stop")
+		return
+	}
+	speed := 1.0
+	if len(fields) == 3 {
+		var err error
+		if speed, err = strconv.ParseFloat(fields[2], 64); err != nil || speed <= 0 {
+			fmt.Println("Speed must be a positive number, e.g. 2 for twice as fast")
+			return
+		}
+	}
+
+	replayMu.Lock()
+	defer replayMu.Unlock()
+	if replaying != nil {
+		fmt.Println(`A replay is running already, "replay stop" stops it`)
+		return
+	}
+	stop := make(chan struct{})
+	replaying = stop
+	go func() {
+		if err := replayTranscript(fields[1], speed, stop); err != nil {
+			fmt.Printf("Failed to replay: %v\n", err)
+		}
+		replayMu.Lock()
+		if replaying == stop {
+			replaying = nil
+		}
+		replayMu.Unlock()
+		fmt.Print(cfg().Console.Prompt)
+	}()
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gofrpprotocol"
+)
+
+var maxTransfers = flag.Int("max-transfers", 2, "Transfers that run at once per client, more wait in a queue (0 for no limit)")
+
+// Directions of a transfer, seen from the server
+const (
+	download = "download" // a file the client sends, with send
+	upload   = "upload"   // an upload or update sent to the client
+)
+
+// States of a transfer
+const (
+	transferQueued  = "queued"
+	transferRunning = "running"
+	transferPaused  = "paused"
+)
+
+var (
+	errTransferCanceled = errors.New("transfer canceled")
+	errUploadPaused     = errors.New("a paused upload holds the connection")
+)
+
+// transfer is a file on its way between the server and a client, or
+// waiting in the queue for its turn. Clients without the "transfers"
+// capability send files as soon as they are asked; those are listed, but
+// cannot be queued, paused or canceled.
+type transfer struct {
+	ID        int64
+	session   *Session
+	direction string
+	tracked   bool // queued here, and known to the client by ID
+
+	mu        sync.Mutex
+	file      string
+	size      int64 // 0 until known
+	done      int64
+	state     string
+	canceled  bool
+	started   time.Time
+	pausedAt  time.Time
+	pausedFor time.Duration // earlier pauses, left out of the speed
+	changed   chan struct{} // closed and replaced on every change of state
+}
+
+// transferManager holds the transfers in progress or queued, and starts
+// queued ones as the transfers before them end
+type transferManager struct {
+	mu        sync.Mutex
+	nextID    int64
+	transfers map[int64]*transfer
+}
+
+var transfers = &transferManager{transfers: make(map[int64]*transfer)}
+
+// add registers a transfer of file for s. A tracked transfer waits for its
+// turn in wait, others run right away.
+func (tm *transferManager) add(s *Session, direction, file string, tracked bool) *transfer {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.nextID++
+	t := &transfer{
+		ID:        tm.nextID,
+		session:   s,
+		direction: direction,
+		tracked:   tracked,
+		file:      file,
+		state:     transferQueued,
+		changed:   make(chan struct{}),
+	}
+	tm.transfers[t.ID] = t
+	if tracked {
+		tm.schedule()
+	} else {
+		t.mu.Lock()
+		t.setState(transferRunning)
+		t.mu.Unlock()
+	}
+	return t
+}
+
+// list returns the transfers ordered by ID
+func (tm *transferManager) list() []*transfer {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.sorted()
+}
+
+// sorted is list with tm.mu held
+func (tm *transferManager) sorted() []*transfer {
+	list := make([]*transfer, 0, len(tm.transfers))
+	for _, t := range tm.transfers {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (tm *transferManager) get(id int64) *transfer {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.transfers[id]
+}
+
+// schedule starts the queued transfers whose client has room for them,
+// oldest first. tm.mu must be held.
+func (tm *transferManager) schedule() {
+	for _, t := range tm.sorted() {
+		if t.getState() == transferQueued && tm.hasRoom(t) {
+			t.mu.Lock()
+			t.setState(transferRunning)
+			t.mu.Unlock()
+		}
+	}
+}
+
+// hasRoom reports whether t can start next to the transfers its client
+// runs already. tm.mu must be held.
+func (tm *transferManager) hasRoom(t *transfer) bool {
+	running := 0
+	for _, other := range tm.transfers {
+		if other.session != t.session || other.getState() == transferQueued {
+			continue
+		}
+		// Without streams, the files of a client and its answers share
+		// one connection, and go one at a time
+		if !t.session.multiplexed() {
+			return false
+		}
+		running++
+	}
+	limit := cfg().MaxTransfers
+	return limit <= 0 || running < limit
+}
+
+// finish removes t once it ended, for err if it failed, and starts the
+// transfers queued behind it. Finishing a transfer again does nothing.
+func (tm *transferManager) finish(t *transfer, err error) {
+	if t == nil {
+		return
+	}
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.transfers[t.ID] != t {
+		return
+	}
+	delete(tm.transfers, t.ID)
+
+	t.mu.Lock()
+	canceled := t.canceled
+	t.notify()
+	t.mu.Unlock()
+	// What a canceled transfer fails with is only the cancel reaching it
+	if err != nil && !canceled && !errors.Is(err, errTransferCanceled) {
+		log.Printf("Transfer %d (%s %s, %s) failed: %v", t.ID, t.direction, t.name(), t.session, err)
+	}
+	tm.schedule()
+}
+
+// dropSession ends the transfers of a session that is gone
+func (tm *transferManager) dropSession(s *Session) {
+	for _, t := range tm.list() {
+		if t.session == s {
+			tm.finish(t, errClientGone)
+		}
+	}
+}
+
+// abortIdle cancels the transfers that are paused or wait in the queue,
+// which a shutdown does not wait for, and returns how many it canceled
+func (tm *transferManager) abortIdle() int {
+	n := 0
+	for _, t := range tm.list() {
+		if state := t.getState(); state != transferPaused && state != transferQueued {
+			continue
+		}
+		if err := t.control(protocol.TransferCancel); err != nil {
+			log.Printf("Failed to cancel transfer %d: %v", t.ID, err)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// pausedUpload returns the paused upload that holds the main connection
+// of s, if there is one
+func (tm *transferManager) pausedUpload(s *Session) *transfer {
+	if s.multiplexed() {
+		return nil
+	}
+	for _, t := range tm.list() {
+		if t.session == s && t.direction == upload && t.getState() == transferPaused {
+			return t
+		}
+	}
+	return nil
+}
+
+// setState changes the state and wakes up whoever waits on t. t.mu must
+// be held.
+func (t *transfer) setState(state string) {
+	now := time.Now()
+	switch {
+	case state == transferRunning && t.started.IsZero():
+		t.started = now
+	case state == transferRunning && t.state == transferPaused:
+		t.pausedFor += now.Sub(t.pausedAt)
+	case state == transferPaused:
+		t.pausedAt = now
+	}
+	t.state = state
+	t.notify()
+}
+
+// notify wakes up whoever waits on t. t.mu must be held.
+func (t *transfer) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+func (t *transfer) getState() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+func (t *transfer) name() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.file
+}
+
+// begin records the file as the client or the server starts sending it
+func (t *transfer) begin(file string, size int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.file, t.size = file, size
+}
+
+// progress counts n more bytes of the file
+func (t *transfer) progress(n int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done += int64(n)
+}
+
+// wait blocks until t may start. It ends t if it is canceled, its client
+// goes away or cancel is closed before that.
+func (t *transfer) wait(cancel <-chan struct{}) error {
+	for {
+		t.mu.Lock()
+		state, canceled, changed := t.state, t.canceled, t.changed
+		t.mu.Unlock()
+		if canceled {
+			transfers.finish(t, errTransferCanceled)
+			return errTransferCanceled
+		}
+		if state != transferQueued {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-t.session.done:
+			transfers.finish(t, errClientGone)
+			return errClientGone
+		case <-cancel:
+			transfers.finish(t, errCanceled)
+			return errCanceled
+		}
+	}
+}
+
+// checkpoint is called by the server between the chunks it sends. It
+// blocks while t is paused and reports whether t was canceled.
+func (t *transfer) checkpoint() error {
+	if t == nil {
+		return nil
+	}
+	for {
+		t.mu.Lock()
+		state, canceled, changed := t.state, t.canceled, t.changed
+		t.mu.Unlock()
+		if canceled {
+			return errTransferCanceled
+		}
+		if state != transferPaused {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-t.session.done:
+			return errClientGone
+		}
+	}
+}
+
+// control pauses, resumes or cancels t, as asked on the console
+func (t *transfer) control(action string) error {
+	s := t.session
+	t.mu.Lock()
+	state := t.state
+	t.mu.Unlock()
+
+	switch {
+	case t.direction == download && !t.tracked:
+		return fmt.Errorf("client version %s cannot pause or cancel the files it sends, update it", describeVersion(s.info.Version))
+	case action == protocol.TransferPause && state != transferRunning,
+		action == protocol.TransferResume && state != transferPaused:
+		return fmt.Errorf("transfer %d is %s", t.ID, state)
+	case action == protocol.TransferPause && t.direction == upload && !s.multiplexed() && !s.interleaves():
+		return fmt.Errorf("client version %s cannot take a pause in the middle of an upload, cancel it or update the client", describeVersion(s.info.Version))
+	}
+
+	// The client pauses the files it sends itself
+	if t.direction == download && state != transferQueued {
+		if err := s.send(protocol.Transfer{Action: action, ID: t.ID}); err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch action {
+	case protocol.TransferPause:
+		t.setState(transferPaused)
+	case protocol.TransferResume:
+		t.setState(transferRunning)
+	case protocol.TransferCancel:
+		t.canceled = true
+		t.notify()
+	}
+	return nil
+}
+
+// transferStatus is a transfer as the transfers command lists it
+type transferStatus struct {
+	state    string
+	progress string
+	speed    string
+	eta      string
+}
+
+func (t *transfer) status() transferStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := transferStatus{state: t.state, progress: "-", speed: "-", eta: "-"}
+	if t.canceled {
+		st.state = "canceling"
+	}
+	if t.started.IsZero() {
+		return st
+	}
+
+	st.progress = protocol.FormatBytes(float64(t.done))
+	if t.size > 0 {
+		st.progress = fmt.Sprintf("%d%% of %s", t.done*100/t.size, protocol.FormatBytes(float64(t.size)))
+	}
+	active := time.Since(t.started) - t.pausedFor
+	if t.state == transferPaused {
+		active -= time.Since(t.pausedAt)
+	}
+	if active <= 0 || t.done == 0 {
+		return st
+	}
+	speed := float64(t.done) / active.Seconds()
+	st.speed = protocol.FormatBytes(speed) + "/s"
+	if t.size > t.done && t.state == transferRunning {
+		st.eta = time.Duration(float64(t.size-t.done) / speed * float64(time.Second)).Round(time.Second).String()
+	}
+	return st
+}
+
+// interleaves reports whether the client reads frames such as heartbeats
+// in the middle of an upload, so they need not wait for its end
+func (s *Session) interleaves() bool {
+	return slices.Contains(s.capabilities(), "transfers")
+}
+
+// fileRequest returns the path of a send command for a client that takes
+// it as a transfer of the queue
+func (s *Session) fileRequest(command string) (string, bool) {
+	if commandVerb(command) != "send" || !s.interleaves() {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(command, "send")), true
+}
+
+// requestFile asks the client for t's file once t gets its turn. Its
+// output goes to sink, or to the console if sink is nil.
+func (s *Session) requestFile(t *transfer, sink *responseSink, cancel <-chan struct{}) error {
+	if err := t.wait(cancel); err != nil {
+		return err
+	}
+	write := func(w io.Writer) error {
+		return protocol.Write(w, protocol.SendFile{ID: t.ID, Path: t.name()})
+	}
+
+	var err error
+	if sink == nil {
+		err = s.sendPayloadTo(write, nil)
+	} else {
+		err = s.runPayload(write, sink, cancel)
+	}
+	if err != nil {
+		transfers.finish(t, err)
+	}
+	return err
+}
+
+// printTransfers implements the console "transfers" command
+func printTransfers() {
+	list := transfers.list()
+	if len(list) == 0 {
+		fmt.Println("No transfers")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCLIENT\tDIRECTION\tSTATE\tFILE\tPROGRESS\tSPEED\tETA")
+	for _, t := range list {
+		st := t.status()
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			t.ID, t.session.name(), t.direction, st.state, t.name(), st.progress, st.speed, st.eta)
+	}
+	w.Flush()
+}
+
+// handleTransferCommand implements the console "pause", "resume" and
+// "cancel" commands
+func handleTransferCommand(fields []string) {
+	action := fields[0]
+	if len(fields) != 2 {
+		fmt.Printf("Usage: %s <transfer id>, see \"transfers\"\n", action)
+		return
+	}
+	id, err := strconv.ParseInt(fields[1], 10, 64)
+	t := transfers.get(id)
+	if err != nil || t == nil {
+		fmt.Printf("No such transfer: %s\n", fields[1])
+		return
+	}
+
+	entry := AuditEntry{Operator: consoleOperator(), Source: "console", Action: "transfer_" + action, Command: fmt.Sprintf("%s %d (%s %s)", action, t.ID, t.direction, t.name()), Status: "done"}.withSession(t.session)
+	if err := t.control(action); err != nil {
+		fmt.Println(err)
+		entry.Status, entry.Error = "failed", err.Error()
+		audit.record(entry)
+		return
+	}
+	audit.record(entry)
+
+	switch action {
+	case protocol.TransferPause:
+		fmt.Printf("Paused transfer %d, \"resume %d\" to go on\n", t.ID, t.ID)
+	case protocol.TransferResume:
+		fmt.Printf("Resumed transfer %d\n", t.ID)
+	case protocol.TransferCancel:
+		fmt.Printf("Canceled transfer %d\n", t.ID)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"gofrpprotocol"
+)
+
+var updatesDir = flag.String("updates", "", "Directory of signed client binaries for the update command")
+
+// Client binaries in the updates directory are named
+// gofrpclient-<goos>-<goarch>, with .exe on Windows, and signed with
+// "gofrpserver sign" into a .sig file next to them. The signature covers
+// the platform and the version as well as the SHA-256 of the binary, so a
+// binary cannot be pushed to a platform it was not signed for, nor to a
+// client that runs the same or a newer version.
+//
+// A .sig file has a "<key>: <value>" line each for the version, its
+// signature and, if signed with -legacy, the signature for clients before
+// the "update-version" capability.
+type updateSignature struct {
+	Version   string
+	Signature []byte
+	Legacy    []byte
+}
+
+func (us updateSignature) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "version: %s\n", us.Version)
+	fmt.Fprintf(&b, "signature: %s\n", base64.StdEncoding.EncodeToString(us.Signature))
+	if us.Legacy != nil {
+		fmt.Fprintf(&b, "legacy: %s\n", base64.StdEncoding.EncodeToString(us.Legacy))
+	}
+	return b.String()
+}
+
+func readUpdateSignature(path string) (updateSignature, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return updateSignature{}, err
+	}
+	var us updateSignature
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), ":")
+		value = strings.TrimSpace(value)
+		switch key {
+		case "version":
+			us.Version = value
+		case "signature":
+			us.Signature, err = base64.StdEncoding.DecodeString(value)
+		case "legacy":
+			us.Legacy, err = base64.StdEncoding.DecodeString(value)
+		}
+		if err != nil {
+			return updateSignature{}, fmt.Errorf("%s: bad %s: %v", path, key, err)
+		}
+	}
+	if us.Version == "" || us.Signature == nil {
+		return updateSignature{}, fmt.Errorf("%s has no version or signature, sign the binary again", path)
+	}
+	return us, nil
+}
+
+// updateBinaryName is the file name of the client binary for a platform
+func updateBinaryName(goos, goarch string) string {
+	name := fmt.Sprintf("gofrpclient-%s-%s", goos, goarch)
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// pendingUpdates are the versions clients had when they were sent an
+// update, by client ID, to report the new one when they are back
+var pendingUpdates sync.Map
+
+// handleUpdateCommand implements the console "update" command: it sends
+// the client the binary for its platform. The client checks the
+// signature, restarts and reconnects with its new version.
+func handleUpdateCommand(fields []string) {
+	if len(fields) > 2 {
+		fmt.Println("Usage: update [session id | client name | client id]")
+		return
+	}
+	s := sessions.active()
+	if len(fields) == 2 {
+		s = sessions.find(fields[1])
+	}
+	if s == nil {
+		fmt.Println("No such session")
+		return
+	}
+	entry := AuditEntry{Operator: consoleOperator(), Source: "console", Action: "update", Command: "update"}.withSession(s)
+	if !cfg().commandAllowed(s, "update") {
+		fmt.Printf("Command %q is not allowed for client %s by policy\n", "update", s)
+		entry.Status = "denied"
+		audit.record(entry)
+		return
+	}
+	if err := s.supports("update"); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// The update may wait in the transfer queue, the console does not
+	go func() {
+		file, err := sendUpdate(s)
+		entry.Status = "sent"
+		if err != nil {
+			fmt.Printf("\n--- Failed to update %s: %v ---\n", s, err)
+			entry.Status, entry.Error = "failed", err.Error()
+		} else {
+			entry.Bytes, entry.Files = file.Size, []AuditFile{file}
+			fmt.Printf("\n--- Sent %s (%d bytes) to %s ---\n", file.Name, file.Size, s)
+			s.transcript.command("console", consoleOperator(), "update "+file.Name)
+		}
+		audit.record(entry)
+	}()
+}
+
+// sendUpdate sends s the signed binary for its platform
+func sendUpdate(s *Session) (AuditFile, error) {
+	dir := cfg().Updates
+	if dir == "" {
+		return AuditFile{}, fmt.Errorf("no updates directory configured (-updates)")
+	}
+	if s.info.OS == "" || s.info.Arch == "" {
+		return AuditFile{}, fmt.Errorf("the client did not say which platform it runs on")
+	}
+	path := filepath.Join(dir, updateBinaryName(s.info.OS, s.info.Arch))
+	sig, err := readUpdateSignature(path + ".sig")
+	if err != nil {
+		return AuditFile{}, fmt.Errorf("no signed binary for %s/%s: %v", s.info.OS, s.info.Arch, err)
+	}
+	start, err := updateStart(s, sig)
+	if err != nil {
+		return AuditFile{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return AuditFile{}, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return AuditFile{}, err
+	}
+	start.Size = stat.Size()
+	t := transfers.add(s, upload, filepath.Base(path), true)
+	if t.getState() == transferQueued {
+		fmt.Printf("\n--- Update queued as transfer %d behind the transfers %s runs, see \"transfers\" ---\n", t.ID, s)
+	}
+	if err := t.wait(nil); err != nil {
+		return AuditFile{}, err
+	}
+	err = s.sendPayloadTo(func(w io.Writer) error {
+		return writeChunked(w, t, start, protocol.UpdateEnd{}, f)
+	}, nil)
+	transfers.finish(t, err)
+	if err != nil {
+		return AuditFile{}, err
+	}
+	if s.info.ID != "" {
+		pendingUpdates.Store(s.info.ID, s.info.Version)
+	}
+	log.Printf("Update %s sent to %s", path, s)
+	return fileDigest(path), nil
+}
+
+// updateStart is the header of the update signed with sig for s. Clients
+// that check the version get it and are refused one that is not newer;
+// older ones only get the legacy signature, if the binary has one.
+func updateStart(s *Session, sig updateSignature) (protocol.UpdateStart, error) {
+	if !slices.Contains(s.capabilities(), "update-version") {
+		if sig.Legacy == nil {
+			return protocol.UpdateStart{}, fmt.Errorf("%s does not check update versions, sign the binary with -legacy to update it", s)
+		}
+		return protocol.UpdateStart{Signature: sig.Legacy}, nil
+	}
+	c, err := protocol.CompareVersions(sig.Version, s.info.Version)
+	if err != nil {
+		return protocol.UpdateStart{}, err
+	}
+	if c <= 0 {
+		return protocol.UpdateStart{}, fmt.Errorf("%s runs version %s already, the update is %s", s, s.info.Version, sig.Version)
+	}
+	return protocol.UpdateStart{Signature: sig.Signature, Version: sig.Version}, nil
+}
+
+// reportUpdate tells the console when a client that was sent an update
+// is back, and with which version
+func reportUpdate(s *Session) {
+	if s.info.ID == "" {
+		return
+	}
+	previous, ok := pendingUpdates.LoadAndDelete(s.info.ID)
+	if !ok {
+		return
+	}
+	switch {
+	case s.info.Version == "":
+		fmt.Printf("\n--- %s is back after the update but did not report a version ---\n", s)
+	case s.info.Version == previous:
+		fmt.Printf("\n--- %s is back with version %s: the update did not take or was rolled back ---\n", s, s.info.Version)
+	default:
+		fmt.Printf("\n--- %s updated from version %s to %s ---\n", s, previous, s.info.Version)
+	}
+	fmt.Print(cfg().Console.Prompt)
+}
+
+// runSign implements "gofrpserver sign": create the update signing key,
+// or sign client binaries with it
+func runSign(args []string) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyFile := fs.String("key", "update.key", "Private key file")
+	generate := fs.Bool("generate", false, "Create the private key file and print the public key for the clients' update_key")
+	version := fs.String("version", "", "Version the binaries report with -version, clients only take newer ones")
+	legacy := fs.Bool("legacy", false, "Also sign for clients that do not check the version, which take any binary signed for them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s sign -generate [-key FILE]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s sign [-key FILE] -version VERSION [-legacy] <updates dir>/gofrpclient-<goos>-<goarch>[.exe]...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *generate {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err == nil {
+			// O_EXCL: never overwrite a key clients already trust
+			var f *os.File
+			f, err = os.OpenFile(*keyFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err == nil {
+				_, err = fmt.Fprintln(f, base64.StdEncoding.EncodeToString(private))
+				f.Close()
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Private key written to %s, keep it off the server\n", *keyFile)
+		fmt.Printf("Public key for the clients' update_key:\n%s\n", base64.StdEncoding.EncodeToString(public))
+		return
+	}
+
+	if fs.NArg() == 0 || *version == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if _, err := protocol.CompareVersions(*version, *version); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	data, err := os.ReadFile(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	private, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(private) != ed25519.PrivateKeySize {
+		fmt.Fprintf(os.Stderr, "Error: %s is not an update signing key\n", *keyFile)
+		os.Exit(1)
+	}
+
+	for _, path := range fs.Args() {
+		goos, goarch, ok := parseUpdateBinaryName(filepath.Base(path))
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: %s is not named gofrpclient-<goos>-<goarch>[.exe]\n", path)
+			os.Exit(1)
+		}
+		sum := fileDigest(path)
+		if sum.SHA256 == "" {
+			fmt.Fprintf(os.Stderr, "Error: cannot read %s\n", path)
+			os.Exit(1)
+		}
+		raw, _ := hex.DecodeString(sum.SHA256)
+		sig := updateSignature{
+			Version:   *version,
+			Signature: ed25519.Sign(ed25519.PrivateKey(private), protocol.UpdateMessage(goos, goarch, *version, raw)),
+		}
+		if *legacy {
+			sig.Legacy = ed25519.Sign(ed25519.PrivateKey(private), protocol.UpdateMessage(goos, goarch, "", raw))
+		}
+		if err := os.WriteFile(path+".sig", []byte(sig.String()), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Signed %s as version %s for %s/%s (sha256 %s)\n", path, *version, goos, goarch, sum.SHA256)
+	}
+}
+
+// parseUpdateBinaryName is the reverse of updateBinaryName
+func parseUpdateBinaryName(name string) (goos, goarch string, ok bool) {
+	rest, ok := strings.CutPrefix(name, "gofrpclient-")
+	if !ok {
+		return "", "", false
+	}
+	goos, goarch, ok = strings.Cut(rest, "-")
+	if !ok || goarch == "" {
+		return "", "", false
+	}
+	if goos == "windows" {
+		if goarch, ok = strings.CutSuffix(goarch, ".exe"); !ok {
+			return "", "", false
+		}
+	}
+	return goos, goarch, updateBinaryName(goos, goarch) == name
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// webFiles is the browser console, served next to the API. It has no
+// access of its own: the page asks for an API token and sends it with
+// every request.
+//
+//go:embed web
+var webFiles embed.FS
+
+func webHandler() http.Handler {
+	sub, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServerFS(sub)
+}
@@ -0,0 +1,415 @@
+// GoFRP web console. Everything goes through the HTTP API with the token
+// the user signs in with; it is kept in sessionStorage only.
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+let token = sessionStorage.getItem("gofrp-token") || "";
+let current = null; // selected SessionInfo
+let cwd = "";
+
+// api calls the HTTP API and returns the parsed JSON, or the Response for
+// raw bodies. Errors are thrown with the server's message and status.
+async function api(method, path, body, raw) {
+  const opts = { method, headers: { Authorization: "Bearer " + token } };
+  if (body instanceof Blob) {
+    opts.body = body;
+  } else if (body !== undefined) {
+    opts.headers["Content-Type"] = "application/json";
+    opts.body = JSON.stringify(body);
+  }
+  const resp = await fetch("/api/v1" + path, opts);
+  if (resp.status === 401) {
+    signOut("Invalid token");
+    throw new Error("unauthorized");
+  }
+  if (!resp.ok) {
+    let message = resp.statusText;
+    try { message = (await resp.json()).error; } catch (e) { /* not JSON */ }
+    const err = new Error(message);
+    err.status = resp.status;
+    throw err;
+  }
+  if (raw) return resp;
+  return resp.status === 204 ? null : resp.json();
+}
+
+function el(tag, props, ...children) {
+  const e = document.createElement(tag);
+  Object.assign(e, props || {});
+  for (const c of children) e.append(c);
+  return e;
+}
+
+// ---- sign in ----
+
+function signOut(message) {
+  token = "";
+  sessionStorage.removeItem("gofrp-token");
+  $("app").classList.add("hidden");
+  $("login").classList.remove("hidden");
+  $("login-error").textContent = message || "";
+}
+
+$("login-form").addEventListener("submit", async (ev) => {
+  ev.preventDefault();
+  token = $("token").value;
+  try {
+    await api("GET", "/sessions");
+    sessionStorage.setItem("gofrp-token", token);
+    start();
+  } catch (e) {
+    $("login-error").textContent = e.message;
+  }
+});
+
+$("logout").addEventListener("click", () => signOut());
+
+// ---- sessions ----
+
+async function refreshSessions() {
+  let list;
+  try {
+    list = await api("GET", "/sessions");
+  } catch (e) {
+    return;
+  }
+  const ul = $("sessions");
+  ul.replaceChildren();
+  for (const s of list) {
+    const li = el("li", {},
+      el("strong", { textContent: "#" + s.id + " " + (s.name || s.address) }),
+      el("span", { className: "meta", textContent: s.address + (s.tags ? " [" + s.tags.join(", ") + "]" : "") }));
+    if (s.metrics) {
+      li.append(el("span", { className: "meta",
+        textContent: `cpu ${s.metrics.cpu.toFixed(0)}%  mem ${s.metrics.mem.toFixed(0)}%  disk ${s.metrics.disk.toFixed(0)}%` }));
+    }
+    if (current && sameClient(current, s)) {
+      li.classList.add("selected");
+      current = s;
+    }
+    li.addEventListener("click", () => selectSession(s));
+    ul.append(li);
+  }
+}
+
+function sameClient(a, b) {
+  return a.client_id ? a.client_id === b.client_id : a.id === b.id;
+}
+
+// selector is how API paths address the selected client; the client ID
+// keeps working when it reconnects
+function selector() {
+  return encodeURIComponent(current.client_id || String(current.id));
+}
+
+function selectSession(s) {
+  const changed = !current || !sameClient(current, s);
+  current = s;
+  $("empty").classList.add("hidden");
+  $("forwards-panel").classList.add("hidden");
+  $("client").classList.remove("hidden");
+  $("client-title").textContent = "#" + s.id + " " + (s.name || s.address);
+  $("client-meta").textContent = [s.hostname, s.os && s.os + "/" + s.arch, s.version && "v" + s.version, s.address].filter(Boolean).join("  ·  ");
+  // Only the tabs for what the client can do
+  for (const [tab, capability] of [["files", "ls"], ["screenshot", "screenshot"]]) {
+    const button = document.querySelector(`nav button[data-tab="${tab}"]`);
+    button.classList.toggle("hidden", !(s.capabilities || []).includes(capability));
+    if (button.classList.contains("hidden") && button.classList.contains("active")) {
+      document.querySelector('nav button[data-tab="terminal"]').click();
+    }
+  }
+  if (changed) {
+    $("terminal").replaceChildren();
+    $("files").replaceChildren();
+    $("path").value = "";
+    cwd = "";
+    $("screenshot").removeAttribute("src");
+  }
+  refreshSessions();
+}
+
+// ---- tabs ----
+
+for (const button of document.querySelectorAll("nav button")) {
+  button.addEventListener("click", () => {
+    for (const b of document.querySelectorAll("nav button")) b.classList.toggle("active", b === button);
+    for (const t of document.querySelectorAll(".tab")) t.classList.add("hidden");
+    $("tab-" + button.dataset.tab).classList.remove("hidden");
+    if (button.dataset.tab === "files" && !cwd) listDirectory("");
+  });
+}
+
+// ---- terminal ----
+
+function termLine(text, cls) {
+  const term = $("terminal");
+  term.append(el("div", { className: cls || "", textContent: text }));
+  term.scrollTop = term.scrollHeight;
+}
+
+// streamJob follows a job's output until it ends and returns the job
+async function streamJob(id, onLine) {
+  const resp = await api("GET", `/jobs/${id}/output`, undefined, true);
+  const reader = resp.body.getReader();
+  const decoder = new TextDecoder();
+  let buffered = "";
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) break;
+    buffered += decoder.decode(value, { stream: true });
+    let nl;
+    while ((nl = buffered.indexOf("\n")) >= 0) {
+      const msg = JSON.parse(buffered.slice(0, nl));
+      buffered = buffered.slice(nl + 1);
+      if (msg.line !== undefined) onLine(msg.line);
+      if (msg.job) return msg.job;
+    }
+  }
+  return api("GET", `/jobs/${id}`);
+}
+
+$("command-form").addEventListener("submit", async (ev) => {
+  ev.preventDefault();
+  const command = $("command").value.trim();
+  if (!command || !current) return;
+  $("command").value = "";
+  termLine("> " + command, "cmd");
+  try {
+    const job = await startCommand(command);
+    if (!job) {
+      termLine("[cancelled]", "status");
+      return;
+    }
+    const result = await streamJob(job.id, (line) => termLine(line));
+    const code = result.exit_code !== undefined ? `exit ${result.exit_code}` : result.status;
+    termLine(`[${code}${result.error ? ": " + result.error : ""}]`, result.status === "failed" ? "failed" : "status");
+  } catch (e) {
+    termLine("[" + e.message + "]", "failed");
+  }
+});
+
+// startCommand starts command as a job. Dangerous commands are refused
+// with 428 until the user confirms them; null means they did not.
+async function startCommand(command) {
+  const path = `/sessions/${selector()}/commands`;
+  try {
+    return await api("POST", path, { command, async: true });
+  } catch (e) {
+    if (e.status !== 428) throw e;
+    if (!confirm(e.message + "\n\nSend it anyway?")) return null;
+    return api("POST", path, { command, async: true, force: true });
+  }
+}
+
+// ---- files ----
+
+function separator() {
+  return current && current.os === "windows" ? "\\" : "/";
+}
+
+function joinPath(dir, name) {
+  const sep = separator();
+  return dir.endsWith(sep) ? dir + name : dir + sep + name;
+}
+
+function parentPath(dir) {
+  const sep = separator();
+  const trimmed = dir.length > 1 && dir.endsWith(sep) ? dir.slice(0, -1) : dir;
+  const i = trimmed.lastIndexOf(sep);
+  if (i < 0) return dir;
+  if (i === 0) return sep;
+  const parent = trimmed.slice(0, i);
+  return /^[A-Za-z]:$/.test(parent) ? parent + sep : parent;
+}
+
+async function runJob(path, body) {
+  const job = await api("POST", path, body);
+  return job.status === "running" ? streamJob(job.id, () => {}) : job;
+}
+
+async function listDirectory(dir) {
+  $("files-status").textContent = "Loading...";
+  try {
+    const job = await runJob(`/sessions/${selector()}/commands`, { command: dir ? "ls " + dir : "ls" });
+    if (job.status !== "done") throw new Error(job.output.join(" ") || job.error);
+    showDirectory(job.output);
+    $("files-status").textContent = "";
+  } catch (e) {
+    $("files-status").textContent = e.message;
+  }
+}
+
+function showDirectory(lines) {
+  const tbody = $("files");
+  tbody.replaceChildren();
+  for (const line of lines) {
+    if (line.startsWith("# ")) {
+      cwd = line.slice(2);
+      $("path").value = cwd;
+      continue;
+    }
+    const [kind, size, modified, ...rest] = line.split("\t");
+    const name = rest.join("\t");
+    const full = joinPath(cwd, name);
+    const nameCell = el("td", { textContent: kind === "d" ? name + separator() : name });
+    const action = el("td");
+    if (kind === "d") {
+      nameCell.className = "dir";
+      nameCell.addEventListener("click", () => listDirectory(full));
+    } else {
+      const button = el("button", { textContent: "Download" });
+      button.addEventListener("click", () => download(full, button));
+      action.append(button);
+    }
+    tbody.append(el("tr", {}, nameCell,
+      el("td", { className: "num", textContent: kind === "d" ? "" : formatSize(Number(size)) }),
+      el("td", { textContent: modified }), action));
+  }
+}
+
+function formatSize(n) {
+  if (n >= 1 << 30) return (n / (1 << 30)).toFixed(1) + " GB";
+  if (n >= 1 << 20) return (n / (1 << 20)).toFixed(1) + " MB";
+  if (n >= 1 << 10) return (n / (1 << 10)).toFixed(1) + " KB";
+  return n + " B";
+}
+
+async function saveJobFile(job, name) {
+  const resp = await api("GET", job.files[0].url.replace("/api/v1", ""), undefined, true);
+  const url = URL.createObjectURL(await resp.blob());
+  const a = el("a", { href: url, download: name });
+  document.body.append(a);
+  a.click();
+  a.remove();
+  setTimeout(() => URL.revokeObjectURL(url), 60000);
+}
+
+async function download(path, button) {
+  button.disabled = true;
+  button.textContent = "Fetching...";
+  try {
+    const job = await runJob(`/sessions/${selector()}/transfers`, { path });
+    if (!job.files || job.files.length === 0) throw new Error(job.output.join(" ") || job.error);
+    await saveJobFile(job, job.files[0].name);
+    button.textContent = "Download";
+  } catch (e) {
+    button.textContent = "Failed";
+    button.title = e.message;
+  }
+  button.disabled = false;
+}
+
+$("path-form").addEventListener("submit", (ev) => {
+  ev.preventDefault();
+  listDirectory($("path").value.trim());
+});
+
+$("path-up").addEventListener("click", () => {
+  if (cwd) listDirectory(parentPath(cwd));
+});
+
+$("upload").addEventListener("change", async () => {
+  const files = Array.from($("upload").files);
+  $("upload").value = "";
+  for (const file of files) {
+    $("files-status").textContent = `Uploading ${file.name}...`;
+    try {
+      const path = encodeURIComponent(joinPath(cwd, file.name));
+      const job = await api("POST", `/sessions/${selector()}/uploads?path=${path}`, file);
+      const result = job.status === "running" ? await streamJob(job.id, () => {}) : job;
+      if (result.status !== "done") throw new Error(result.output.join(" ") || result.error);
+    } catch (e) {
+      $("files-status").textContent = `Upload of ${file.name} failed: ${e.message}`;
+      return;
+    }
+  }
+  $("files-status").textContent = "";
+  listDirectory(cwd);
+});
+
+// ---- screenshots ----
+
+$("take-screenshot").addEventListener("click", async () => {
+  $("screenshot-status").textContent = "Capturing...";
+  try {
+    const job = await runJob(`/sessions/${selector()}/screenshots`, {});
+    if (!job.files || job.files.length === 0) throw new Error(job.output.join(" ") || job.error);
+    const resp = await api("GET", job.files[0].url.replace("/api/v1", ""), undefined, true);
+    const img = $("screenshot");
+    if (img.src) URL.revokeObjectURL(img.src);
+    img.src = URL.createObjectURL(await resp.blob());
+    $("screenshot-status").textContent = job.files[0].name;
+  } catch (e) {
+    $("screenshot-status").textContent = e.message;
+  }
+});
+
+// ---- forwards ----
+
+async function refreshForwards() {
+  const tbody = $("forwards");
+  try {
+    const list = await api("GET", "/forwards");
+    tbody.replaceChildren();
+    for (const f of list) {
+      const remove = el("button", { textContent: "Remove" });
+      remove.addEventListener("click", async () => {
+        try {
+          await api("DELETE", "/forwards/" + encodeURIComponent(f.name));
+        } catch (e) {
+          $("forwards-status").textContent = e.message;
+        }
+        refreshForwards();
+      });
+      tbody.append(el("tr", {},
+        el("td", { textContent: f.name }), el("td", { textContent: f.listen }),
+        el("td", { textContent: f.client || "(active session)" }), el("td", { textContent: f.target }),
+        el("td", {}, remove)));
+    }
+  } catch (e) {
+    $("forwards-status").textContent = e.message;
+  }
+}
+
+$("show-forwards").addEventListener("click", () => {
+  $("empty").classList.add("hidden");
+  $("client").classList.add("hidden");
+  $("forwards-panel").classList.remove("hidden");
+  $("forwards-status").textContent = "";
+  refreshForwards();
+});
+
+$("forward-form").addEventListener("submit", async (ev) => {
+  ev.preventDefault();
+  $("forwards-status").textContent = "";
+  try {
+    await api("POST", "/forwards", {
+      listen: $("fw-listen").value.trim(),
+      target: $("fw-target").value.trim(),
+      client: $("fw-client").value.trim(),
+    });
+    $("forward-form").reset();
+  } catch (e) {
+    $("forwards-status").textContent = e.message;
+  }
+  refreshForwards();
+});
+
+// ---- start ----
+
+let timer = null;
+
+function start() {
+  $("login").classList.add("hidden");
+  $("app").classList.remove("hidden");
+  refreshSessions();
+  clearInterval(timer);
+  timer = setInterval(() => { if (token) refreshSessions(); }, 5000);
+}
+
+if (token) {
+  start();
+} else {
+  signOut();
+}
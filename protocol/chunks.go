@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"io"
+	"strings"
+)
+
+// ChunkSize is how many bytes of a file go in one Chunk
+const ChunkSize = 32 << 10
+
+// screenshotLine is how many characters of base64 go in one line of a
+// screenshot
+const screenshotLine = 1024
+
+// ChunkWriter sends what is written to it as Chunk lines, one per Write
+type ChunkWriter struct {
+	w   io.Writer
+	seq int
+}
+
+func NewChunkWriter(w io.Writer) *ChunkWriter {
+	return &ChunkWriter{w: w}
+}
+
+func (c *ChunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.seq++
+	if err := Write(c.w, Chunk{Seq: c.seq, Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Chunks is how many chunks were written
+func (c *ChunkWriter) Chunks() int {
+	return c.seq
+}
+
+// WriteScreenshot sends a PNG as ScreenshotStart, lines of base64,
+// ScreenshotEnd and End. A Conn sends Chunks instead of the base64.
+func WriteScreenshot(w io.Writer, png []byte) error {
+	msgs := []Message{ScreenshotStart{Size: len(png)}}
+	if _, ok := w.(*Conn); ok {
+		// A write per chunk, so the screenshot can be paced
+		if err := Write(w, msgs...); err != nil {
+			return err
+		}
+		for seq := 1; len(png) > 0; seq++ {
+			n := min(len(png), ChunkSize)
+			if err := Write(w, Chunk{Seq: seq, Data: png[:n]}); err != nil {
+				return err
+			}
+			png = png[n:]
+		}
+		return Write(w, ScreenshotEnd{}, End{})
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(png)
+	for len(encoded) > screenshotLine {
+		msgs = append(msgs, Text(encoded[:screenshotLine]))
+		encoded = encoded[screenshotLine:]
+	}
+	if encoded != "" {
+		msgs = append(msgs, Text(encoded))
+	}
+	return Write(w, append(msgs, ScreenshotEnd{}, End{})...)
+}
+
+// DecodeBase64 decodes the base64 lines of a screenshot, joined, or a
+// chunk of a client from before Chunk. The padding is added if it was
+// lost.
+func DecodeBase64(data string) ([]byte, error) {
+	data = strings.TrimSpace(data)
+	if n := len(data) % 4; n != 0 {
+		data += strings.Repeat("=", 4-n)
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
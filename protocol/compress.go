@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings a peer can compress frames with
+const (
+	Zstd = "zstd"
+	Gzip = "gzip"
+	None = "none"
+)
+
+// Encodings are the ones this package implements, best first
+var Encodings = []string{Zstd, Gzip}
+
+// Kinds of frames compression is agreed for
+const (
+	// OutputFrames are command output and every other line
+	OutputFrames = "output"
+	// DataFrames are the chunks of files, uploads, updates and
+	// screenshots
+	DataFrames = "data"
+)
+
+// Compression is the encoding agreed in the hello for each kind of frame.
+// Kinds it has no encoding for are sent uncompressed.
+type Compression map[string]string
+
+// Negotiate picks for each kind in want the encoding asked for, or the
+// best one of Encodings the peer offers if it cannot do that one
+func Negotiate(want map[string]string, offered []string) Compression {
+	c := Compression{}
+	for kind, enc := range want {
+		if enc == None || enc == "" {
+			continue
+		}
+		if !slices.Contains(offered, enc) {
+			i := slices.IndexFunc(Encodings, func(e string) bool { return slices.Contains(offered, e) })
+			if i < 0 {
+				continue
+			}
+			enc = Encodings[i]
+		}
+		c[kind] = enc
+	}
+	return c
+}
+
+// maxFrameSize bounds the payload of a binary frame, compressed or not,
+// so a bad peer cannot make us allocate without limit
+const maxFrameSize = 16 << 20
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		return e
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxFrameSize))
+		return d
+	})
+)
+
+func compress(enc string, data []byte) ([]byte, error) {
+	switch enc {
+	case Zstd:
+		return zstdEncoder().EncodeAll(data, nil), nil
+	case Gzip:
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q", enc)
+}
+
+func decompress(enc string, data []byte) ([]byte, error) {
+	switch enc {
+	case Zstd:
+		return zstdDecoder().DecodeAll(data, nil)
+	case Gzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		out, err := io.ReadAll(io.LimitReader(zr, maxFrameSize+1))
+		if err == nil && len(out) > maxFrameSize {
+			err = fmt.Errorf("more than %d bytes", maxFrameSize)
+		}
+		return out, err
+	}
+	return nil, fmt.Errorf("unknown encoding %q", enc)
+}
+
+// signatures start the formats that are compressed already
+var signatures = [][]byte{
+	[]byte("\x89PNG"),
+	[]byte("\xff\xd8\xff"), // JPEG
+	[]byte("GIF8"),
+	[]byte("PK\x03\x04"), // zip, and the office formats and jars built on it
+	[]byte("\x1f\x8b"),   // gzip
+	[]byte("\x28\xb5\x2f\xfd"),
+	[]byte("BZh"),
+	[]byte("\xfd7zXZ\x00"),
+	[]byte("7z\xbc\xaf\x27\x1c"),
+	[]byte("Rar!"),
+	[]byte("\x04\x22\x4d\x18"), // lz4
+	[]byte("OggS"),
+	[]byte("ID3"), // mp3
+	[]byte("fLaC"),
+}
+
+// compressible reports whether data, the start of a file, is worth
+// compressing: not an image, archive or media format that already is
+func compressible(data []byte) bool {
+	for _, sig := range signatures {
+		if bytes.HasPrefix(data, sig) {
+			return false
+		}
+	}
+	// WebP, and the MP4 family with its "ftyp" box
+	if len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP" {
+		return false
+	}
+	if len(data) >= 8 && string(data[4:8]) == "ftyp" {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,267 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Binary frames are a header line followed by length bytes of payload:
+//
+//	DATA:<seq>:<length>[:<encoding>]      a Chunk, its data raw or compressed
+//	COMPRESSED:<encoding>:<length>        lines compressed together
+//
+// and TEXT:<line> is a line of Text that starts like a frame, such as
+// output that prints one, so that it is never read as one.
+const (
+	dataName       = "DATA"
+	compressedName = "COMPRESSED"
+	textName       = "TEXT"
+)
+
+// minCompress is the smallest batch of lines worth compressing
+const minCompress = 256
+
+// maxBatch bounds the lines that go in one compressed frame
+const maxBatch = 1 << 20
+
+// Conn writes to a peer that speaks FramingVersion or later in the
+// framing agreed in the hello: Chunks as binary instead of base64, Text
+// that starts like a frame escaped, and frames compressed where the
+// agreement says so and it pays off. Send messages on it with Write; a
+// Reader on the other end, SetFramed, unpacks them.
+type Conn struct {
+	net.Conn
+	compression Compression
+
+	mu sync.Mutex
+	// raw is set for the rest of a transfer whose data does not compress
+	raw bool
+}
+
+// NewConn frames the messages written on conn with compression. A Conn
+// remembers whether the data of the current transfer compresses, so use
+// one per transfer where transfers can run side by side.
+func NewConn(conn net.Conn, compression Compression) *Conn {
+	return &Conn{Conn: conn, compression: compression}
+}
+
+func (c *Conn) writeMessages(msgs []Message) error {
+	var out, lines bytes.Buffer
+	for _, m := range msgs {
+		chunk, ok := m.(Chunk)
+		if !ok {
+			lines.WriteString(escape(m))
+			lines.WriteByte('\n')
+			if lines.Len() >= maxBatch {
+				c.appendLines(&out, lines.Bytes())
+				lines.Reset()
+			}
+			continue
+		}
+		c.appendLines(&out, lines.Bytes())
+		lines.Reset()
+		c.appendChunk(&out, chunk)
+	}
+	c.appendLines(&out, lines.Bytes())
+	_, err := c.Conn.Write(out.Bytes())
+	return err
+}
+
+// escape returns the line m is sent as: Text that starts like a frame goes
+// as a TEXT frame, everything else as it is
+func escape(m Message) string {
+	line := m.String()
+	if _, ok := m.(Text); !ok {
+		return line
+	}
+	name, _, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ":")
+	if _, ok := frames[name]; ok || name == dataName || name == compressedName || name == textName {
+		return textName + ":" + line
+	}
+	return line
+}
+
+func (c *Conn) appendLines(out *bytes.Buffer, lines []byte) {
+	enc := c.compression[OutputFrames]
+	if enc == "" || len(lines) < minCompress || len(lines) > maxFrameSize {
+		out.Write(lines)
+		return
+	}
+	z, err := compress(enc, lines)
+	if err != nil || len(z) >= len(lines) {
+		out.Write(lines)
+		return
+	}
+	fmt.Fprintf(out, "%s:%s:%d\n", compressedName, enc, len(z))
+	out.Write(z)
+}
+
+func (c *Conn) appendChunk(out *bytes.Buffer, m Chunk) {
+	c.mu.Lock()
+	if m.Seq <= 1 {
+		c.raw = !compressible(m.Data)
+	}
+	raw := c.raw
+	c.mu.Unlock()
+
+	if enc := c.compression[DataFrames]; enc != "" && !raw {
+		z, err := compress(enc, m.Data)
+		if err == nil && len(z) < len(m.Data)-len(m.Data)/32 {
+			fmt.Fprintf(out, "%s:%d:%d:%s\n", dataName, m.Seq, len(z), enc)
+			out.Write(z)
+			return
+		}
+		// Data that does not shrink is of a format we do not know to be
+		// compressed; stop trying for the rest of it
+		c.mu.Lock()
+		c.raw = true
+		c.mu.Unlock()
+	}
+	fmt.Fprintf(out, "%s:%d:%d\n", dataName, m.Seq, len(m.Data))
+	out.Write(m.Data)
+}
+
+// Reader reads what a peer sends in any framing, so it works with peers of
+// every protocol version: lines, and once SetFramed, compressed frames,
+// binary Chunks and escaped Text.
+type Reader struct {
+	r      *bufio.Reader
+	framed bool
+
+	// What a failed read, such as on a deadline, had read already
+	line    []byte
+	header  string
+	payload []byte
+
+	// pending are the lines of a compressed frame not returned yet
+	pending []string
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// SetFramed tells r whether the peer writes with a Conn, as peers of
+// FramingVersion or later do once the hello is through. Before, the
+// binary and TEXT frames are lines of Text like any other.
+func (r *Reader) SetFramed(framed bool) {
+	r.framed = framed
+}
+
+// Read returns the next message. A frame that does not decode comes back
+// as Text along with an error wrapping ErrMalformed. A read that fails on
+// the connection can be retried; what it had read is kept.
+func (r *Reader) Read() (Message, error) {
+	for len(r.pending) == 0 {
+		if r.header == "" {
+			line, err := r.readLine()
+			if err != nil {
+				return nil, err
+			}
+			name, _, _ := strings.Cut(line, ":")
+			if !r.framed || (name != dataName && name != compressedName) {
+				return r.parseLine(line)
+			}
+			r.header = line
+		}
+
+		m, err := r.readBinary()
+		if m != nil || err != nil {
+			return m, err
+		}
+	}
+	line := r.pending[0]
+	r.pending = r.pending[1:]
+	return r.parseLine(line)
+}
+
+// parseLine decodes a line that is no binary frame
+func (r *Reader) parseLine(line string) (Message, error) {
+	if text, ok := strings.CutPrefix(line, textName+":"); ok && r.framed {
+		return Text(text), nil
+	}
+	m, err := Parse(line)
+	if err != nil {
+		return Text(line), err
+	}
+	return m, nil
+}
+
+func (r *Reader) readLine() (string, error) {
+	b, err := r.r.ReadBytes('\n')
+	r.line = append(r.line, b...)
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimRight(string(r.line), "\r\n")
+	r.line = r.line[:0]
+	return line, nil
+}
+
+// readBinary reads the payload of the frame in r.header. Compressed lines
+// go to r.pending, a nil message means to read those.
+func (r *Reader) readBinary() (Message, error) {
+	header := r.header
+	name, rest, _ := strings.Cut(header, ":")
+	fields := strings.Split(rest, ":")
+
+	var seq, length int
+	var enc string
+	var err error
+	switch {
+	case name == dataName && (len(fields) == 2 || len(fields) == 3):
+		seq, err = strconv.Atoi(fields[0])
+		if err == nil {
+			length, err = strconv.Atoi(fields[1])
+		}
+		if len(fields) == 3 {
+			enc = fields[2]
+		}
+	case name == compressedName && len(fields) == 2:
+		enc = fields[0]
+		length, err = strconv.Atoi(fields[1])
+	default:
+		err = fmt.Errorf("bad header")
+	}
+	if err == nil && (length < 0 || length > maxFrameSize) {
+		err = fmt.Errorf("%d bytes of payload", length)
+	}
+	if err != nil {
+		// The payload cannot be skipped without its length, what follows
+		// is read as lines
+		r.header = ""
+		return Text(header), fmt.Errorf("%w: %s: %v", ErrMalformed, name, err)
+	}
+
+	if cap(r.payload) < length {
+		payload := make([]byte, len(r.payload), length)
+		copy(payload, r.payload)
+		r.payload = payload
+	}
+	n, err := io.ReadFull(r.r, r.payload[len(r.payload):length])
+	r.payload = r.payload[:len(r.payload)+n]
+	if err != nil {
+		return nil, err
+	}
+	payload := r.payload
+	r.header, r.payload = "", nil
+
+	if enc != "" {
+		if payload, err = decompress(enc, payload); err != nil {
+			return Text(header), fmt.Errorf("%w: %s: %v", ErrMalformed, name, err)
+		}
+	}
+	if name == dataName {
+		return Chunk{Seq: seq, Data: payload}, nil
+	}
+	if text := strings.TrimSuffix(string(payload), "\n"); text != "" {
+		r.pending = strings.Split(text, "\n")
+	}
+	return nil, nil
+}
@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"bytes"
+	"cmp"
+	"net"
+	"strings"
+	"testing"
+)
+
+// bufConn is a net.Conn that keeps what is written to it
+type bufConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+
+// frameLines are output lines that start like every frame there is
+func frameLines() []Message {
+	names := []string{dataName, compressedName, textName}
+	for name := range frames {
+		names = append(names, name)
+	}
+	var lines []Message
+	for _, name := range names {
+		lines = append(lines, Text(name), Text(name+":"), Text(name+":1:50000"), Text(name+":gzip:100"))
+	}
+	return lines
+}
+
+func TestConnEscapesOutput(t *testing.T) {
+	lines := frameLines()
+	for _, enc := range []string{"", Gzip, Zstd} {
+		t.Run(cmp.Or(enc, None), func(t *testing.T) {
+			conn := &bufConn{}
+			c := NewConn(conn, Compression{OutputFrames: enc, DataFrames: enc})
+			// A write for each line, then all of them in one batch, which
+			// is compressed if anything is
+			for _, m := range lines {
+				if err := Write(c, m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := Write(c, lines...); err != nil {
+				t.Fatal(err)
+			}
+			data := []byte(strings.Repeat("after the output ", 100))
+			if err := Write(c, Chunk{Seq: 1, Data: data}, End{}); err != nil {
+				t.Fatal(err)
+			}
+
+			r := NewReader(&conn.buf)
+			r.SetFramed(true)
+			for i := range 2 * len(lines) {
+				want := lines[i%len(lines)]
+				m, err := r.Read()
+				if err != nil || m != want {
+					t.Fatalf("line %d: got %#v, %v, want %#v", i, m, err, want)
+				}
+			}
+			m, err := r.Read()
+			if chunk, ok := m.(Chunk); err != nil || !ok || !bytes.Equal(chunk.Data, data) {
+				t.Fatalf("after the output: got %#v, %v, want the chunk", m, err)
+			}
+			if m, err := r.Read(); err != nil || m != (End{}) {
+				t.Fatalf("got %#v, %v, want End", m, err)
+			}
+		})
+	}
+}
+
+func TestReaderUnframed(t *testing.T) {
+	// Peers before FramingVersion send no binary or TEXT frames, lines
+	// that look like them are output
+	r := NewReader(strings.NewReader("DATA:1:5\nabcde\nCOMPRESSED:gzip:3\nTEXT:x\n"))
+	for _, want := range []Message{Text("DATA:1:5"), Text("abcde"), Text("COMPRESSED:gzip:3"), Text("TEXT:x")} {
+		m, err := r.Read()
+		if err != nil || m != want {
+			t.Fatalf("got %#v, %v, want %#v", m, err, want)
+		}
+	}
+}
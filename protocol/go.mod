@@ -0,0 +1,5 @@
+module gofrpprotocol
+
+go 1.24.7
+
+require github.com/klauspost/compress v1.18.0
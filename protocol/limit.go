@@ -0,0 +1,174 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of traffic a Limit applies to
+const (
+	// TransferLimit paces files, screenshots, uploads and updates
+	TransferLimit = "transfer"
+	// ForwardLimit paces the traffic of port forwards
+	ForwardLimit = "forward"
+)
+
+// Limiter paces data to a rate in bytes per second with a token bucket.
+// The rate can change while the Limiter is in use; 0 means no limit. A nil
+// Limiter does not limit.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate}
+}
+
+// SetRate changes the rate, for data already waiting too
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+// Rate is the rate in bytes per second, 0 for no limit
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Wait blocks until n bytes may pass. Bytes beyond what the bucket holds
+// are borrowed and paid back by the waits after them.
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return
+	}
+	l.refill()
+	l.tokens -= float64(n)
+	for l.rate > 0 && l.tokens < 0 {
+		wait := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+		l.mu.Unlock()
+		// Sleep in steps so a new rate takes effect soon
+		time.Sleep(min(wait, 100*time.Millisecond))
+		l.mu.Lock()
+		l.refill()
+	}
+}
+
+func (l *Limiter) refill() {
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	}
+	l.last = now
+	// A quarter of a second of data may go at once
+	l.tokens = min(l.tokens, float64(l.rate)/4)
+}
+
+// Conn paces what is written to conn. Each write waits for its bytes
+// before it goes out whole, so the frames of writers sharing conn do not
+// get mixed.
+func (l *Limiter) Conn(conn net.Conn) net.Conn {
+	if l == nil {
+		return conn
+	}
+	return &limitedConn{Conn: conn, l: l}
+}
+
+type limitedConn struct {
+	net.Conn
+	l *Limiter
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	c.l.Wait(len(p))
+	return c.Conn.Write(p)
+}
+
+// String formats the rate for flags and the console
+func (l *Limiter) String() string {
+	return FormatRate(l.Rate())
+}
+
+// Set parses a rate as given to ParseRate, so a Limiter can be a flag
+func (l *Limiter) Set(s string) error {
+	rate, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	l.SetRate(rate)
+	return nil
+}
+
+var rateUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+}
+
+// ParseRate reads a rate such as "500KB/s", "1.5MB/s" or "800K" in bytes
+// per second, with units of 1024. "0", "off", "none" and "unlimited" are
+// no limit.
+func ParseRate(s string) (int64, error) {
+	text := strings.ToLower(strings.TrimSpace(s))
+	switch text {
+	case "", "0", "off", "none", "unlimited":
+		return 0, nil
+	}
+	text = strings.TrimSuffix(text, "/s")
+	i := strings.IndexFunc(text, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(text)
+	}
+	unit, ok := rateUnits[strings.TrimSpace(text[i:])]
+	n, err := strconv.ParseFloat(text[:i], 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q, want e.g. 500KB/s or off", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// FormatRate shows a rate in bytes per second the way ParseRate reads it
+func FormatRate(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return FormatBytes(float64(rate)) + "/s"
+}
+
+// FormatBytes shows n bytes in units of 1024
+func FormatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterWait(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		rate  int64
+		idle  time.Duration // before the first write
+		sizes []int
+		want  time.Duration
+	}{
+		{"unlimited", 0, 0, []int{1 << 20, 1 << 20}, 0},
+		{"one write", 100 << 10, 0, []int{20 << 10}, 200 * time.Millisecond},
+		{"small writes", 100 << 10, 0, []int{5 << 10, 5 << 10, 5 << 10, 5 << 10}, 200 * time.Millisecond},
+		{"borrowed", 100 << 10, 0, []int{30 << 10, 1}, 300 * time.Millisecond},
+		// An idle bucket lets a quarter of a second of data go at once,
+		// and no more
+		{"burst", 100 << 10, 500 * time.Millisecond, []int{25 << 10}, 0},
+		{"past the burst", 100 << 10, 500 * time.Millisecond, []int{25 << 10, 20 << 10}, 200 * time.Millisecond},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			l := NewLimiter(c.rate)
+			l.Wait(0)
+			time.Sleep(c.idle)
+			start := time.Now()
+			for _, n := range c.sizes {
+				l.Wait(n)
+			}
+			if got := time.Since(start); got < c.want*9/10 || got > c.want+150*time.Millisecond {
+				t.Errorf("writes of %v at %d B/s took %v, want %v", c.sizes, c.rate, got, c.want)
+			}
+		})
+	}
+
+	// A nil Limiter does not limit, and a new rate frees a write that waits
+	var none *Limiter
+	none.Wait(1 << 30)
+	l := NewLimiter(1 << 10)
+	time.AfterFunc(100*time.Millisecond, func() { l.SetRate(0) })
+	start := time.Now()
+	l.Wait(1 << 20)
+	if got := time.Since(start); got > 500*time.Millisecond {
+		t.Errorf("write waited %v after the limit was lifted", got)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want int64
+	}{
+		{"", 0},
+		{"off", 0},
+		{"Unlimited", 0},
+		{"0", 0},
+		{"800", 800},
+		{"800B/s", 800},
+		{"500KB/s", 500 << 10},
+		{"500 kb/s", 500 << 10},
+		{"800K", 800 << 10},
+		{"1.5MB/s", 3 << 19},
+		{"2G", 2 << 30},
+	} {
+		if got, err := ParseRate(c.text); err != nil || got != c.want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", c.text, got, err, c.want)
+		}
+	}
+	for _, text := range []string{"fast", "-1KB/s", "10 TB/s", "1.2.3M", "KB/s"} {
+		if _, err := ParseRate(text); err == nil {
+			t.Errorf("ParseRate(%q) is not an error", text)
+		}
+	}
+
+	// What FormatRate shows reads back as the same rate
+	for _, rate := range []int64{0, 512, 500 << 10, 3 << 19, 2 << 30} {
+		if got, err := ParseRate(FormatRate(rate)); err != nil || got != rate {
+			t.Errorf("ParseRate(FormatRate(%d)) = %d, %v", rate, got, err)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package protocol
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	authName            = "AUTH"
+	authFailedName      = "AUTH_FAILED"
+	clientInfoName      = "CLIENT_INFO"
+	helloName           = "HELLO"
+	keepAliveName       = "KEEP_ALIVE"
+	keepAliveAckName    = "KEEP_ALIVE_ACK"
+	metricsName         = "METRICS"
+	disconnectName      = "DISCONNECT"
+	serverShutdownName  = "SERVER_SHUTDOWN"
+	exitStatusName      = "EXIT_STATUS"
+	endName             = "---END---"
+	errorName           = "ERROR"
+	newConnectionName   = "NEW_CONNECTION"
+	newConnFailedName   = "NEW_CONNECTION_FAILED"
+	chunkName           = "CHUNK"
+	fileStartName       = "FILE_TRANSFER_START"
+	fileEndName         = "FILE_TRANSFER_END"
+	screenshotStartName = "SCREENSHOT_START"
+	screenshotEndName   = "SCREENSHOT_END"
+	uploadStartName     = "UPLOAD_START"
+	uploadEndName       = "UPLOAD_END"
+	updateStartName     = "UPDATE_START"
+	updateEndName       = "UPDATE_END"
+	limitName           = "LIMIT"
+	sendFileName        = "SEND_FILE"
+	transferName        = "TRANSFER"
+)
+
+// Text is a line that is no frame: a command, or a line of output
+type Text string
+
+func (t Text) String() string { return string(t) }
+
+// Auth is the first line of a client session
+type Auth struct {
+	Key string
+}
+
+func (m Auth) String() string { return authName + ":" + m.Key }
+
+func parseAuth(payload string) (Message, error) {
+	return Auth{Key: payload}, nil
+}
+
+// AuthFailed tells a client its key was rejected
+type AuthFailed struct{}
+
+func (AuthFailed) String() string { return authFailedName }
+
+// ClientInfo follows Auth and is the client's hello: who it is, what it
+// runs on and what it can do. Clients before the hello have no Protocol.
+type ClientInfo struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Tags     []string `json:"tags,omitempty"`
+	Hostname string   `json:"hostname"`
+	OS       string   `json:"os"`
+	Arch     string   `json:"arch"`
+	Version  string   `json:"version,omitempty"`
+
+	Protocol     int      `json:"protocol,omitempty"`
+	MinProtocol  int      `json:"min_protocol,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Compression  []string `json:"compression,omitempty"` // encodings the client can read
+}
+
+func (m ClientInfo) String() string { return jsonFrame(clientInfoName, m) }
+
+func parseClientInfo(payload string) (Message, error) {
+	var m ClientInfo
+	err := json.Unmarshal([]byte(payload), &m)
+	return m, err
+}
+
+// Hello is the server's answer to ClientInfo. A client it refuses gets
+// the reason in Error.
+type Hello struct {
+	Protocol     int         `json:"protocol"`
+	MinProtocol  int         `json:"min_protocol"`
+	Version      string      `json:"version"`
+	OS           string      `json:"os"`
+	Arch         string      `json:"arch"`
+	Capabilities []string    `json:"capabilities"`
+	Compression  Compression `json:"compression,omitempty"` // used by both sides
+	Error        string      `json:"error,omitempty"`
+}
+
+func (m Hello) String() string { return jsonFrame(helloName, m) }
+
+func parseHello(payload string) (Message, error) {
+	var m Hello
+	err := json.Unmarshal([]byte(payload), &m)
+	return m, err
+}
+
+// KeepAlive is sent by either side when it has not heard from the other
+// for a while, and answered with KeepAliveAck
+type KeepAlive struct{}
+
+func (KeepAlive) String() string { return keepAliveName }
+
+type KeepAliveAck struct{}
+
+func (KeepAliveAck) String() string { return keepAliveAckName }
+
+// Metrics is the telemetry a client pushes at intervals
+type Metrics struct {
+	Time     int64   `json:"time"`
+	CPU      float64 `json:"cpu"`
+	Mem      float64 `json:"mem"`
+	MemUsed  uint64  `json:"mem_used"`
+	MemTotal uint64  `json:"mem_total"`
+	Disk     float64 `json:"disk"`
+	DiskPath string  `json:"disk_path"`
+	NetRx    float64 `json:"net_rx"`
+	NetTx    float64 `json:"net_tx"`
+	Load1    float64 `json:"load1"`
+	Load5    float64 `json:"load5"`
+	Load15   float64 `json:"load15"`
+}
+
+func (m Metrics) String() string { return jsonFrame(metricsName, m) }
+
+func parseMetrics(payload string) (Message, error) {
+	var m Metrics
+	err := json.Unmarshal([]byte(payload), &m)
+	return m, err
+}
+
+// Disconnect and ServerShutdown tell the client the server is about to
+// close the connection; the client reconnects later either way
+type Disconnect struct{}
+
+func (Disconnect) String() string { return disconnectName }
+
+type ServerShutdown struct{}
+
+func (ServerShutdown) String() string { return serverShutdownName }
+
+// ExitStatus precedes End after the output of a command
+type ExitStatus struct {
+	Code int
+}
+
+func (m ExitStatus) String() string { return exitStatusName + ":" + strconv.Itoa(m.Code) }
+
+func parseExitStatus(payload string) (Message, error) {
+	code, err := strconv.Atoi(payload)
+	return ExitStatus{Code: code}, err
+}
+
+// End closes the answer to a command
+type End struct{}
+
+func (End) String() string { return endName }
+
+// Error is sent by the client instead of the rest of a file transfer that
+// failed half way
+type Error struct {
+	Message string
+}
+
+func (m Error) String() string { return errorName + ":" + m.Message }
+
+func parseError(payload string) (Message, error) {
+	return Error{Message: payload}, nil
+}
+
+// NewConnection asks the client to connect a forward to Target. The
+// client answers on a new connection or stream that starts with a
+// NewConnection with the same ID and no Target, after its Auth if the
+// server has the "forward-auth" capability. IDs are random, so they cannot
+// be guessed by others to take the connection.
+type NewConnection struct {
+	ID     int64
+	Target string
+}
+
+func (m NewConnection) String() string {
+	if m.Target == "" {
+		return fmt.Sprintf("%s:%d", newConnectionName, m.ID)
+	}
+	return fmt.Sprintf("%s:%d:%s", newConnectionName, m.ID, m.Target)
+}
+
+func parseNewConnection(payload string) (Message, error) {
+	idText, target, _ := strings.Cut(payload, ":")
+	id, err := strconv.ParseInt(idText, 10, 64)
+	return NewConnection{ID: id, Target: target}, err
+}
+
+// NewConnFailed tells the server a forward's target could not be reached
+type NewConnFailed struct {
+	ID     int64
+	Reason string
+}
+
+func (m NewConnFailed) String() string {
+	return fmt.Sprintf("%s:%d:%s", newConnFailedName, m.ID, m.Reason)
+}
+
+func parseNewConnFailed(payload string) (Message, error) {
+	idText, reason, _ := strings.Cut(payload, ":")
+	id, err := strconv.ParseInt(idText, 10, 64)
+	return NewConnFailed{ID: id, Reason: reason}, err
+}
+
+// Chunk is a piece of a file, upload or update. Seq counts from 1.
+type Chunk struct {
+	Seq  int
+	Data []byte
+}
+
+// String encodes the chunk as "CHUNK:<seq>:<length of the base64>:<base64>"
+func (m Chunk) String() string {
+	encoded := base64.StdEncoding.EncodeToString(m.Data)
+	return fmt.Sprintf("%s:%d:%d:%s", chunkName, m.Seq, len(encoded), encoded)
+}
+
+func parseChunk(payload string) (Message, error) {
+	parts := strings.SplitN(payload, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("want <seq>:<length>:<base64>")
+	}
+	seq, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if length != len(parts[2]) {
+		return nil, fmt.Errorf("chunk %d has %d bytes of base64, want %d", seq, len(parts[2]), length)
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	return Chunk{Seq: seq, Data: data}, nil
+}
+
+// FileStart starts a file the client sends, in Chunks up to FileEnd
+type FileStart struct {
+	Name string
+	Size int64
+}
+
+func (m FileStart) String() string {
+	return fmt.Sprintf("%s:%s:%d", fileStartName, m.Name, m.Size)
+}
+
+func parseFileStart(payload string) (Message, error) {
+	// The size is last, names may have colons
+	i := strings.LastIndex(payload, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("want <name>:<size>")
+	}
+	size, err := strconv.ParseInt(payload[i+1:], 10, 64)
+	return FileStart{Name: payload[:i], Size: size}, err
+}
+
+type FileEnd struct{}
+
+func (FileEnd) String() string { return fileEndName }
+
+// ScreenshotStart starts a PNG the client sends, as Text lines of base64
+// up to ScreenshotEnd and End. See WriteScreenshot.
+type ScreenshotStart struct {
+	Size int
+}
+
+func (m ScreenshotStart) String() string {
+	return screenshotStartName + ":" + strconv.Itoa(m.Size)
+}
+
+func parseScreenshotStart(payload string) (Message, error) {
+	size, err := strconv.Atoi(payload)
+	return ScreenshotStart{Size: size}, err
+}
+
+type ScreenshotEnd struct{}
+
+func (ScreenshotEnd) String() string { return screenshotEndName }
+
+// UploadStart starts a file the server writes to Path on the client, in
+// Chunks up to UploadEnd
+type UploadStart struct {
+	Size int64
+	Path string
+}
+
+func (m UploadStart) String() string {
+	return fmt.Sprintf("%s:%d:%s", uploadStartName, m.Size, m.Path)
+}
+
+func parseUploadStart(payload string) (Message, error) {
+	sizeText, path, _ := strings.Cut(payload, ":")
+	size, err := strconv.ParseInt(sizeText, 10, 64)
+	if err == nil && path == "" {
+		err = fmt.Errorf("no path")
+	}
+	return UploadStart{Size: size, Path: path}, err
+}
+
+type UploadEnd struct{}
+
+func (UploadEnd) String() string { return uploadEndName }
+
+// UpdateStart starts a new client binary, in Chunks up to UpdateEnd.
+// Signature is the ed25519 signature of UpdateMessage for it and Version,
+// the version the binary reports. Clients without the "update-version"
+// capability get no Version, and a signature without one.
+type UpdateStart struct {
+	Size      int64
+	Signature []byte
+	Version   string
+}
+
+func (m UpdateStart) String() string {
+	s := fmt.Sprintf("%s:%d:%s", updateStartName, m.Size, base64.StdEncoding.EncodeToString(m.Signature))
+	if m.Version != "" {
+		s += ":" + m.Version
+	}
+	return s
+}
+
+func parseUpdateStart(payload string) (Message, error) {
+	sizeText, rest, _ := strings.Cut(payload, ":")
+	size, err := strconv.ParseInt(sizeText, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	sigText, version, _ := strings.Cut(rest, ":")
+	m := UpdateStart{Size: size, Version: version}
+	if sigText != "" {
+		m.Signature, err = base64.StdEncoding.DecodeString(sigText)
+	}
+	return m, err
+}
+
+type UpdateEnd struct{}
+
+func (UpdateEnd) String() string { return updateEndName }
+
+// Limit changes the rate the client holds Kind of traffic it sends to, in
+// bytes per second. 0 lifts the limit.
+type Limit struct {
+	Kind string
+	Rate int64
+}
+
+func (m Limit) String() string {
+	return fmt.Sprintf("%s:%s:%d", limitName, m.Kind, m.Rate)
+}
+
+func parseLimit(payload string) (Message, error) {
+	kind, rateText, _ := strings.Cut(payload, ":")
+	rate, err := strconv.ParseInt(rateText, 10, 64)
+	if err == nil && rate < 0 {
+		err = fmt.Errorf("negative rate")
+	}
+	return Limit{Kind: kind, Rate: rate}, err
+}
+
+// SendFile asks the client for the file at Path, like the send command,
+// as the transfer ID. Only clients with the "transfers" capability get it.
+type SendFile struct {
+	ID   int64
+	Path string
+}
+
+func (m SendFile) String() string {
+	return fmt.Sprintf("%s:%d:%s", sendFileName, m.ID, m.Path)
+}
+
+func parseSendFile(payload string) (Message, error) {
+	idText, path, _ := strings.Cut(payload, ":")
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err == nil && path == "" {
+		err = fmt.Errorf("no path")
+	}
+	return SendFile{ID: id, Path: path}, err
+}
+
+// Actions of a Transfer frame
+const (
+	// TransferStart comes from the client right before the FileStart of
+	// the transfer, TransferEnd once it is over, sent or not
+	TransferStart = "start"
+	TransferEnd   = "end"
+	// The server pauses, resumes or cancels a transfer the client sends
+	TransferPause  = "pause"
+	TransferResume = "resume"
+	TransferCancel = "cancel"
+)
+
+// Transfer is about the transfer ID of a SendFile
+type Transfer struct {
+	Action string
+	ID     int64
+}
+
+func (m Transfer) String() string {
+	return fmt.Sprintf("%s:%s:%d", transferName, m.Action, m.ID)
+}
+
+func parseTransfer(payload string) (Message, error) {
+	action, idText, _ := strings.Cut(payload, ":")
+	id, err := strconv.ParseInt(idText, 10, 64)
+	return Transfer{Action: action, ID: id}, err
+}
+
+// UpdateMessage is what the update key signs for a client binary: the
+// platform, the version and the SHA-256 of the binary, so a binary cannot
+// be pushed to a platform it was not signed for, nor as another version
+// to go back to an older one. Without a version it is the message of
+// clients before the "update-version" capability, which take any binary
+// that was ever signed for their platform.
+func UpdateMessage(goos, goarch, version string, sum []byte) []byte {
+	if version == "" {
+		return []byte(fmt.Sprintf("gofrpclient-update\n%s/%s\n%x\n", goos, goarch, sum))
+	}
+	return []byte(fmt.Sprintf("gofrpclient-update-version\n%s/%s\n%s\n%x\n", goos, goarch, version, sum))
+}
+
+// CompareVersions compares versions of dotted numbers such as "1.2.0",
+// with an optional "v" in front, and returns -1, 0 or +1. Missing numbers
+// count as 0.
+func CompareVersions(a, b string) (int, error) {
+	na, err := versionNumbers(a)
+	if err != nil {
+		return 0, err
+	}
+	nb, err := versionNumbers(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := range max(len(na), len(nb)) {
+		var x, y int
+		if i < len(na) {
+			x = na[i]
+		}
+		if i < len(nb) {
+			y = nb[i]
+		}
+		if x != y {
+			return cmp.Compare(x, y), nil
+		}
+	}
+	return 0, nil
+}
+
+func versionNumbers(v string) ([]int, error) {
+	var numbers []int
+	for _, part := range strings.Split(strings.TrimPrefix(v, "v"), ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("version %q is not dotted numbers", v)
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, nil
+}
+
+func jsonFrame(name string, v any) string {
+	data, _ := json.Marshal(v)
+	return name + ":" + string(data)
+}
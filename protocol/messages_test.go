@@ -0,0 +1,310 @@
+package protocol
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"io"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// messages has a value of every message type, with payloads that are
+// awkward to encode where a type has any
+func messages() []Message {
+	return []Message{
+		Text("dir C:\\Users"),
+		Text(""),
+		Auth{Key: "key:with:colons"},
+		AuthFailed{},
+		ClientInfo{
+			ID: "id", Name: "name", Tags: []string{"a", "b"}, Hostname: "host",
+			OS: "linux", Arch: "amd64", Version: "1.2.3",
+			Protocol: Version, MinProtocol: 1, Capabilities: []string{"transfers"},
+			Compression: Encodings,
+		},
+		Hello{
+			Protocol: Version, MinProtocol: 1, Version: "1.2.3", OS: "windows", Arch: "arm64",
+			Capabilities: []string{"forward-auth"}, Compression: Compression{OutputFrames: Gzip, DataFrames: Zstd},
+		},
+		Hello{Protocol: Version, MinProtocol: 2, Error: "too old: upgrade"},
+		KeepAlive{},
+		KeepAliveAck{},
+		Metrics{
+			Time: 1700000000, CPU: 12.5, Mem: 50.25, MemUsed: 1 << 30, MemTotal: 1 << 32,
+			Disk: 80, DiskPath: "C:\\", NetRx: 1024.5, NetTx: 2048, Load1: 0.5, Load5: 1, Load15: 1.5,
+		},
+		Disconnect{},
+		ServerShutdown{},
+		ExitStatus{Code: 0},
+		ExitStatus{Code: -1},
+		End{},
+		Error{Message: "read failed: EOF"},
+		NewConnection{ID: 8106811779741334000},
+		NewConnection{ID: 1, Target: "127.0.0.1:22"},
+		NewConnFailed{ID: 2, Reason: "dial tcp 10.0.0.1:80: refused"},
+		Chunk{Seq: 1, Data: []byte("hello\n\x00\xff")},
+		FileStart{Name: "C:\\dir\\a:b.txt", Size: 12345},
+		FileEnd{},
+		ScreenshotStart{Size: 4096},
+		ScreenshotEnd{},
+		UploadStart{Size: 10, Path: "/tmp/a:b"},
+		UploadEnd{},
+		UpdateStart{Size: 1 << 20, Signature: []byte{1, 2, 3, 255}},
+		UpdateStart{Size: 7},
+		UpdateStart{Size: 7, Signature: []byte{4, 5}, Version: "1.2.3"},
+		UpdateEnd{},
+		Limit{Kind: DataFrames, Rate: 1 << 20},
+		Limit{Kind: OutputFrames},
+		SendFile{ID: 3, Path: "/var/log/a:b.log"},
+		Transfer{Action: TransferStart, ID: 3},
+		Transfer{Action: TransferCancel, ID: 4},
+	}
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	for _, m := range messages() {
+		for _, end := range []string{"", "\n", "\r\n"} {
+			got, err := Parse(m.String() + end)
+			if err != nil || !reflect.DeepEqual(got, m) {
+				t.Errorf("Parse(%q) = %#v, %v, want %#v", m.String()+end, got, err, m)
+			}
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, line := range []string{
+		"EXIT_STATUS:x",
+		"CLIENT_INFO:{",
+		"CHUNK:1:4",
+		"CHUNK:1:5:AAAA",
+		"CHUNK:1:4:!!!!",
+		"FILE_TRANSFER_START:name",
+		"UPLOAD_START:10:",
+		"LIMIT:data:-1",
+		"SEND_FILE:1:",
+		"TRANSFER:end:x",
+	} {
+		m, err := Parse(line)
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("Parse(%q) = %#v, %v, want ErrMalformed", line, m, err)
+		}
+	}
+
+	// Names without the payload they need, or with one they do not take,
+	// are output
+	for _, line := range []string{"AUTH", "KEEP_ALIVE:1", "---END---:", "EXIT_STATUS"} {
+		if m, err := Parse(line); err != nil || m != Text(line) {
+			t.Errorf("Parse(%q) = %#v, %v, want Text", line, m, err)
+		}
+	}
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	// Every message through a plain writer, as peers before FramingVersion
+	// send them, and through a Conn with each encoding
+	for _, enc := range []string{"plain", None, Gzip, Zstd} {
+		t.Run(enc, func(t *testing.T) {
+			conn := &bufConn{}
+			var w io.Writer = &conn.buf
+			if enc != "plain" {
+				c := Compression{}
+				if enc != None {
+					c = Compression{OutputFrames: enc, DataFrames: enc}
+				}
+				w = NewConn(conn, c)
+			}
+			msgs := messages()
+			if err := Write(w, msgs...); err != nil {
+				t.Fatal(err)
+			}
+
+			// A byte at a time, so that every frame is split across reads
+			r := NewReader(iotest.OneByteReader(&conn.buf))
+			r.SetFramed(enc != "plain")
+			for _, want := range msgs {
+				m, err := r.Read()
+				if err != nil || !reflect.DeepEqual(m, want) {
+					t.Fatalf("got %#v, %v, want %#v", m, err, want)
+				}
+			}
+			if m, err := r.Read(); err != io.EOF {
+				t.Fatalf("got %#v, %v after the messages, want EOF", m, err)
+			}
+		})
+	}
+}
+
+func TestChunkFrames(t *testing.T) {
+	text := []byte(strings.Repeat("a line of a log file\n", 1000))
+	random := make([]byte, 32<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, enc := range []string{"", Gzip, Zstd} {
+		t.Run(cmp.Or(enc, None), func(t *testing.T) {
+			conn := &bufConn{}
+			c := NewConn(conn, Compression{OutputFrames: enc, DataFrames: enc})
+
+			// Data that compresses goes compressed, if anything does
+			wire := writeWire(t, c, conn, Chunk{Seq: 1, Data: text})
+			header := "DATA:1:" + strconv.Itoa(len(text)) + "\n"
+			if enc != "" {
+				header = "DATA:1:"
+			}
+			if !strings.HasPrefix(wire, header) || enc != "" && !strings.Contains(wire[:32], ":"+enc+"\n") {
+				t.Fatalf("text chunk sent as %q", wire[:min(len(wire), 32)])
+			}
+			readChunks(t, wire, Chunk{Seq: 1, Data: text})
+
+			// Data that does not is sent raw, and so is the rest of its
+			// transfer
+			wire = writeWire(t, c, conn, Chunk{Seq: 1, Data: random}, Chunk{Seq: 2, Data: text})
+			if !strings.HasPrefix(wire, "DATA:1:"+strconv.Itoa(len(random))+"\n") ||
+				!strings.Contains(wire, "DATA:2:"+strconv.Itoa(len(text))+"\n") {
+				t.Fatalf("random chunks sent as %q", wire[:32])
+			}
+			readChunks(t, wire, Chunk{Seq: 1, Data: random}, Chunk{Seq: 2, Data: text})
+
+			// Output lines are batched in one COMPRESSED frame
+			var lines []Message
+			for i := range 100 {
+				lines = append(lines, Text("output line "+strconv.Itoa(i)))
+			}
+			wire = writeWire(t, c, conn, lines...)
+			if compressed := strings.HasPrefix(wire, "COMPRESSED:"+enc+":"); compressed != (enc != "") {
+				t.Fatalf("output sent as %q", wire[:32])
+			}
+			r := NewReader(strings.NewReader(wire))
+			r.SetFramed(true)
+			for _, want := range lines {
+				if m, err := r.Read(); err != nil || m != want {
+					t.Fatalf("got %#v, %v, want %#v", m, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderMalformedFrames(t *testing.T) {
+	// A bad binary header cannot be skipped, what follows is read as
+	// lines; a payload that does not decompress is skipped
+	r := NewReader(strings.NewReader("DATA:x:3\nabc\nCOMPRESSED:gzip:3\nabcEXIT_STATUS:1\n"))
+	r.SetFramed(true)
+	for _, want := range []struct {
+		m   Message
+		bad bool
+	}{
+		{Text("DATA:x:3"), true},
+		{Text("abc"), false},
+		{Text("COMPRESSED:gzip:3"), true},
+		{ExitStatus{Code: 1}, false},
+	} {
+		m, err := r.Read()
+		if m != want.m || errors.Is(err, ErrMalformed) != want.bad {
+			t.Fatalf("got %#v, %v, want %#v", m, err, want.m)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.0", "1.2.0", 0},
+		{"1.2", "1.2.0", 0},
+		{"v1.10.0", "1.9.9", 1},
+		{"0.01", "0.1", 0},
+		{"0.02", "0.01", 1},
+		{"1.2.0", "1.2.1", -1},
+		{"2", "10", -1},
+	} {
+		if got, err := CompareVersions(c.a, c.b); err != nil || got != c.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, %v, want %d", c.a, c.b, got, err, c.want)
+		}
+	}
+	for _, v := range []string{"", "1.x", "1..2", "1.2.0-rc1", "-1"} {
+		if _, err := CompareVersions(v, "1.0"); err == nil {
+			t.Errorf("CompareVersions(%q) is not an error", v)
+		}
+	}
+}
+
+func writeWire(t *testing.T, c *Conn, conn *bufConn, msgs ...Message) string {
+	t.Helper()
+	conn.buf.Reset()
+	if err := Write(c, msgs...); err != nil {
+		t.Fatal(err)
+	}
+	return conn.buf.String()
+}
+
+func readChunks(t *testing.T, wire string, want ...Chunk) {
+	t.Helper()
+	r := NewReader(strings.NewReader(wire))
+	r.SetFramed(true)
+	for _, w := range want {
+		m, err := r.Read()
+		if chunk, ok := m.(Chunk); err != nil || !ok || chunk.Seq != w.Seq || !bytes.Equal(chunk.Data, w.Data) {
+			t.Fatalf("got %T, %v, want chunk %d", m, err, w.Seq)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Fatalf("got %v after the chunks, want EOF", err)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, m := range messages() {
+		f.Add(m.String())
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		m, err := Parse(line)
+		if err != nil {
+			if !errors.Is(err, ErrMalformed) {
+				t.Fatalf("Parse(%q): %v does not wrap ErrMalformed", line, err)
+			}
+			return
+		}
+		// What decodes encodes to a line that decodes the same
+		again, err := Parse(m.String())
+		if err != nil || again.String() != m.String() {
+			t.Fatalf("Parse(%q) = %#v, which encodes to %q, which parses to %#v, %v", line, m, m.String(), again, err)
+		}
+	})
+}
+
+func FuzzReader(f *testing.F) {
+	f.Add([]byte("DATA:1:5\nabcde\nTEXT:DATA:1:5\n"), true)
+	f.Add([]byte("COMPRESSED:gzip:3\nabc\n---END---\n"), true)
+	for _, enc := range []string{"", Gzip, Zstd} {
+		conn := &bufConn{}
+		Write(NewConn(conn, Compression{OutputFrames: enc, DataFrames: enc}), messages()...)
+		f.Add(conn.buf.Bytes(), true)
+		f.Add(conn.buf.Bytes(), false)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, framed bool) {
+		r := NewReader(bytes.NewReader(data))
+		r.SetFramed(framed)
+		for {
+			m, err := r.Read()
+			if errors.Is(err, ErrMalformed) {
+				if m == nil {
+					t.Fatalf("malformed frame and no message")
+				}
+				continue
+			}
+			if err != nil {
+				return
+			}
+			if m == nil {
+				t.Fatalf("no message and no error")
+			}
+		}
+	})
+}
@@ -0,0 +1,128 @@
+// Package protocol is the wire protocol between gofrpserver and
+// gofrpclient. Both binaries use it, so the two sides cannot drift apart.
+//
+// Everything on a connection is a line ending in "\n". A line is either a
+// frame, "NAME" or "NAME:<payload>", or Text: commands from the server and
+// command output from the client. Each frame is a Message type whose
+// String method encodes it; Parse decodes any line.
+//
+// A session starts with Auth and ClientInfo from the client, which the
+// server answers with Hello. Commands are answered with Text lines,
+// ExitStatus and End. Files, screenshots, uploads and updates are framed
+// by a start and an end frame, with Chunk lines (or Text lines of base64
+// for screenshots) in between.
+//
+// Peers that speak FramingVersion or later agree in the hello on
+// compression for each kind of frame; a Conn then sends Chunks as binary
+// frames, escapes Text that starts like a frame and compresses where it
+// pays off, and a Reader on the other side unpacks what it gets.
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Version is the protocol version exchanged in the hello. Clients and
+// servers without a hello speak version 1.
+const Version = 3
+
+// FramingVersion is the first version whose peers read the binary and
+// compressed frames of a Conn
+const FramingVersion = 3
+
+// Message is one line of the protocol
+type Message interface {
+	// String encodes the message, without the line end
+	String() string
+}
+
+// ErrMalformed is returned by Parse for a line that has the name of a
+// frame but a payload that does not decode
+var ErrMalformed = errors.New("malformed frame")
+
+// Write sends msgs, one line each, in a single write. On a Conn they are
+// framed as agreed with the peer.
+func Write(w io.Writer, msgs ...Message) error {
+	if c, ok := w.(*Conn); ok {
+		return c.writeMessages(msgs)
+	}
+	var b strings.Builder
+	for _, m := range msgs {
+		b.WriteString(m.String())
+		b.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Parse decodes one line, with or without its line end. Lines that are no
+// frame come back as Text. A frame whose payload does not decode is an
+// error wrapping ErrMalformed.
+func Parse(line string) (Message, error) {
+	line = strings.TrimRight(line, "\r\n")
+	name, payload, hasPayload := strings.Cut(line, ":")
+	decode, ok := frames[name]
+	if !ok || decode.payload != hasPayload {
+		return Text(line), nil
+	}
+	m, err := decode.parse(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrMalformed, name, err)
+	}
+	return m, nil
+}
+
+// Peek reports whether the next line in r is a frame of the same kind as
+// m, without reading it. Peek waits for as many bytes as the frame's name.
+func Peek(r *bufio.Reader, m Message) bool {
+	name, _, hasPayload := strings.Cut(m.String(), ":")
+	prefix := name + "\n"
+	if hasPayload {
+		prefix = name + ":"
+	}
+	next, _ := r.Peek(len(prefix))
+	return string(next) == prefix
+}
+
+type frame struct {
+	payload bool
+	parse   func(payload string) (Message, error)
+}
+
+// frames decode the payload of each frame by name
+var frames = map[string]frame{
+	authName:            {true, parseAuth},
+	authFailedName:      {false, constant(AuthFailed{})},
+	clientInfoName:      {true, parseClientInfo},
+	helloName:           {true, parseHello},
+	keepAliveName:       {false, constant(KeepAlive{})},
+	keepAliveAckName:    {false, constant(KeepAliveAck{})},
+	metricsName:         {true, parseMetrics},
+	disconnectName:      {false, constant(Disconnect{})},
+	serverShutdownName:  {false, constant(ServerShutdown{})},
+	exitStatusName:      {true, parseExitStatus},
+	endName:             {false, constant(End{})},
+	errorName:           {true, parseError},
+	newConnectionName:   {true, parseNewConnection},
+	newConnFailedName:   {true, parseNewConnFailed},
+	chunkName:           {true, parseChunk},
+	fileStartName:       {true, parseFileStart},
+	fileEndName:         {false, constant(FileEnd{})},
+	screenshotStartName: {true, parseScreenshotStart},
+	screenshotEndName:   {false, constant(ScreenshotEnd{})},
+	uploadStartName:     {true, parseUploadStart},
+	uploadEndName:       {false, constant(UploadEnd{})},
+	updateStartName:     {true, parseUpdateStart},
+	updateEndName:       {false, constant(UpdateEnd{})},
+	limitName:           {true, parseLimit},
+	sendFileName:        {true, parseSendFile},
+	transferName:        {true, parseTransfer},
+}
+
+func constant(m Message) func(string) (Message, error) {
+	return func(string) (Message, error) { return m, nil }
+}